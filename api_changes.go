@@ -0,0 +1,98 @@
+package covidcase
+
+import (
+	"covidcase/db"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ChangePage struct for JSON encoding one page of the change feed
+type ChangePage struct {
+	Changes []db.Change `json:"changes"`
+	Next    string      `json:"next"` // Cursor to pass as since to get the changes after this page
+	More    bool        `json:"more"` // More changes are waiting, no need to wait before asking for them
+}
+
+// HandlerChanges main handler for route related to `/changes` requests
+func HandlerChanges(store db.ChangeStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handleChangesGet(w, r, store)
+		case http.MethodPost:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		case http.MethodPut:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		case http.MethodDelete:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		}
+	}
+}
+
+// handleChangesGet utility function, package level, to list the changes logged after a cursor, oldest first
+func handleChangesGet(w http.ResponseWriter, r *http.Request, store db.ChangeStore) {
+	var page ChangePage
+
+	// Set response to be of JSON type
+	http.Header.Add(w.Header(), "content-type", "application/json")
+	parts := strings.Split(r.URL.Path, "/")
+	// error handling
+	if len(parts) != 4 || parts[3] != "changes" {
+		http.Error(w, "Malformed URL", http.StatusBadRequest)
+		return
+	}
+
+	// Extract optional 'since' and 'limit' parameters, without a cursor the feed is read from its start
+	var since int64
+	raw := r.URL.Query().Get("since")
+	if raw != "" {
+		var err error
+		if since, err = strconv.ParseInt(raw, 10, 64); err != nil || since < 0 {
+			http.Error(w, "Parameter since must be a cursor returned as next", http.StatusBadRequest)
+			return
+		}
+	}
+	limit, ok := queryInt(w, r, "limit", DEFAULTLIMIT, 1, MAXLIMIT)
+	if !ok {
+		return
+	}
+
+	// One more than asked for tells whether another page follows
+	changes, err := store.ListChanges(since, limit+1)
+	if err != nil {
+		http.Error(w, "Could not fetch changes", http.StatusInternalServerError)
+		fmt.Println("Store: " + err.Error())
+		return
+	}
+	// Checked after listing, so changes removed in the meantime cannot go missing unnoticed
+	pruned, err := store.ChangesPruned()
+	if err != nil {
+		http.Error(w, "Could not fetch changes", http.StatusInternalServerError)
+		fmt.Println("Store: " + err.Error())
+		return
+	}
+	if raw != "" && since < pruned {
+		http.Error(w, "Cursor has expired, the changes after it were removed. Start over without since", http.StatusGone)
+		return
+	}
+
+	page.More = len(changes) > limit
+	if page.More {
+		changes = changes[:limit]
+	}
+	page.Changes = []db.Change{}
+	page.Changes = append(page.Changes, changes...)
+	// Without changes the client asks again from the same place, or from the start of what is left
+	next := since
+	if len(changes) > 0 {
+		next = changes[len(changes)-1].ID
+	} else if raw == "" {
+		next = pruned
+	}
+	page.Next = strconv.FormatInt(next, 10)
+
+	// Send result for processing
+	resWithData(w, page)
+}
@@ -0,0 +1,93 @@
+package covidcase
+
+import (
+	"covidcase/db"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestChangeFeed(t *testing.T) {
+	old := time.Now().UTC().Add(-48 * time.Hour)
+	tests := []struct {
+		name  string
+		prune time.Duration // Changes older than this are removed before the request, 0 keeps them
+		query string
+		code  int
+		ids   []int64
+		next  string
+		more  bool
+	}{
+		{"from the start", 0, "", http.StatusOK, []int64{1, 2, 3, 4, 5, 6}, "6", false},
+		{"first page", 0, "limit=2", http.StatusOK, []int64{1, 2}, "2", true},
+		{"page after a cursor", 0, "since=2&limit=3", http.StatusOK, []int64{3, 4, 5}, "5", true},
+		{"up to date", 0, "since=6", http.StatusOK, nil, "6", false},
+		{"from the start of what is left", 24 * time.Hour, "", http.StatusOK, []int64{4, 5, 6}, "6", false},
+		{"from the last change pruned", 24 * time.Hour, "since=3", http.StatusOK, []int64{4, 5, 6}, "6", false},
+		{"pruned cursor", 24 * time.Hour, "since=2", http.StatusGone, nil, "", false},
+		{"pruned first cursor", 24 * time.Hour, "since=0", http.StatusGone, nil, "", false},
+		{"everything pruned", -time.Hour, "", http.StatusOK, nil, "6", false},
+		{"everything pruned, up to date", -time.Hour, "since=6", http.StatusOK, nil, "6", false},
+		{"everything pruned, behind", -time.Hour, "since=5", http.StatusGone, nil, "", false},
+		{"negative cursor", 0, "since=-1", http.StatusBadRequest, nil, "", false},
+		{"malformed cursor", 0, "since=abc", http.StatusBadRequest, nil, "", false},
+		{"limit out of range", 0, "limit=0", http.StatusBadRequest, nil, "", false},
+	}
+	for _, test := range tests {
+		stores, done := testStores(t)
+		for name, store := range stores {
+			// Three changes from two days ago, three from now
+			for id := int64(1); id <= 6; id++ {
+				observed := old
+				if id > 3 {
+					observed = time.Now().UTC()
+				}
+				if err := store.AddChange(db.Change{ID: id, Country: "Norway", Field: "stringency", Value: float64(id), Time: observed}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.prune != 0 {
+				if err := store.PruneChanges(time.Now().Add(-test.prune)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			w := httptest.NewRecorder()
+			HandlerChanges(store)(w, httptest.NewRequest(http.MethodGet, "/corona/v1/changes?"+test.query, nil))
+			if w.Code != test.code {
+				t.Errorf("%s %s: %d %s, want %d", name, test.name, w.Code, w.Body.String(), test.code)
+				continue
+			}
+			if w.Code != http.StatusOK {
+				continue
+			}
+			var page ChangePage
+			if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+			var ids []int64
+			for _, change := range page.Changes {
+				ids = append(ids, change.ID)
+			}
+			if page.Changes == nil || !equalIDs(ids, test.ids) || page.Next != test.next || page.More != test.more {
+				t.Errorf("%s %s: changes %v, next %q, more %v, want %v, %q, %v", name, test.name, ids, page.Next, page.More, test.ids, test.next, test.more)
+			}
+		}
+		done()
+	}
+}
+
+// equalIDs reports whether two lists of change ids are the same
+func equalIDs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
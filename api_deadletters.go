@@ -0,0 +1,203 @@
+package covidcase
+
+import (
+	"covidcase/db"
+	"covidcase/notify"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Redriven struct for JSON encoding the number of dead letters sent for delivery again
+type Redriven struct {
+	Redriven int `json:"redriven"`
+}
+
+// HandlerDeadLetters main handler for route related to `/notifications/{id}/failed` requests
+func HandlerDeadLetters(store db.Store, dispatcher *notify.Dispatcher) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handleDeadLettersGet(w, r, store)
+		case http.MethodPost:
+			handleDeadLettersPost(w, r, store, dispatcher)
+		case http.MethodPut:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		case http.MethodDelete:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		}
+	}
+}
+
+// HandlerDeadLetter main handler for route related to `/notifications/{id}/failed/{failed_id}` requests
+func HandlerDeadLetter(store db.Store, dispatcher *notify.Dispatcher) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handleDeadLetterGet(w, r, store)
+		case http.MethodPost:
+			handleDeadLetterPost(w, r, store, dispatcher)
+		case http.MethodPut:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		case http.MethodDelete:
+			handleDeadLetterDelete(w, r, store)
+		}
+	}
+}
+
+// handleDeadLettersGet utility function, package level, to list the failed deliveries of a webhook
+func handleDeadLettersGet(w http.ResponseWriter, r *http.Request, store db.Store) {
+	// Set response to be of JSON type
+	http.Header.Add(w.Header(), "content-type", "application/json")
+	parts := strings.Split(r.URL.Path, "/")
+	// error handling
+	if len(parts) != 6 || parts[3] != "notifications" || parts[5] != "failed" {
+		http.Error(w, "Malformed URL", http.StatusBadRequest)
+		return
+	}
+
+	// Dead letters of an unknown webhook are a 404 rather than an empty list
+	hook, ok := getWebhook(w, store, p(r, "id"))
+	if !ok {
+		return
+	}
+	deliveries, err := store.ListDeadLetters(hook.ID)
+	if err != nil {
+		http.Error(w, "Could not fetch failed deliveries", http.StatusInternalServerError)
+		fmt.Println("Store: " + err.Error())
+		return
+	}
+	if deliveries == nil { // Encode as an empty list rather than null
+		deliveries = []db.Delivery{}
+	}
+
+	// Send result for processing
+	resWithData(w, deliveries)
+}
+
+// handleDeadLettersPost utility function, package level, to redrive every failed delivery of a webhook
+func handleDeadLettersPost(w http.ResponseWriter, r *http.Request, store db.Store, dispatcher *notify.Dispatcher) {
+	var redriven Redriven
+
+	// Set response to be of JSON type
+	http.Header.Add(w.Header(), "content-type", "application/json")
+	parts := strings.Split(r.URL.Path, "/")
+	// error handling
+	if len(parts) != 6 || parts[3] != "notifications" || parts[5] != "failed" {
+		http.Error(w, "Malformed URL", http.StatusBadRequest)
+		return
+	}
+
+	hook, ok := getWebhook(w, store, p(r, "id"))
+	if !ok {
+		return
+	}
+	deliveries, err := store.ListDeadLetters(hook.ID)
+	if err != nil {
+		http.Error(w, "Could not fetch failed deliveries", http.StatusInternalServerError)
+		fmt.Println("Store: " + err.Error())
+		return
+	}
+	for _, delivery := range deliveries {
+		if err := dispatcher.Redrive(delivery); err != nil {
+			// Report how far we got, the remaining dead letters stay where they are
+			fmt.Println("Redrive: " + err.Error())
+			break
+		}
+		redriven.Redriven++
+	}
+
+	// Deliveries continue in the background
+	w.WriteHeader(http.StatusAccepted)
+	resWithData(w, redriven)
+}
+
+// handleDeadLetterGet utility function, package level, to view one failed delivery
+func handleDeadLetterGet(w http.ResponseWriter, r *http.Request, store db.Store) {
+	// Set response to be of JSON type
+	http.Header.Add(w.Header(), "content-type", "application/json")
+	parts := strings.Split(r.URL.Path, "/")
+	// error handling
+	if len(parts) != 7 || parts[3] != "notifications" || parts[5] != "failed" {
+		http.Error(w, "Malformed URL", http.StatusBadRequest)
+		return
+	}
+
+	delivery, ok := getDeadLetter(w, store, p(r, "id"), p(r, "failed_id"))
+	if !ok {
+		return
+	}
+
+	// Send result for processing
+	resWithData(w, delivery)
+}
+
+// handleDeadLetterPost utility function, package level, to redrive one failed delivery
+func handleDeadLetterPost(w http.ResponseWriter, r *http.Request, store db.Store, dispatcher *notify.Dispatcher) {
+	// Set response to be of JSON type
+	http.Header.Add(w.Header(), "content-type", "application/json")
+	parts := strings.Split(r.URL.Path, "/")
+	// error handling
+	if len(parts) != 7 || parts[3] != "notifications" || parts[5] != "failed" {
+		http.Error(w, "Malformed URL", http.StatusBadRequest)
+		return
+	}
+
+	delivery, ok := getDeadLetter(w, store, p(r, "id"), p(r, "failed_id"))
+	if !ok {
+		return
+	}
+	err := dispatcher.Redrive(delivery)
+	if err == db.ErrNotFound { // Redriven or removed by someone else in the meantime
+		http.Error(w, "Failed delivery not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not redrive delivery", http.StatusInternalServerError)
+		fmt.Println("Redrive: " + err.Error())
+		return
+	}
+
+	// Delivery continues in the background
+	w.WriteHeader(http.StatusAccepted)
+	resWithData(w, Redriven{Redriven: 1})
+}
+
+// handleDeadLetterDelete utility function, package level, to discard one failed delivery
+func handleDeadLetterDelete(w http.ResponseWriter, r *http.Request, store db.Store) {
+	parts := strings.Split(r.URL.Path, "/")
+	// error handling
+	if len(parts) != 7 || parts[3] != "notifications" || parts[5] != "failed" {
+		http.Error(w, "Malformed URL", http.StatusBadRequest)
+		return
+	}
+
+	err := store.DeleteDeadLetter(p(r, "id"), p(r, "failed_id"))
+	if err == db.ErrNotFound {
+		http.Error(w, "Failed delivery not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not delete failed delivery", http.StatusInternalServerError)
+		fmt.Println("Store: " + err.Error())
+		return
+	}
+
+	// Nothing left to send back
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getDeadLetter fetches a failed delivery from the store, writing an error response and returning false if that fails
+func getDeadLetter(w http.ResponseWriter, store db.Store, webhookID, id string) (db.Delivery, bool) {
+	delivery, err := store.GetDeadLetter(webhookID, id)
+	if err == db.ErrNotFound {
+		http.Error(w, "Failed delivery not found", http.StatusNotFound)
+		return delivery, false
+	}
+	if err != nil {
+		http.Error(w, "Could not fetch failed delivery", http.StatusInternalServerError)
+		fmt.Println("Store: " + err.Error())
+		return delivery, false
+	}
+	return delivery, true
+}
@@ -0,0 +1,108 @@
+package covidcase
+
+import (
+	"covidcase/db"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const DEFAULTLIMIT = 20 // Items per page when no limit is given
+const MAXLIMIT = 100    // Largest page a client may ask for
+
+// DeliveryPage struct for JSON encoding one page of a webhook's delivery history
+type DeliveryPage struct {
+	Total      int               `json:"total"` // Matching attempts across all pages
+	Offset     int               `json:"offset"`
+	Limit      int               `json:"limit"`
+	Deliveries []db.HistoryEntry `json:"deliveries"`
+}
+
+// HandlerDeliveries main handler for route related to `/notifications/{id}/deliveries` requests
+func HandlerDeliveries(store db.Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handleDeliveriesGet(w, r, store)
+		case http.MethodPost:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		case http.MethodPut:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		case http.MethodDelete:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		}
+	}
+}
+
+// handleDeliveriesGet utility function, package level, to list the recent delivery attempts of a webhook
+func handleDeliveriesGet(w http.ResponseWriter, r *http.Request, store db.Store) {
+	var page DeliveryPage
+
+	// Set response to be of JSON type
+	http.Header.Add(w.Header(), "content-type", "application/json")
+	parts := strings.Split(r.URL.Path, "/")
+	// error handling
+	if len(parts) != 6 || parts[3] != "notifications" || parts[5] != "deliveries" {
+		http.Error(w, "Malformed URL", http.StatusBadRequest)
+		return
+	}
+
+	// Extract optional 'status', 'limit' and 'offset' parameters
+	status := r.URL.Query().Get("status")
+	if status != "" && status != "success" && status != "failure" {
+		http.Error(w, "Status must be success or failure", http.StatusBadRequest)
+		return
+	}
+	var ok bool
+	if page.Limit, ok = queryInt(w, r, "limit", DEFAULTLIMIT, 1, MAXLIMIT); !ok {
+		return
+	}
+	if page.Offset, ok = queryInt(w, r, "offset", 0, 0, -1); !ok {
+		return
+	}
+
+	hook, ok := getWebhook(w, store, p(r, "id"))
+	if !ok {
+		return
+	}
+	entries, err := store.ListHistory(hook.ID)
+	if err != nil {
+		http.Error(w, "Could not fetch delivery history", http.StatusInternalServerError)
+		fmt.Println("Store: " + err.Error())
+		return
+	}
+
+	// Filter on outcome, then cut out the requested page
+	page.Deliveries = []db.HistoryEntry{}
+	for _, entry := range entries {
+		if status == "" || entry.Success == (status == "success") {
+			if page.Total >= page.Offset && len(page.Deliveries) < page.Limit {
+				page.Deliveries = append(page.Deliveries, entry)
+			}
+			page.Total++
+		}
+	}
+
+	// Send result for processing
+	resWithData(w, page)
+}
+
+// queryInt reads an optional integer query parameter within [min, max] (no upper bound if max < 0),
+// writing an error response and returning false if it is malformed
+func queryInt(w http.ResponseWriter, r *http.Request, key string, def, min, max int) (int, bool) {
+	raw := r.URL.Query().Get(key)
+	if raw == "" {
+		return def, true
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < min || (max >= 0 && value > max) {
+		if max >= 0 {
+			http.Error(w, fmt.Sprintf("Parameter %s must be a number from %d to %d", key, min, max), http.StatusBadRequest)
+		} else {
+			http.Error(w, fmt.Sprintf("Parameter %s must be a number from %d", key, min), http.StatusBadRequest)
+		}
+		return 0, false
+	}
+	return value, true
+}
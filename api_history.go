@@ -0,0 +1,208 @@
+package covidcase
+
+import (
+	"covidcase/db"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/middleware"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const HEADERAPIKEY = "X-API-Key" // Request header labelling the client in the audit log instead of its address, not checked
+const REDACTED = "[redacted]"    // Stands in for secrets in the audit log
+
+// fingerprintKey keys the fingerprints of API keys and secrets, random unless set with SetFingerprintKey
+var fingerprintKey = randomKey()
+
+// AuditPage struct for JSON encoding one page of the audit log of a webhook
+type AuditPage struct {
+	Total   int             `json:"total"` // Entries across all pages
+	Offset  int             `json:"offset"`
+	Limit   int             `json:"limit"`
+	Entries []db.AuditEntry `json:"entries"`
+}
+
+// HandlerHistory main handler for route related to `/notifications/{id}/history` requests
+func HandlerHistory(store db.Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handleHistoryGet(w, r, store)
+		case http.MethodPost:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		case http.MethodPut:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		case http.MethodDelete:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		}
+	}
+}
+
+// handleHistoryGet utility function, package level, to list the changes made to a webhook, oldest first
+func handleHistoryGet(w http.ResponseWriter, r *http.Request, store db.Store) {
+	var page AuditPage
+
+	// Set response to be of JSON type
+	http.Header.Add(w.Header(), "content-type", "application/json")
+	parts := strings.Split(r.URL.Path, "/")
+	// error handling
+	if len(parts) != 6 || parts[3] != "notifications" || parts[5] != "history" {
+		http.Error(w, "Malformed URL", http.StatusBadRequest)
+		return
+	}
+
+	// Extract optional 'limit' and 'offset' parameters
+	var ok bool
+	if page.Limit, ok = queryInt(w, r, "limit", DEFAULTLIMIT, 1, MAXLIMIT); !ok {
+		return
+	}
+	if page.Offset, ok = queryInt(w, r, "offset", 0, 0, -1); !ok {
+		return
+	}
+
+	// The log outlives the webhook, so deleted webhooks are looked up in the log rather than the store
+	entries, err := store.ListAuditEntries(p(r, "id"))
+	if err != nil {
+		http.Error(w, "Could not fetch webhook history", http.StatusInternalServerError)
+		fmt.Println("Store: " + err.Error())
+		return
+	}
+	if len(entries) == 0 {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	// Cut out the requested page
+	page.Total = len(entries)
+	page.Entries = []db.AuditEntry{}
+	if page.Offset < len(entries) {
+		entries = entries[page.Offset:]
+		if len(entries) > page.Limit {
+			entries = entries[:page.Limit]
+		}
+		page.Entries = entries
+	}
+
+	// Send result for processing
+	resWithData(w, page)
+}
+
+// audit appends a change made by a request to the log of the webhook, before is nil on creation and after on deletion.
+// Requests that changed nothing are not logged, failing to log is only reported internally.
+func audit(r *http.Request, store db.AuditStore, action string, before, after *db.Webhook) {
+	changes := diff(before, after)
+	if len(changes) == 0 {
+		return
+	}
+	entry := db.AuditEntry{
+		Action:    action,
+		Actor:     actor(r),
+		RequestID: middleware.GetReqID(r.Context()),
+		Changes:   changes,
+	}
+	if after != nil {
+		entry.WebhookID = after.ID
+	} else {
+		entry.WebhookID = before.ID
+	}
+	if _, err := store.AddAuditEntry(entry); err != nil {
+		fmt.Println("Audit: " + err.Error())
+	}
+}
+
+// actor identifies who made a request, by a fingerprint of its API key if it sent one, otherwise by the client
+// address middleware.RealIP took from the proxy headers.
+// The API has no authentication, so the key is whatever the caller sent: it tells apart clients that keep their key
+// to themselves, it does not prove who made a change
+func actor(r *http.Request) string {
+	if key := r.Header.Get(HEADERAPIKEY); key != "" {
+		// Never store the key itself, the fingerprint is enough to tell keys apart
+		return "key:" + fingerprint(key)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil { // RealIP leaves out the port
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// diff lists the settings that differ between two versions of a webhook by their JSON names, sorted by name,
+// with the signing secrets redacted
+func diff(before, after *db.Webhook) []db.FieldChange {
+	was, is := fields(before), fields(after)
+	names := make([]string, 0, len(was)+len(is))
+	for name := range was {
+		names = append(names, name)
+	}
+	for name := range is {
+		if _, ok := was[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := []db.FieldChange{}
+	for _, name := range names {
+		if !reflect.DeepEqual(was[name], is[name]) {
+			changes = append(changes, db.FieldChange{Field: name, Before: was[name], After: is[name]})
+		}
+	}
+	return changes
+}
+
+// fields returns the settings of a webhook by their JSON names, left out where unset and secrets redacted
+func fields(hook *db.Webhook) map[string]interface{} {
+	values := map[string]interface{}{}
+	if hook == nil {
+		return values
+	}
+	// Encoding and decoding again gives the names and values clients see
+	data, err := json.Marshal(redact(*hook))
+	if err != nil {
+		fmt.Println("Audit: " + err.Error())
+		return values
+	}
+	if err := json.Unmarshal(data, &values); err != nil {
+		fmt.Println("Audit: " + err.Error())
+		return values
+	}
+	// A rotation shows up as a change of a redacted secret
+	if hook.Secret != "" {
+		values["secret"] = REDACTED + " " + fingerprint(hook.Secret)
+	}
+	if hook.PreviousSecret != "" {
+		values["previous_secret"] = REDACTED + " " + fingerprint(hook.PreviousSecret)
+	}
+	return values
+}
+
+// SetFingerprintKey sets the server-side key of fingerprints, the same key gives the same fingerprints after a restart.
+// It has to be called before requests are served
+func SetFingerprintKey(key string) {
+	fingerprintKey = []byte(key)
+}
+
+// fingerprint returns a short keyed hash telling keys and secrets apart in the audit log without giving them away.
+// Without the server-side key, guessed keys and secrets cannot be checked against it
+func fingerprint(secret string) string {
+	mac := hmac.New(sha256.New, fingerprintKey)
+	mac.Write([]byte(secret))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// randomKey returns a new random fingerprint key
+func randomKey() []byte {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil { // Error handling random source, nothing works without one
+		panic(err)
+	}
+	return key
+}
@@ -2,8 +2,11 @@ package covidcase
 
 import (
 	"covidcase/country"
+	"covidcase/db"
+	"covidcase/notify"
 	"covidcase/policy"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-chi/chi"
 	"html/template"
@@ -18,20 +21,12 @@ var appStart time.Time // Uptime variable
 
 // Diagnose struct for JSON encoding
 type Diagnose struct {
-	Mmediagroupapi  string  `json:"mmediagroupapi"`
-	Covidtrackerapi string  `json:"covidtrackerapi"`
-	Registered      float64 `json:"registered"`
-	Version         string  `json:"version"`
-	Uptime          string  `json:"uptime"`
-}
-
-// WebhookForm struct for JSON decoding
-type WebhookForm struct {
-	URL     string  `json:"url"`
-	Timeout float64 `json:"timeout"`
-	Field   string  `json:"field"`
-	Country string  `json:"country"`
-	Trigger string  `json:"trigger"`
+	Mmediagroupapi  string              `json:"mmediagroupapi"`
+	Covidtrackerapi string              `json:"covidtrackerapi"`
+	Registered      float64             `json:"registered"`
+	Version         string              `json:"version"`
+	Uptime          string              `json:"uptime"`
+	Destinations    []notify.HostStatus `json:"destinations"` // Circuit breaker and load per webhook destination host
 }
 
 /*
@@ -57,38 +52,6 @@ func HandlerLostUser(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// HandlerNotification main handler for route related to `/notification/{id}` requests
-func HandlerNotification() func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodGet:
-			//handleNotificationsGet(w, r)
-		case http.MethodPost:
-			//handleNotificationPost(w, r)
-		case http.MethodPut:
-			http.Error(w, "Not implemented", http.StatusNotImplemented)
-		case http.MethodDelete:
-			http.Error(w, "Not implemented", http.StatusNotImplemented)
-		}
-	}
-}
-
-// HandlerNotifications main handler for route related to `/notification` requests
-func HandlerNotifications() func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodGet:
-			//handleNotificationsGet(w, r)
-		case http.MethodPost:
-			handleNotificationsPost(w, r)
-		case http.MethodPut:
-			http.Error(w, "Not implemented", http.StatusNotImplemented)
-		case http.MethodDelete:
-			http.Error(w, "Not implemented", http.StatusNotImplemented)
-		}
-	}
-}
-
 // HandlerCountry main handler for route related to `/country` requests
 func HandlerCountry() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -122,12 +85,12 @@ func HandlerPolicy() func(http.ResponseWriter, *http.Request) {
 }
 
 // HandlerDiag main handler for route related to `/diag` requests
-func HandlerDiag(t time.Time) func(http.ResponseWriter, *http.Request) {
+func HandlerDiag(t time.Time, store db.WebhookStore, dispatcher *notify.Dispatcher) func(http.ResponseWriter, *http.Request) {
 	appStart = t // Pass application start time for multiple function access
 	return func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
-			handleDiagGet(w, r)
+			handleDiagGet(w, r, store, dispatcher)
 		case http.MethodPost:
 			http.Error(w, "Not implemented", http.StatusNotImplemented)
 		case http.MethodPut:
@@ -161,11 +124,29 @@ func handleCountryGet(w http.ResponseWriter, r *http.Request) {
 	// Request covid info for queried country
 
 	result, err := country.GetCountryData(sDate, eDate, countryName)
-	if err != nil { // Error handling bad request parameter for countryName
+	if errors.Is(err, country.ErrUnknownCountry) { // Error handling bad request parameter for countryName
+		http.Error(w, "No cases for country "+countryName, http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, country.ErrDateNotAvailable) { // Error handling scope outside the history of the country
+		http.Error(w, "Scope not available, "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if errors.Is(err, country.ErrSchemaChanged) { // Error handling data the API no longer sends as expected
+		http.Error(w, "Unexpected response from API server", http.StatusBadGateway)
+		fmt.Println("Cases API: " + err.Error())
+		return
+	}
+	if errors.Is(err, country.ErrUpstream) { // Error handling the API answering with an error of its own
+		http.Error(w, "API server could not answer", http.StatusBadGateway)
+		fmt.Println("Cases API: " + err.Error())
+		return
+	}
+	if err != nil {
 		// In case of no server response, reply with 500
 		http.Error(w, "Could not contact API server", http.StatusInternalServerError)
-		// Error could also be a 400, but we print that only internally
-		fmt.Println("HTTP status: " + err.Error())
+		fmt.Println("HTTP request: " + err.Error())
+		return
 	}
 
 	// Send result for processing
@@ -198,56 +179,15 @@ func handlePolicyGet(w http.ResponseWriter, r *http.Request) {
 	if err != nil { // Error handling bad request parameter for params
 		// In case of no server response, reply with 500
 		http.Error(w, "Could not contact API server", http.StatusInternalServerError)
-		// Error could also be a 400, but we print that only internally
-		fmt.Println("HTTP status: " + err.Error())
+		fmt.Println("HTTP request: " + err.Error())
 	}
 
 	// Send result for processing
 	resWithData(w, result)
 }
 
-// handleNotificationsPost utility function, package level, to handle POST request to notification route
-func handleNotificationsPost(w http.ResponseWriter, r *http.Request) {
-	var webhookForm WebhookForm
-
-	// Set response to be of JSON type
-	http.Header.Add(w.Header(), "content-type", "application/json")
-	parts := strings.Split(r.URL.Path, "/")
-	// error handling
-	if len(parts) != 5 || parts[3] != "notifications" {
-		http.Error(w, "Malformed URL", http.StatusBadRequest)
-		return
-	}
-
-	/*  JSON example for Body
-		{
-	    "url": "https://localhost:8080/client/",
-		"timeout": 3600,
-		"field": "stringency",
-		"country": "France",
-		"trigger": "ON_CHANGE"
-		}
-	*/
-
-	// Decode JSON body
-	err := json.NewDecoder(r.Body).Decode(&webhookForm)
-	if err != nil {
-		switch err := err.(type) {
-		case *json.SyntaxError:
-			fmt.Printf("json syntax error: %s at offset %d\n", err, err.Offset)
-			http.Error(w, "Malformed Body", http.StatusBadRequest)
-		default:
-			fmt.Printf("json default: %s", err)
-			http.Error(w, "Error in JSON", http.StatusBadRequest)
-		}
-	}
-
-	// Send result for processing
-	resWithData(w, "resData")
-}
-
 // handleDiagGet utility function, package level, to handle GET request to diag route
-func handleDiagGet(w http.ResponseWriter, r *http.Request) {
+func handleDiagGet(w http.ResponseWriter, r *http.Request, store db.WebhookStore, dispatcher *notify.Dispatcher) {
 	var diag Diagnose
 	var err error
 	// Set response to be of JSON type
@@ -271,18 +211,26 @@ func handleDiagGet(w http.ResponseWriter, r *http.Request) {
 		fmt.Println("HTTP status: " + err.Error())
 	}
 	// Insert number of registered webhooks
-	diag.Registered = 0 // TODO update to fetch number of webhooks!!!
+	registered, countErr := store.Count()
+	if countErr != nil {
+		// Store unreachable, report no webhooks but print internally
+		fmt.Println("Store: " + countErr.Error())
+	}
+	diag.Registered = float64(registered)
 	// Insert API version
 	diag.Version = "v1"
 	// Insert API uptime in hr min sec
 	diag.Uptime = time.Since(appStart).String()
+	// Insert state of deliveries per destination host
+	diag.Destinations = dispatcher.Hosts()
 	// Encode diagnostic report
-	report, _ := json.Marshal(diag)
+	report, err := json.Marshal(diag)
 	if err != nil {
 		// In case of no server response, reply with 500
 		http.Error(w, "Could not process request", http.StatusInternalServerError)
 		// Error could also be a 400 or failure in decoding, but we print that only internally
 		fmt.Println("Encode: " + err.Error())
+		return
 	}
 	// Send status and diagnostic report
 	w.WriteHeader(http.StatusOK)
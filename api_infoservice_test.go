@@ -0,0 +1,33 @@
+package covidcase
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+)
+
+// statusTransport answers every request with its status and an empty body
+type statusTransport int
+
+func (s statusTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: int(s), Status: http.StatusText(int(s)), Header: make(http.Header),
+		Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+}
+
+func TestCountryUpstreamError(t *testing.T) {
+	transport := http.DefaultClient.Transport
+	http.DefaultClient.Transport = statusTransport(http.StatusServiceUnavailable)
+	defer func() { http.DefaultClient.Transport = transport }()
+
+	router := chi.NewRouter()
+	router.Get("/corona/v1/country/{country_name:[A-Za-z]+}", HandlerCountry())
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/corona/v1/country/norway", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("cases API answering 503 gave %d %s, want 502", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,762 @@
+package covidcase
+
+import (
+	"covidcase/db"
+	"covidcase/notify"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const MAXBODY = 64 * 1024 // Largest request body accepted for a webhook, in bytes
+
+const HEADERIDEMPOTENCY = "Idempotency-Key"  // Request header making a registration safe to retry
+const HEADERREPLAYED = "Idempotent-Replayed" // Response header set when a registration is answered from its key
+const MAXKEYLEN = 255                        // Longest idempotency key accepted
+const KEYPENDING = time.Minute               // Time after which a request that never finished gives up its key
+const DEFAULTKEYTTL = 24 * time.Hour         // Time an idempotency key is remembered when nothing else is set
+
+// WebhookForm struct for JSON decoding
+type WebhookForm struct {
+	URL         string   `json:"url"`
+	Channel     string   `json:"channel"`      // "http" (default), "email", "slack" or "teams"
+	To          []string `json:"to"`           // Required by email, recipient addresses
+	Subject     string   `json:"subject"`      // Optional subject line for email
+	Template    string   `json:"template"`     // Optional text/template for the payload
+	ContentType string   `json:"content_type"` // Content type of the rendered template, JSON by default
+	Timeout     float64  `json:"timeout"`
+	Field       string   `json:"field"`
+	Country     string   `json:"country"`    // A single country, or "*" for all
+	Countries   []string `json:"countries"`  // Instead of country, a list of countries
+	Continent   string   `json:"continent"`  // Instead of country, every country on it
+	Mode        string   `json:"mode"`       // "single" (default), "batch" or "digest" notifications
+	Window      string   `json:"window"`     // Required by digests, "hourly", "daily" or "weekly"
+	SkipEmpty   bool     `json:"skip_empty"` // Digests of windows without events are not sent
+	Trigger     string   `json:"trigger"`
+	Threshold   *float64 `json:"threshold"` // Required by ABOVE, BELOW and CROSSES triggers
+	Condition   string   `json:"condition"` // Required by CONDITION triggers, replaces field
+	Secret      string   `json:"secret"`    // Optional, generated if left out
+}
+
+// WebhookPage struct for JSON encoding one page of registered webhooks
+type WebhookPage struct {
+	Total    int          `json:"total"` // Matching webhooks across all pages
+	Limit    int          `json:"limit"`
+	Next     string       `json:"next,omitempty"` // Cursor for the page after this one, left out on the last page
+	Webhooks []db.Webhook `json:"webhooks"`
+}
+
+// ProblemResponse struct for JSON encoding everything wrong with a request
+type ProblemResponse struct {
+	Error    string           `json:"error"`
+	Problems []notify.Problem `json:"problems"`
+}
+
+// WebhookID struct for JSON encoding the id and signing secret of a newly registered webhook
+type WebhookID struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret,omitempty"` // Left out when a retry is answered, the secret is only sent once
+}
+
+// HandlerNotification main handler for route related to `/notification/{id}` requests
+func HandlerNotification(store db.Store, dispatcher *notify.Dispatcher) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handleNotificationGet(w, r, store)
+		case http.MethodPost:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		case http.MethodPut:
+			handleNotificationPut(w, r, store, dispatcher)
+		case http.MethodPatch:
+			handleNotificationPatch(w, r, store, dispatcher)
+		case http.MethodDelete:
+			handleNotificationDelete(w, r, store, dispatcher)
+		}
+	}
+}
+
+// HandlerNotifications main handler for route related to `/notification` requests
+func HandlerNotifications(store db.Store, dispatcher *notify.Dispatcher, keyTTL time.Duration) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handleNotificationsGet(w, r, store)
+		case http.MethodPost:
+			handleNotificationsPost(w, r, store, dispatcher, keyTTL)
+		case http.MethodPut:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		case http.MethodDelete:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		}
+	}
+}
+
+// handleNotificationsGet utility function, package level, to list registered webhooks a page at a time
+func handleNotificationsGet(w http.ResponseWriter, r *http.Request, store db.WebhookStore) {
+	var page WebhookPage
+
+	// Set response to be of JSON type
+	http.Header.Add(w.Header(), "content-type", "application/json")
+	parts := strings.Split(r.URL.Path, "/")
+	// error handling
+	if len(parts) != 5 || parts[3] != "notifications" {
+		http.Error(w, "Malformed URL", http.StatusBadRequest)
+		return
+	}
+
+	// Extract optional 'country', 'field', 'trigger', 'status', 'sort', 'limit' and 'cursor' parameters
+	query := r.URL.Query()
+	status := query.Get("status")
+	if status != "" && status != "active" && status != "paused" && status != "suspended" {
+		http.Error(w, "Status must be active, paused or suspended", http.StatusBadRequest)
+		return
+	}
+	newest := false // Oldest first unless sorted by "-created"
+	switch query.Get("sort") {
+	case "", "created":
+	case "-created":
+		newest = true
+	default:
+		http.Error(w, "Sort must be created or -created", http.StatusBadRequest)
+		return
+	}
+	var ok bool
+	if page.Limit, ok = queryInt(w, r, "limit", DEFAULTLIMIT, 1, MAXLIMIT); !ok {
+		return
+	}
+	var after *cursor
+	if raw := query.Get("cursor"); raw != "" {
+		decoded, err := decodeCursor(raw)
+		if err != nil {
+			http.Error(w, "Malformed cursor", http.StatusBadRequest)
+			return
+		}
+		after = &decoded
+	}
+
+	hooks, err := store.List()
+	if err != nil {
+		http.Error(w, "Could not fetch webhooks", http.StatusInternalServerError)
+		fmt.Println("Store: " + err.Error())
+		return
+	}
+
+	// Sort by creation time, ties broken by id so the order and therefore the cursors are stable
+	sort.Slice(hooks, func(i, j int) bool {
+		if newest {
+			return cursorOf(hooks[j]).before(cursorOf(hooks[i]))
+		}
+		return cursorOf(hooks[i]).before(cursorOf(hooks[j]))
+	})
+
+	// Filter, then take the page following the cursor
+	page.Webhooks = []db.Webhook{}
+	for _, hook := range hooks {
+		if !matches(hook, query.Get("country"), query.Get("field"), query.Get("trigger"), status) {
+			continue
+		}
+		page.Total++
+		if after != nil && !after.follows(cursorOf(hook), newest) {
+			continue
+		}
+		if len(page.Webhooks) == page.Limit {
+			// There is more, continue after the last webhook of this page
+			page.Next = cursorOf(page.Webhooks[len(page.Webhooks)-1]).encode()
+			continue
+		}
+		page.Webhooks = append(page.Webhooks, redact(hook))
+	}
+
+	// Send result for processing
+	resWithData(w, page)
+}
+
+// handleNotificationsPost utility function, package level, to handle POST request to notification route
+func handleNotificationsPost(w http.ResponseWriter, r *http.Request, store db.Store, dispatcher *notify.Dispatcher, keyTTL time.Duration) {
+	var webhookForm WebhookForm
+
+	// Set response to be of JSON type
+	http.Header.Add(w.Header(), "content-type", "application/json")
+	parts := strings.Split(r.URL.Path, "/")
+	// error handling
+	if len(parts) != 5 || parts[3] != "notifications" {
+		http.Error(w, "Malformed URL", http.StatusBadRequest)
+		return
+	}
+
+	/*  JSON example for Body
+		{
+	    "url": "https://localhost:8080/client/",
+		"timeout": 3600,
+		"field": "stringency",
+		"country": "France, or * for all",
+		"countries": ["instead of country", "a list of countries"],
+		"continent": "instead of country, e.g. Europe",
+		"mode": "single or batch, optional",
+		"trigger": "ON_CHANGE",
+		"threshold": "number, only for ABOVE, BELOW and CROSSES",
+		"condition": "expression such as stringency < 40 && trend < 0, only for CONDITION",
+		"secret": "optional, at least 16 characters"
+		}
+	*/
+
+	// Decode JSON body
+	if !decodeForm(w, r, &webhookForm) {
+		return
+	}
+
+	// A retried request with an idempotency key is answered with the registration it made the first time
+	key, ok := claimKey(w, r, store, webhookForm, keyTTL)
+	if !ok {
+		return
+	}
+	// The key is given up on failure, so the request can be fixed and sent again under it
+	registered := false
+	if key != nil {
+		defer func() {
+			if !registered {
+				if err := store.DeleteIdempotencyKey(*key); err != nil {
+					fmt.Println("Store: " + err.Error())
+				}
+			}
+		}()
+	}
+
+	// Reject anything that could never be notified, all problems at once
+	if !checkWebhook(w, r, dispatcher, webhookForm.toWebhook()) {
+		return
+	}
+
+	// Use the client's signing secret or generate one
+	var err error
+	if webhookForm.Secret == "" {
+		webhookForm.Secret, err = notify.NewSecret()
+		if err != nil {
+			http.Error(w, "Could not register webhook", http.StatusInternalServerError)
+			fmt.Println("Secret: " + err.Error())
+			return
+		}
+	}
+
+	// Store registration
+	hook, err := store.Create(webhookForm.toWebhook())
+	if err != nil {
+		http.Error(w, "Could not register webhook", http.StatusInternalServerError)
+		fmt.Println("Store: " + err.Error())
+		return
+	}
+	registered = true
+	audit(r, store, "create", nil, &hook)
+	// Start evaluating the new registration
+	dispatcher.Watch(hook)
+
+	// Remember what the key registered, a retry in the meantime is told to wait
+	if key != nil {
+		done := *key
+		done.WebhookID = hook.ID
+		if swapped, err := store.SwapIdempotencyKey(*key, done); err != nil {
+			fmt.Println("Store: " + err.Error())
+		} else if !swapped {
+			fmt.Println("Idempotency key was taken over while webhook " + hook.ID + " was registered")
+		}
+	}
+
+	// Send id of the new registration, this is the only response carrying the secret
+	w.WriteHeader(http.StatusCreated)
+	resWithData(w, WebhookID{ID: hook.ID, Secret: hook.Secret})
+}
+
+// claimKey claims the idempotency key of a registration request, if it has one, writing the response and
+// returning false if the request was made before. A nil key means the request has none. Keys are scoped to the
+// client sending them, so one client cannot replay the registration of another by guessing its key.
+func claimKey(w http.ResponseWriter, r *http.Request, store db.Store, webhookForm WebhookForm, keyTTL time.Duration) (*db.IdempotencyKey, bool) {
+	name := r.Header.Get(HEADERIDEMPOTENCY)
+	if name == "" {
+		return nil, true
+	}
+	if len(name) > MAXKEYLEN {
+		http.Error(w, fmt.Sprintf("%s must be at most %d characters", HEADERIDEMPOTENCY, MAXKEYLEN), http.StatusBadRequest)
+		return nil, false
+	}
+
+	// Fingerprint the decoded form, so a retry differing only in whitespace or field order is the same request
+	form, err := json.Marshal(webhookForm)
+	if err != nil {
+		http.Error(w, "Could not register webhook", http.StatusInternalServerError)
+		fmt.Println("Encode: " + err.Error())
+		return nil, false
+	}
+	sum := sha256.Sum256(form)
+	// Firestore keeps microseconds, the time must read back the same for the key to be swapped
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	key := db.IdempotencyKey{Key: actor(r) + " " + name, Hash: hex.EncodeToString(sum[:]), Created: now, Expires: now.Add(keyTTL)}
+
+	existing, claimed, err := store.ClaimIdempotencyKey(key, now)
+	if err != nil {
+		http.Error(w, "Could not register webhook", http.StatusInternalServerError)
+		fmt.Println("Store: " + err.Error())
+		return nil, false
+	}
+	if claimed {
+		return &key, true
+	}
+
+	// Used before, only the same request gets the same answer
+	if existing.Hash != key.Hash {
+		http.Error(w, HEADERIDEMPOTENCY+" was already used for a different request", http.StatusConflict)
+		return nil, false
+	}
+	if existing.WebhookID == "" {
+		// A request that never finished, e.g. because the server went down, does not hold on to the key for long.
+		// Only one of several retries taking over at the same time gets it.
+		if now.Sub(existing.Created) > KEYPENDING {
+			swapped, err := store.SwapIdempotencyKey(existing, key)
+			if err != nil {
+				http.Error(w, "Could not register webhook", http.StatusInternalServerError)
+				fmt.Println("Store: " + err.Error())
+				return nil, false
+			}
+			if swapped {
+				return &key, true
+			}
+		}
+		http.Error(w, "A request with this "+HEADERIDEMPOTENCY+" is still in progress, retry later", http.StatusConflict)
+		return nil, false
+	}
+	hook, err := store.Get(existing.WebhookID)
+	if err == db.ErrNotFound {
+		http.Error(w, "The webhook registered with this "+HEADERIDEMPOTENCY+" has since been deleted", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Could not fetch webhook", http.StatusInternalServerError)
+		fmt.Println("Store: " + err.Error())
+		return nil, false
+	}
+	// The secret is not sent again, whoever holds the key may not be the one who registered
+	w.Header().Set(HEADERREPLAYED, "true")
+	w.WriteHeader(http.StatusCreated)
+	resWithData(w, WebhookID{ID: hook.ID})
+	return nil, false
+}
+
+// handleNotificationGet utility function, package level, to handle GET request to a single notification
+func handleNotificationGet(w http.ResponseWriter, r *http.Request, store db.WebhookStore) {
+	// Set response to be of JSON type
+	http.Header.Add(w.Header(), "content-type", "application/json")
+	parts := strings.Split(r.URL.Path, "/")
+	// error handling
+	if len(parts) != 5 || parts[3] != "notifications" {
+		http.Error(w, "Malformed URL", http.StatusBadRequest)
+		return
+	}
+
+	hook, ok := getWebhook(w, store, p(r, "id"))
+	if !ok {
+		return
+	}
+
+	// Send result for processing
+	resWithData(w, redact(hook))
+}
+
+// handleNotificationPut utility function, package level, to replace the settings of a single notification
+func handleNotificationPut(w http.ResponseWriter, r *http.Request, store db.Store, dispatcher *notify.Dispatcher) {
+	var webhookForm WebhookForm
+
+	// Set response to be of JSON type
+	http.Header.Add(w.Header(), "content-type", "application/json")
+	parts := strings.Split(r.URL.Path, "/")
+	// error handling
+	if len(parts) != 5 || parts[3] != "notifications" {
+		http.Error(w, "Malformed URL", http.StatusBadRequest)
+		return
+	}
+
+	hook, ok := getWebhook(w, store, p(r, "id"))
+	if !ok {
+		return
+	}
+
+	// Decode JSON body, same as for registration but without the secret
+	if !decodeForm(w, r, &webhookForm) {
+		return
+	}
+	updateWebhook(w, r, store, dispatcher, hook, webhookForm)
+}
+
+// handleNotificationPatch utility function, package level, to change some of the settings of a single notification
+func handleNotificationPatch(w http.ResponseWriter, r *http.Request, store db.Store, dispatcher *notify.Dispatcher) {
+	// Set response to be of JSON type
+	http.Header.Add(w.Header(), "content-type", "application/json")
+	parts := strings.Split(r.URL.Path, "/")
+	// error handling
+	if len(parts) != 5 || parts[3] != "notifications" {
+		http.Error(w, "Malformed URL", http.StatusBadRequest)
+		return
+	}
+
+	hook, ok := getWebhook(w, store, p(r, "id"))
+	if !ok {
+		return
+	}
+
+	/*  JSON example for Body, fields left out keep their value and null clears threshold
+	{
+	"timeout": 600,
+	"trigger": "ON_CHANGE",
+	"threshold": null
+	}
+	*/
+
+	// Decode JSON body over the current settings
+	webhookForm := fromWebhook(hook)
+	if !decodeForm(w, r, &webhookForm) {
+		return
+	}
+	updateWebhook(w, r, store, dispatcher, hook, webhookForm)
+}
+
+// updateWebhook validates and stores the settings in webhookForm for hook, then sends back the result
+func updateWebhook(w http.ResponseWriter, r *http.Request, store db.Store, dispatcher *notify.Dispatcher, hook db.Webhook, webhookForm WebhookForm) {
+	if webhookForm.Secret != "" {
+		problems := &notify.ValidationError{}
+		problems.Add("secret", "cannot be changed here, rotate it through /secret")
+		resProblems(w, http.StatusBadRequest, problems)
+		return
+	}
+
+	// Same rules as for registration
+	updated := keepState(webhookForm.toWebhook(), hook)
+	if !checkWebhook(w, r, dispatcher, updated) {
+		return
+	}
+
+	// Take the new settings over the webhook as stored by then, so a rotation, pause or health update in the
+	// meantime is kept
+	before, updated, ok := modifyWebhook(w, store, hook.ID, func(current *db.Webhook) {
+		*current = keepState(updated, *current)
+	})
+	if !ok {
+		return
+	}
+	audit(r, store, "update", &before, &updated)
+	// Evaluate with the new settings from now on
+	refresh(dispatcher, updated.ID)
+
+	// Send result for processing
+	resWithData(w, redact(updated))
+}
+
+// keepState returns the settings of hook with the identity, secrets, paused state and health of current
+func keepState(hook, current db.Webhook) db.Webhook {
+	hook.ID = current.ID
+	hook.Created = current.Created
+	hook.Paused = current.Paused
+	hook.Health = current.Health
+	hook.Suspended = current.Suspended
+	hook.Secret = current.Secret
+	hook.PreviousSecret = current.PreviousSecret
+	hook.PreviousSecretExpires = current.PreviousSecretExpires
+	return hook
+}
+
+// handleNotificationDelete utility function, package level, to handle DELETE request to a single notification
+func handleNotificationDelete(w http.ResponseWriter, r *http.Request, store db.Store, dispatcher *notify.Dispatcher) {
+	parts := strings.Split(r.URL.Path, "/")
+	// error handling
+	if len(parts) != 5 || parts[3] != "notifications" {
+		http.Error(w, "Malformed URL", http.StatusBadRequest)
+		return
+	}
+
+	// Fetched first, the audit log records the settings it had
+	hook, ok := getWebhook(w, store, p(r, "id"))
+	if !ok {
+		return
+	}
+	id := hook.ID
+	err := store.Delete(id)
+	if err == db.ErrNotFound {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not delete webhook", http.StatusInternalServerError)
+		fmt.Println("Store: " + err.Error())
+		return
+	}
+	audit(r, store, "delete", &hook, nil)
+	// Stop evaluating the removed registration
+	dispatcher.Unwatch(id)
+
+	// Nothing left to send back
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeForm strictly decodes a JSON body into form, writing a problem response and returning false if that fails
+func decodeForm(w http.ResponseWriter, r *http.Request, form interface{}) bool {
+	return decodeBody(w, r, form, true)
+}
+
+// decodeOptionalForm is decodeForm for bodies that may be left empty, leaving form as it is
+func decodeOptionalForm(w http.ResponseWriter, r *http.Request, form interface{}) bool {
+	return decodeBody(w, r, form, false)
+}
+
+// decodeBody strictly decodes a JSON body into form, writing a problem response and returning false if that fails
+func decodeBody(w http.ResponseWriter, r *http.Request, form interface{}, required bool) bool {
+	problems := &notify.ValidationError{}
+	status := http.StatusBadRequest
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAXBODY))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(form)
+	if err == nil && decoder.More() {
+		err = errors.New("unexpected data after the JSON object")
+	}
+	if err == io.EOF && !required {
+		return true
+	}
+	switch e := err.(type) {
+	case nil:
+		return true
+	case *json.SyntaxError:
+		problems.Add("body", fmt.Sprintf("malformed JSON at offset %d", e.Offset))
+	case *json.UnmarshalTypeError:
+		problems.Add(e.Field, "must be a "+e.Type.String()+", not a JSON "+e.Value)
+	default:
+		switch {
+		case err == io.EOF:
+			problems.Add("body", "empty, expected a JSON object")
+		case err == io.ErrUnexpectedEOF:
+			problems.Add("body", "malformed JSON, ends too early")
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), "\"")
+			problems.Add(field, "unknown field")
+		case err.Error() == "http: request body too large":
+			problems.Add("body", fmt.Sprintf("larger than %d bytes", MAXBODY))
+			status = http.StatusRequestEntityTooLarge
+		default:
+			problems.Add("body", err.Error())
+		}
+	}
+	resProblems(w, status, problems)
+	return false
+}
+
+// checkWebhook validates hook, writing a response and returning false if anything is wrong with it
+func checkWebhook(w http.ResponseWriter, r *http.Request, dispatcher *notify.Dispatcher, hook db.Webhook) bool {
+	err := dispatcher.Check(r.Context(), hook)
+	if problems, ok := err.(*notify.ValidationError); ok {
+		resProblems(w, http.StatusBadRequest, problems)
+		return false
+	}
+	if err != nil { // Country could not be looked up
+		http.Error(w, "Could not verify countries with the cases API", http.StatusBadGateway)
+		fmt.Println("Check: " + err.Error())
+		return false
+	}
+	return true
+}
+
+// resProblems sends every problem found with a request in one structured response
+func resProblems(w http.ResponseWriter, status int, problems *notify.ValidationError) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	resWithData(w, ProblemResponse{Error: "Invalid webhook", Problems: problems.Problems})
+}
+
+// modifyWebhook applies fn to the stored webhook with the given id in one step, returning it as it was before and
+// after. It writes an error response and returns false if that fails
+func modifyWebhook(w http.ResponseWriter, store db.WebhookStore, id string, fn func(hook *db.Webhook)) (db.Webhook, db.Webhook, bool) {
+	var before db.Webhook
+	after, err := store.Modify(id, func(hook *db.Webhook) error {
+		before = *hook
+		fn(hook)
+		return nil
+	})
+	if err == db.ErrNotFound { // Removed since it was fetched
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return before, after, false
+	}
+	if err != nil {
+		http.Error(w, "Could not update webhook", http.StatusInternalServerError)
+		fmt.Println("Store: " + err.Error())
+		return before, after, false
+	}
+	return before, after, true
+}
+
+// refresh restarts or stops evaluating the webhook with the given id to match what is stored
+func refresh(dispatcher *notify.Dispatcher, id string) {
+	if err := dispatcher.Refresh(id); err != nil && err != db.ErrNotFound { // Removed in the meantime is fine
+		fmt.Println("Store: " + err.Error())
+	}
+}
+
+// getWebhook fetches a webhook from the store, writing an error response and returning false if that fails
+func getWebhook(w http.ResponseWriter, store db.WebhookStore, id string) (db.Webhook, bool) {
+	hook, err := store.Get(id)
+	if err == db.ErrNotFound {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return hook, false
+	}
+	if err != nil {
+		http.Error(w, "Could not fetch webhook", http.StatusInternalServerError)
+		fmt.Println("Store: " + err.Error())
+		return hook, false
+	}
+	return hook, true
+}
+
+// cursor struct for the position of a webhook in a listing, right after which the next page starts
+type cursor struct {
+	Created time.Time
+	ID      string
+}
+
+// cursorOf returns the position of a webhook in a listing
+func cursorOf(hook db.Webhook) cursor {
+	return cursor{Created: hook.Created, ID: hook.ID}
+}
+
+// before reports whether c comes before other when sorted oldest first
+func (c cursor) before(other cursor) bool {
+	if c.Created.Equal(other.Created) {
+		return c.ID < other.ID
+	}
+	return c.Created.Before(other.Created)
+}
+
+// follows reports whether position comes after c in a listing, sorted newest first or oldest first
+func (c cursor) follows(position cursor, newest bool) bool {
+	if newest {
+		return position.before(c)
+	}
+	return c.before(position)
+}
+
+// encode returns the cursor as an opaque string for clients
+func (c cursor) encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.Created.UTC().Format(time.RFC3339Nano) + "|" + c.ID))
+}
+
+// decodeCursor parses a cursor handed out by encode
+func decodeCursor(raw string) (cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return cursor{}, err
+	}
+	fields := strings.SplitN(string(b), "|", 2)
+	if len(fields) != 2 {
+		return cursor{}, errors.New("cursor has no id")
+	}
+	created, err := time.Parse(time.RFC3339Nano, fields[0])
+	if err != nil {
+		return cursor{}, err
+	}
+	return cursor{Created: created, ID: fields[1]}, nil
+}
+
+// matches reports whether a webhook passes the listing filters, empty filters pass everything
+func matches(hook db.Webhook, countryName, field, trigger, status string) bool {
+	if countryName != "" {
+		found := strings.EqualFold(hook.Country, countryName)
+		for _, listed := range hook.Countries {
+			found = found || strings.EqualFold(listed, countryName)
+		}
+		if !found {
+			return false
+		}
+	}
+	if field != "" && !strings.EqualFold(hook.Field, field) {
+		return false
+	}
+	if trigger != "" && !strings.EqualFold(hook.Trigger, trigger) {
+		return false
+	}
+	return status == "" || status == webhookStatus(hook)
+}
+
+// webhookStatus returns whether a webhook is active, paused or suspended, a suspension counts over a pause
+func webhookStatus(hook db.Webhook) string {
+	switch {
+	case hook.Suspended != nil:
+		return "suspended"
+	case hook.Paused:
+		return "paused"
+	default:
+		return "active"
+	}
+}
+
+// redact removes the signing secrets from a webhook about to be sent to a client
+func redact(hook db.Webhook) db.Webhook {
+	hook.Secret = ""
+	hook.PreviousSecret = ""
+	return hook
+}
+
+// fromWebhook returns the settings of a stored webhook as a form, without its secret
+func fromWebhook(hook db.Webhook) WebhookForm {
+	// Decoding into the form writes through pointers and slices, keep it from changing the stored webhook
+	if hook.Threshold != nil {
+		threshold := *hook.Threshold
+		hook.Threshold = &threshold
+	}
+	hook.Countries = append([]string(nil), hook.Countries...)
+	hook.To = append([]string(nil), hook.To...)
+	return WebhookForm{
+		URL:         hook.URL,
+		Channel:     hook.Channel,
+		To:          hook.To,
+		Subject:     hook.Subject,
+		Template:    hook.Template,
+		ContentType: hook.ContentType,
+		Timeout:     hook.Timeout,
+		Field:       hook.Field,
+		Country:     hook.Country,
+		Countries:   hook.Countries,
+		Continent:   hook.Continent,
+		Mode:        hook.Mode,
+		Window:      hook.Window,
+		SkipEmpty:   hook.SkipEmpty,
+		Trigger:     hook.Trigger,
+		Threshold:   hook.Threshold,
+		Condition:   hook.Condition,
+	}
+}
+
+// toWebhook converts a decoded registration form into a storable webhook
+func (f WebhookForm) toWebhook() db.Webhook {
+	return db.Webhook{
+		URL:         f.URL,
+		Channel:     f.Channel,
+		To:          f.To,
+		Subject:     f.Subject,
+		Template:    f.Template,
+		ContentType: f.ContentType,
+		Timeout:     f.Timeout,
+		Field:       f.Field,
+		Country:     f.Country,
+		Countries:   f.Countries,
+		Continent:   f.Continent,
+		Mode:        f.Mode,
+		Window:      f.Window,
+		SkipEmpty:   f.SkipEmpty,
+		Trigger:     f.Trigger,
+		Threshold:   f.Threshold,
+		Condition:   f.Condition,
+		Secret:      f.Secret,
+	}
+}
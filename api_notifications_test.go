@@ -0,0 +1,313 @@
+package covidcase
+
+import (
+	"covidcase/db"
+	"covidcase/notify"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const registration = `{"url": "http://127.0.0.1:9/hook", "timeout": 3600, "field": "stringency", "country": "*", "trigger": "ON_CHANGE"}`
+
+// register posts the registration above from addr under an idempotency key
+func register(handler http.HandlerFunc, addr, key string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/corona/v1/notifications/", strings.NewReader(registration))
+	req.RemoteAddr = addr
+	req.Header.Set(HEADERIDEMPOTENCY, key)
+	handler(w, req)
+	return w
+}
+
+// keyHandler returns the registration handler with a dispatcher that checks webhooks but never runs them
+func keyHandler(t *testing.T, store db.Store) http.HandlerFunc {
+	t.Helper()
+	allow, err := notify.ParseAllowList("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := notify.DefaultConfig
+	config.Allow = allow
+	dispatcher := notify.NewDispatcher(store, config)
+	dispatcher.Stop() // Registrations are only stored, not evaluated
+	return HandlerNotifications(store, dispatcher, time.Hour)
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	stores, done := testStores(t)
+	defer done()
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			handler := keyHandler(t, store)
+
+			var first, replay, other WebhookID
+			w := register(handler, "10.0.0.1:1234", "k1")
+			if w.Code != http.StatusCreated || json.NewDecoder(w.Body).Decode(&first) != nil || first.Secret == "" {
+				t.Fatalf("first registration: %d %s", w.Code, w.Body.String())
+			}
+
+			// The same client gets the same webhook, without its secret
+			w = register(handler, "10.0.0.1:5678", "k1")
+			if w.Code != http.StatusCreated || w.Header().Get(HEADERREPLAYED) != "true" {
+				t.Fatalf("retry: %d %s, replayed %q", w.Code, w.Body.String(), w.Header().Get(HEADERREPLAYED))
+			}
+			if strings.Contains(w.Body.String(), "secret") {
+				t.Errorf("replay sent the secret: %s", w.Body.String())
+			}
+			if json.NewDecoder(w.Body).Decode(&replay) != nil || replay.ID != first.ID {
+				t.Errorf("replay answered %q, want %q", replay.ID, first.ID)
+			}
+
+			// Another client using the same key registers its own webhook
+			w = register(handler, "10.0.0.2:1234", "k1")
+			if w.Code != http.StatusCreated || w.Header().Get(HEADERREPLAYED) != "" {
+				t.Fatalf("other client: %d %s, replayed %q", w.Code, w.Body.String(), w.Header().Get(HEADERREPLAYED))
+			}
+			if json.NewDecoder(w.Body).Decode(&other) != nil || other.ID == first.ID || other.Secret == "" {
+				t.Errorf("other client got %+v, want a webhook of its own", other)
+			}
+		})
+	}
+}
+
+func TestIdempotentTakeover(t *testing.T) {
+	const retries = 10
+
+	stores, done := testStores(t)
+	defer done()
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			handler := keyHandler(t, store)
+
+			// A request that claimed the key long ago and never finished
+			var form WebhookForm
+			if err := json.Unmarshal([]byte(registration), &form); err != nil {
+				t.Fatal(err)
+			}
+			encoded, _ := json.Marshal(form)
+			sum := sha256.Sum256(encoded)
+			created := time.Now().UTC().Add(-2 * KEYPENDING).Truncate(time.Microsecond)
+			stale := db.IdempotencyKey{Key: "ip:10.0.0.1 k1", Hash: hex.EncodeToString(sum[:]), Created: created, Expires: created.Add(time.Hour)}
+			if _, claimed, err := store.ClaimIdempotencyKey(stale, time.Now()); err != nil || !claimed {
+				t.Fatalf("claim: %v %v", claimed, err)
+			}
+
+			// Retries arriving together, only one may take the key over and register. The others are told to
+			// wait, or get its registration once it is done.
+			responses := make(chan *httptest.ResponseRecorder, retries)
+			var wg sync.WaitGroup
+			for i := 0; i < retries; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					responses <- register(handler, "10.0.0.1:1234", "k1")
+				}()
+			}
+			wg.Wait()
+			close(responses)
+			registered := 0
+			for w := range responses {
+				switch {
+				case w.Code == http.StatusCreated && w.Header().Get(HEADERREPLAYED) == "":
+					registered++
+				case w.Code == http.StatusCreated, w.Code == http.StatusConflict:
+				default:
+					t.Errorf("retry answered %d %s, want 201 or 409", w.Code, w.Body.String())
+				}
+			}
+			total, err := store.Count()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if registered != 1 || total != 1 {
+				t.Errorf("%d retries registered, %d webhooks stored, want 1", registered, total)
+			}
+		})
+	}
+}
+
+func TestRegisterConditionTemplate(t *testing.T) {
+	store := db.NewMemoryStore()
+	handler := keyHandler(t, store)
+	body := `{"url": "http://127.0.0.1:9/hook", "timeout": 3600, "country": "*", "trigger": "CONDITION",
+		"condition": "confirmed > 5", "template": "{\"c\": {{json .Values.confirmed}}}"}`
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/corona/v1/notifications/", strings.NewReader(body)))
+	if w.Code != http.StatusCreated {
+		t.Errorf("template reading a variable of the condition: %d %s, want 201", w.Code, w.Body.String())
+	}
+}
+
+// list gets one page of registered webhooks with the given query
+func list(handler http.HandlerFunc, query string) (*httptest.ResponseRecorder, WebhookPage) {
+	var page WebhookPage
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/corona/v1/notifications/?"+query, nil))
+	if w.Code == http.StatusOK {
+		json.Unmarshal(w.Body.Bytes(), &page)
+	}
+	return w, page
+}
+
+func TestListPagination(t *testing.T) {
+	store := db.NewMemoryStore()
+	handler := keyHandler(t, store)
+
+	// Five webhooks a minute apart, the first two created at the same time and ordered by id
+	created := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	var ids []string
+	minutes := []int{0, 0, 1, 2, 3}
+	for i, country := range []string{"Norway", "Norway", "Japan", "Norway", "France"} {
+		hook, err := store.Create(db.Webhook{URL: "http://127.0.0.1:9/hook", Timeout: 3600, Field: "stringency", Country: country, Trigger: "ON_CHANGE"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hook.Created = created.Add(time.Duration(minutes[i]) * time.Minute)
+		if err := store.Update(hook); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, hook.ID)
+	}
+	if ids[1] < ids[0] {
+		ids[0], ids[1] = ids[1], ids[0]
+	}
+	last := cursor{Created: created.Add(3 * time.Minute), ID: ids[4]}.encode()
+
+	tests := []struct {
+		name  string
+		query string
+		ids   []int // Positions in ids of the webhooks on the page, oldest first
+		total int
+		next  bool
+	}{
+		{"first page", "limit=2", []int{0, 1}, 5, true},
+		{"whole listing", "limit=5", []int{0, 1, 2, 3, 4}, 5, false},
+		{"newest first", "limit=2&sort=-created", []int{4, 3}, 5, true},
+		{"after a tie", "limit=2&cursor=" + cursor{Created: created, ID: ids[0]}.encode(), []int{1, 2}, 5, true},
+		{"filtered", "country=norway&limit=2", []int{0, 1}, 3, true},
+		{"filtered last page", "country=norway&cursor=" + cursor{Created: created, ID: ids[1]}.encode(), []int{3}, 3, false},
+		{"empty page after the last", "cursor=" + last, nil, 5, false},
+		{"empty page before the first", "sort=-created&cursor=" + cursor{Created: created, ID: ids[0]}.encode(), nil, 5, false},
+		{"no match", "country=japan&trigger=ABOVE", nil, 0, false},
+		// Positions of deleted webhooks still work as cursors
+		{"cursor of a deleted webhook", "limit=1&cursor=" + cursor{Created: created.Add(30 * time.Second), ID: "gone"}.encode(), []int{2}, 5, true},
+	}
+	for _, test := range tests {
+		w, page := list(handler, test.query)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: %d %s, want 200", test.name, w.Code, w.Body.String())
+			continue
+		}
+		var got, want []string
+		for _, hook := range page.Webhooks {
+			got = append(got, hook.ID)
+		}
+		for _, i := range test.ids {
+			want = append(want, ids[i])
+		}
+		if page.Webhooks == nil || strings.Join(got, " ") != strings.Join(want, " ") || page.Total != test.total || (page.Next != "") != test.next {
+			t.Errorf("%s: webhooks %v of %d, next %q, want %v of %d, next %v", test.name, got, page.Total, page.Next, want, test.total, test.next)
+		}
+	}
+
+	// Following next from the first page visits every webhook once, in order
+	for _, sort := range []string{"created", "-created"} {
+		var seen []string
+		query := "limit=2&sort=" + sort
+		for pages := 0; pages < 5; pages++ {
+			w, page := list(handler, query)
+			if w.Code != http.StatusOK {
+				t.Fatalf("walking %s: %d %s", sort, w.Code, w.Body.String())
+			}
+			for _, hook := range page.Webhooks {
+				seen = append(seen, hook.ID)
+			}
+			if page.Next == "" {
+				break
+			}
+			query = "limit=2&sort=" + sort + "&cursor=" + page.Next
+		}
+		want := append([]string(nil), ids...)
+		if sort == "-created" {
+			for i, j := 0, len(want)-1; i < j; i, j = i+1, j-1 {
+				want[i], want[j] = want[j], want[i]
+			}
+		}
+		if strings.Join(seen, " ") != strings.Join(want, " ") {
+			t.Errorf("walking %s: %v, want %v", sort, seen, want)
+		}
+	}
+}
+
+func TestListBadQuery(t *testing.T) {
+	handler := keyHandler(t, db.NewMemoryStore())
+	encode := base64.RawURLEncoding.EncodeToString
+	tests := []struct {
+		query string
+		err   string
+	}{
+		{"cursor=not*base64", "Malformed cursor"},
+		{"cursor=" + encode([]byte("2021-03-01T12:00:00Z")), "Malformed cursor"},
+		{"cursor=" + encode([]byte("yesterday|id")), "Malformed cursor"},
+		{"limit=0", "Parameter limit must be a number from 1 to 100"},
+		{"limit=101", "Parameter limit must be a number from 1 to 100"},
+		{"limit=ten", "Parameter limit must be a number from 1 to 100"},
+		{"sort=country", "Sort must be created or -created"},
+		{"status=deleted", "Status must be active, paused or suspended"},
+	}
+	for _, test := range tests {
+		w, _ := list(handler, test.query)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), test.err) {
+			t.Errorf("%s: %d %s, want 400 %s", test.query, w.Code, w.Body.String(), test.err)
+		}
+	}
+}
+
+func TestRegisterProblems(t *testing.T) {
+	store := db.NewMemoryStore()
+	handler := keyHandler(t, store)
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		fields string // Fields with problems, in the order reported and separated by spaces
+	}{
+		{"empty body", "", http.StatusBadRequest, "body"},
+		{"malformed JSON", `{"url": `, http.StatusBadRequest, "body"},
+		{"syntax error", `{"url" "http://127.0.0.1:9/hook"}`, http.StatusBadRequest, "body"},
+		{"wrong type", `{"timeout": "hourly"}`, http.StatusBadRequest, "timeout"},
+		{"unknown field", `{"url": "http://127.0.0.1:9/hook", "interval": 60}`, http.StatusBadRequest, "interval"},
+		{"trailing data", registration + registration, http.StatusBadRequest, "body"},
+		{"too large", `{"url": "` + strings.Repeat("a", MAXBODY) + `"}`, http.StatusRequestEntityTooLarge, "body"},
+		{"private address", strings.Replace(registration, "127.0.0.1", "10.0.0.1", 1), http.StatusBadRequest, "url"},
+		{"all at once", `{"url": "ftp://127.0.0.1/hook", "timeout": 1, "trigger": "ABOVE", "field": "deaths"}`,
+			http.StatusBadRequest, "url timeout country field"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "/corona/v1/notifications/", strings.NewReader(test.body)))
+		var response ProblemResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Errorf("%s: %d %s, want a problem response", test.name, w.Code, w.Body.String())
+			continue
+		}
+		var fields []string
+		for _, problem := range response.Problems {
+			fields = append(fields, problem.Field)
+		}
+		if w.Code != test.status || strings.Join(fields, " ") != test.fields {
+			t.Errorf("%s: %d with problems %v, want %d with %q", test.name, w.Code, response.Problems, test.status, test.fields)
+		}
+	}
+	if total, err := store.Count(); err != nil || total != 0 {
+		t.Errorf("%d webhooks stored, %v, want none", total, err)
+	}
+}
@@ -0,0 +1,104 @@
+package covidcase
+
+import (
+	"covidcase/db"
+	"covidcase/notify"
+	"net/http"
+	"strings"
+)
+
+// HandlerPause main handler for route related to `/notifications/{id}/pause` and `/notifications/{id}/resume` requests
+func HandlerPause(store db.Store, dispatcher *notify.Dispatcher, paused bool) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		case http.MethodPost:
+			handlePausePost(w, r, store, dispatcher, paused)
+		case http.MethodPut:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		case http.MethodDelete:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		}
+	}
+}
+
+// handlePausePost utility function, package level, to stop or restart evaluating a webhook without removing it
+func handlePausePost(w http.ResponseWriter, r *http.Request, store db.Store, dispatcher *notify.Dispatcher, paused bool) {
+	// Set response to be of JSON type
+	http.Header.Add(w.Header(), "content-type", "application/json")
+	parts := strings.Split(r.URL.Path, "/")
+	// error handling
+	if len(parts) != 6 || parts[3] != "notifications" || (parts[5] != "pause" && parts[5] != "resume") {
+		http.Error(w, "Malformed URL", http.StatusBadRequest)
+		return
+	}
+
+	// Pausing twice is no different from pausing once
+	before, hook, ok := modifyWebhook(w, store, p(r, "id"), func(hook *db.Webhook) {
+		hook.Paused = paused
+	})
+	if !ok {
+		return
+	}
+	if before.Paused != paused {
+		if paused {
+			audit(r, store, "pause", &before, &hook)
+		} else {
+			audit(r, store, "resume", &before, &hook)
+		}
+		// Stops the worker when paused, the last value seen is kept for when it resumes
+		refresh(dispatcher, hook.ID)
+	}
+
+	// Send result for processing
+	resWithData(w, redact(hook))
+}
+
+// HandlerReactivate main handler for route related to `/notifications/{id}/reactivate` requests
+func HandlerReactivate(store db.Store, dispatcher *notify.Dispatcher) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		case http.MethodPost:
+			handleReactivatePost(w, r, store, dispatcher)
+		case http.MethodPut:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		case http.MethodDelete:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		}
+	}
+}
+
+// handleReactivatePost utility function, package level, to lift the suspension of a webhook that kept failing
+func handleReactivatePost(w http.ResponseWriter, r *http.Request, store db.Store, dispatcher *notify.Dispatcher) {
+	// Set response to be of JSON type
+	http.Header.Add(w.Header(), "content-type", "application/json")
+	parts := strings.Split(r.URL.Path, "/")
+	// error handling
+	if len(parts) != 6 || parts[3] != "notifications" || parts[5] != "reactivate" {
+		http.Error(w, "Malformed URL", http.StatusBadRequest)
+		return
+	}
+
+	// Reactivating a webhook that is not suspended is no different from leaving it be
+	before, hook, ok := modifyWebhook(w, store, p(r, "id"), func(hook *db.Webhook) {
+		if hook.Suspended != nil {
+			// Start over with a clean health, or the next failure would suspend it again right away
+			hook.Suspended = nil
+			hook.Health = nil
+		}
+	})
+	if !ok {
+		return
+	}
+	if before.Suspended != nil {
+		audit(r, store, "reactivate", &before, &hook)
+		// Starts the worker again, unless the webhook is paused as well
+		refresh(dispatcher, hook.ID)
+	}
+
+	// Send result for processing
+	resWithData(w, redact(hook))
+}
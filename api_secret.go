@@ -0,0 +1,101 @@
+package covidcase
+
+import (
+	"covidcase/db"
+	"covidcase/notify"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const DEFAULTGRACE = 24 * 60 * 60  // Seconds the previous secret keeps signing after a rotation, unless specified
+const MAXGRACE = 30 * 24 * 60 * 60 // Upper bound in seconds for the grace period, an old secret is not kept for good
+
+// SecretForm struct for JSON decoding a secret rotation, both fields are optional
+type SecretForm struct {
+	Secret string   `json:"secret"` // New secret, generated if left out
+	Grace  *float64 `json:"grace"`  // Seconds the old secret keeps signing, 0 drops it at once
+}
+
+// RotatedSecret struct for JSON encoding the outcome of a secret rotation
+type RotatedSecret struct {
+	Secret                string     `json:"secret"`
+	PreviousSecretExpires *time.Time `json:"previous_secret_expires,omitempty"`
+}
+
+// HandlerSecret main handler for route related to `/notifications/{id}/secret` requests
+func HandlerSecret(store db.Store, dispatcher *notify.Dispatcher) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		case http.MethodPost:
+			handleSecretPost(w, r, store, dispatcher)
+		case http.MethodPut:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		case http.MethodDelete:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		}
+	}
+}
+
+// handleSecretPost utility function, package level, to rotate the signing secret of a webhook
+func handleSecretPost(w http.ResponseWriter, r *http.Request, store db.Store, dispatcher *notify.Dispatcher) {
+	var secretForm SecretForm
+
+	// Set response to be of JSON type
+	http.Header.Add(w.Header(), "content-type", "application/json")
+	parts := strings.Split(r.URL.Path, "/")
+	// error handling
+	if len(parts) != 6 || parts[3] != "notifications" || parts[5] != "secret" {
+		http.Error(w, "Malformed URL", http.StatusBadRequest)
+		return
+	}
+
+	/*  JSON example for Body, which may also be left empty
+	{
+	"secret": "optional, at least 16 characters",
+	"grace": 3600
+	}
+	*/
+
+	// Decode JSON body, an empty body rotates to a generated secret with the default grace period
+	if !decodeOptionalForm(w, r, &secretForm) {
+		return
+	}
+	grace := float64(DEFAULTGRACE)
+	if secretForm.Grace != nil {
+		grace = *secretForm.Grace
+	}
+	if grace < 0 || grace > MAXGRACE {
+		http.Error(w, fmt.Sprintf("Grace must be between 0 and %d seconds", MAXGRACE), http.StatusBadRequest)
+		return
+	}
+	var err error
+	if secretForm.Secret == "" {
+		secretForm.Secret, err = notify.NewSecret()
+		if err != nil {
+			http.Error(w, "Could not rotate secret", http.StatusInternalServerError)
+			fmt.Println("Secret: " + err.Error())
+			return
+		}
+	} else if len(secretForm.Secret) < notify.MINSECRETLEN {
+		http.Error(w, fmt.Sprintf("Secret must be at least %d characters", notify.MINSECRETLEN), http.StatusBadRequest)
+		return
+	}
+
+	// Rotate from the secret as stored by then, a rotation in the meantime is not lost
+	before, hook, ok := modifyWebhook(w, store, p(r, "id"), func(hook *db.Webhook) {
+		*hook = notify.RotateSecret(*hook, secretForm.Secret, time.Duration(grace*float64(time.Second)))
+	})
+	if !ok {
+		return
+	}
+	audit(r, store, "rotate_secret", &before, &hook)
+	// Sign from now on with the new secret
+	refresh(dispatcher, hook.ID)
+
+	// Send the new secret, it is not shown anywhere else
+	resWithData(w, RotatedSecret{Secret: hook.Secret, PreviousSecretExpires: hook.PreviousSecretExpires})
+}
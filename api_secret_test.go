@@ -0,0 +1,145 @@
+package covidcase
+
+import (
+	"covidcase/db"
+	"covidcase/notify"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// testStores returns a fresh memory and bolt store by name, with a func closing and removing the bolt one
+func testStores(t *testing.T) (map[string]db.Store, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "covidcase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bolt, err := db.NewBoltStore(filepath.Join(dir, "covidcase.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	done := func() {
+		bolt.Close()
+		os.RemoveAll(dir)
+	}
+	return map[string]db.Store{"memory": db.NewMemoryStore(), "bolt": bolt}, done
+}
+
+// TestRotateWhileDelivering rotates the secret of a webhook while deliveries to it record their outcome in its
+// health, neither may undo the other
+func TestRotateWhileDelivering(t *testing.T) {
+	const deliveries = 40
+	const rotations = 20
+
+	stores, done := testStores(t)
+	defer done()
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			defer receiver.Close()
+			allow, err := notify.ParseAllowList("127.0.0.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := notify.DefaultConfig
+			config.Allow = allow
+			config.Retry = notify.RetryPolicy{MaxAttempts: 1}
+			config.HostRate = 0
+			config.HostConcurrency = 0
+			dispatcher := notify.NewDispatcher(store, config)
+
+			// Paused, so the only deliveries are the ones below
+			hook, err := store.Create(db.Webhook{URL: receiver.URL, Secret: "0123456789abcdef0123", Paused: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var letters []db.Delivery
+			for i := 0; i < deliveries; i++ {
+				letter, err := store.AddDeadLetter(db.Delivery{WebhookID: hook.ID, Payload: `{}`})
+				if err != nil {
+					t.Fatal(err)
+				}
+				letters = append(letters, letter)
+			}
+			router := chi.NewRouter()
+			router.Post("/corona/v1/notifications/{id}/secret", HandlerSecret(store, dispatcher))
+
+			var wg sync.WaitGroup
+			secrets := make(chan string, rotations)
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for _, letter := range letters {
+					if err := dispatcher.Redrive(letter); err != nil {
+						t.Error(err)
+					}
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for i := 0; i < rotations; i++ {
+					w := httptest.NewRecorder()
+					req := httptest.NewRequest(http.MethodPost, "/corona/v1/notifications/"+hook.ID+"/secret", strings.NewReader(`{"grace": 0}`))
+					router.ServeHTTP(w, req)
+					var rotated RotatedSecret
+					if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&rotated) != nil {
+						t.Errorf("rotation %d: %d %s", i, w.Code, w.Body.String())
+						return
+					}
+					secrets <- rotated.Secret
+				}
+			}()
+			wg.Wait()
+			close(secrets)
+			// Deliveries run in the background, wait for all of them to be tracked
+			deadline := time.Now().Add(10 * time.Second)
+			for {
+				stored, err := store.Get(hook.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if stored.Health != nil && stored.Health.Deliveries >= deliveries || time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			dispatcher.Stop()
+
+			var last string
+			for secret := range secrets {
+				last = secret
+			}
+			stored, err := store.Get(hook.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Secret != last {
+				t.Errorf("stored secret is not the last one handed out, a delivery wrote back an old copy")
+			}
+			if !stored.Paused {
+				t.Error("paused state was lost")
+			}
+			if stored.Health == nil || stored.Health.Deliveries != deliveries {
+				t.Errorf("health = %+v, want %d deliveries, a rotation wrote back an old copy", stored.Health, deliveries)
+			}
+			entries, err := store.ListAuditEntries(hook.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != rotations {
+				t.Errorf("%d audit entries, want one per rotation", len(entries))
+			}
+		})
+	}
+}
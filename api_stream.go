@@ -0,0 +1,133 @@
+package covidcase
+
+import (
+	"covidcase/db"
+	"covidcase/notify"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const HEARTBEAT = 15 * time.Second // Time between two comments keeping an idle stream from being cut by proxies
+const RECONNECT = 3000             // Milliseconds clients wait before reconnecting to a stream that ended
+
+// HandlerStream main handler for route related to `/stream` requests
+func HandlerStream(dispatcher *notify.Dispatcher) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handleStreamGet(w, r, dispatcher)
+		case http.MethodPost:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		case http.MethodPut:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		case http.MethodDelete:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		}
+	}
+}
+
+// handleStreamGet utility function, package level, to stream the changes to a field for a country as
+// Server-Sent Events until the client goes away
+func handleStreamGet(w http.ResponseWriter, r *http.Request, dispatcher *notify.Dispatcher) {
+	parts := strings.Split(r.URL.Path, "/")
+	// error handling
+	if len(parts) != 4 || parts[3] != "stream" {
+		http.Error(w, "Malformed URL", http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// Extract 'country' and 'field' parameters
+	countryName := r.URL.Query().Get("country")
+	field := r.URL.Query().Get("field")
+	err := dispatcher.CheckStream(r.Context(), countryName, field)
+	if _, ok := err.(*notify.ValidationError); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil { // Country could not be looked up
+		http.Error(w, "Could not verify country with the cases API", http.StatusBadGateway)
+		fmt.Println("Check: " + err.Error())
+		return
+	}
+
+	// Browsers resume with the id of the last event they got, anything else starts from now
+	var after int64
+	if lastID := r.Header.Get("Last-Event-ID"); lastID != "" {
+		if after, err = strconv.ParseInt(lastID, 10, 64); err != nil || after < 0 {
+			http.Error(w, "Last-Event-ID must be the id of an event", http.StatusBadRequest)
+			return
+		}
+	}
+	subscription, err := dispatcher.Subscribe(countryName, field, after)
+	if err != nil {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer subscription.Cancel()
+
+	// Set response to be an event stream, kept out of caches and proxy buffers
+	w.Header().Set("content-type", "text/event-stream")
+	w.Header().Set("cache-control", "no-cache")
+	w.Header().Set("x-accel-buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", RECONNECT)
+	// Changes the client missed were removed, it is told to start over. The empty id makes browsers forget
+	// the one they resumed with, so the next reconnect does not ask for them again.
+	if subscription.Reset {
+		fmt.Fprint(w, "id\nevent: reset\ndata: {\"reason\": \"changes after Last-Event-ID were removed\"}\n\n")
+	}
+	// A missed change may arrive again on the subscription, only ids above the last one sent go out
+	last := after
+	for _, change := range subscription.Missed {
+		if !writeChange(w, change, &last) {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(HEARTBEAT)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done(): // Client went away
+			return
+		case change, ok := <-subscription.Changes:
+			if !ok { // Dropped for falling behind or ended for shutdown, the client reconnects
+				return
+			}
+			if !writeChange(w, change, &last) {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// writeChange writes a change as one event unless its id is not above last, which it moves on, returning false if
+// the client can no longer be written to
+func writeChange(w http.ResponseWriter, change db.Change, last *int64) bool {
+	if change.ID <= *last {
+		return true
+	}
+	*last = change.ID
+	data, err := json.Marshal(change)
+	if err != nil {
+		fmt.Println("Encode: " + err.Error())
+		return false
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: change\ndata: %s\n\n", change.ID, data)
+	return err == nil
+}
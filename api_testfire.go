@@ -0,0 +1,52 @@
+package covidcase
+
+import (
+	"covidcase/db"
+	"covidcase/notify"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// HandlerTestFire main handler for route related to `/notifications/{id}/test` requests
+func HandlerTestFire(store db.WebhookStore, dispatcher *notify.Dispatcher) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		case http.MethodPost:
+			handleTestFirePost(w, r, store, dispatcher)
+		case http.MethodPut:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		case http.MethodDelete:
+			http.Error(w, "Not implemented", http.StatusNotImplemented)
+		}
+	}
+}
+
+// handleTestFirePost utility function, package level, to send a sample notification to a webhook right away
+func handleTestFirePost(w http.ResponseWriter, r *http.Request, store db.WebhookStore, dispatcher *notify.Dispatcher) {
+	// Set response to be of JSON type
+	http.Header.Add(w.Header(), "content-type", "application/json")
+	parts := strings.Split(r.URL.Path, "/")
+	// error handling
+	if len(parts) != 6 || parts[3] != "notifications" || parts[5] != "test" {
+		http.Error(w, "Malformed URL", http.StatusBadRequest)
+		return
+	}
+
+	hook, ok := getWebhook(w, store, p(r, "id"))
+	if !ok {
+		return
+	}
+	// Paused webhooks can be tested too, that is what a receiver being set up looks like
+	result, err := dispatcher.Test(r.Context(), hook)
+	if err != nil {
+		http.Error(w, "Could not fetch data for the webhook's countries", http.StatusBadGateway)
+		fmt.Println("Test: " + err.Error())
+		return
+	}
+
+	// Send result for processing, a failed delivery is part of the result rather than an error
+	resWithData(w, result)
+}
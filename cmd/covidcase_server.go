@@ -1,13 +1,22 @@
 package main
 
 import (
+	"context"
 	"covidcase"
+	"covidcase/db"
+	"covidcase/detect"
+	"covidcase/notify"
+	"errors"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/cors"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -18,6 +27,7 @@ const (
 	// Chi regex parameters
 	COUNTRY = "{country_name:[A-Za-z]+}" // Country name
 	WEBID   = "{id}"                     // Webhook id
+	FAILID  = "{failed_id}"              // Dead letter id
 	//BY = "{b_year:\\d\\d\\d\\d}"		   		  // Begin year
 	//BM = "{b_month:\\d\\d}"		   	  			  // Begin month
 	//BD = "{b_day:\\d\\d}"		   		          // Begin day
@@ -26,6 +36,9 @@ const (
 	//ED = "{e_day:\\d\\d}"		   		          // End day
 )
 
+const BOLTPATH = "covidcase.db"          // Default database file for the bolt webhook store
+const SHUTDOWNTIMEOUT = 10 * time.Second // Time open requests get to finish on shutdown
+
 func main() {
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -35,6 +48,84 @@ func main() {
 	// Define application startup time value
 	appStart := time.Now()
 
+	// Deferred first so it runs last, after the cleanup deferred below
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
+	// Webhooks may only go to public addresses, unless allowlisted in $WEBHOOK_ALLOW
+	allow, err := notify.ParseAllowList(os.Getenv("WEBHOOK_ALLOW"))
+	if err != nil {
+		log.Fatal("Could not parse $WEBHOOK_ALLOW: " + err.Error())
+	}
+
+	// Start delivering notifications for registered webhooks
+	config := notify.Config{
+		Retry: notify.RetryPolicy{
+			MaxAttempts: envInt("RETRY_ATTEMPTS", notify.DefaultRetry.MaxAttempts),
+			BaseDelay:   time.Duration(envInt("RETRY_DELAY", int(notify.DefaultRetry.BaseDelay/time.Second))) * time.Second,
+			MaxDelay:    time.Duration(envInt("RETRY_MAX_DELAY", int(notify.DefaultRetry.MaxDelay/time.Second))) * time.Second,
+		},
+		HistoryMaxAge:     time.Duration(envInt("HISTORY_MAX_AGE", int(notify.DefaultConfig.HistoryMaxAge/time.Hour))) * time.Hour,
+		HistoryMaxEntries: envInt("HISTORY_MAX_ENTRIES", notify.DefaultConfig.HistoryMaxEntries),
+		Allow:             allow,
+		HostConcurrency:   envInt("HOST_CONCURRENCY", notify.DefaultConfig.HostConcurrency),
+		HostRate:          float64(envInt("HOST_RATE", int(notify.DefaultConfig.HostRate))),
+		BreakerFailures:   envInt("BREAKER_FAILURES", notify.DefaultConfig.BreakerFailures),
+		BreakerCooldown:   time.Duration(envInt("BREAKER_COOLDOWN", int(notify.DefaultConfig.BreakerCooldown/time.Second))) * time.Second,
+		SuspendFailures:   envInt("SUSPEND_FAILURES", notify.DefaultConfig.SuspendFailures),
+		SuspendRatio:      float64(envInt("SUSPEND_RATIO", int(notify.DefaultConfig.SuspendRatio*100))) / 100,
+		StreamInterval:    time.Duration(envInt("STREAM_INTERVAL", int(notify.DefaultConfig.StreamInterval/time.Second))) * time.Second,
+		ChangeRetention:   time.Duration(envInt("CHANGE_RETENTION", int(notify.DefaultConfig.ChangeRetention/time.Hour))) * time.Hour,
+		// Email notifications are only offered if a mail server is set
+		SMTP: notify.SMTPConfig{
+			Addr:     os.Getenv("SMTP_ADDR"),
+			From:     os.Getenv("SMTP_FROM"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+		},
+	}
+	if config.SMTP.Addr != "" && config.SMTP.From == "" {
+		log.Fatal("$SMTP_FROM must be set along with $SMTP_ADDR")
+	}
+	// Values have to move beyond $TOLERANCE_<FIELD> to count as changed, e.g. "absolute=0.5,cooldown=1h"
+	config.Tolerances = make(map[string]detect.Tolerance)
+	for _, field := range []string{notify.FIELDSTRINGENCY, notify.FIELDCONFIRMED} {
+		name := "TOLERANCE_" + strings.ToUpper(field)
+		tolerance, err := detect.ParseTolerance(os.Getenv(name))
+		if err != nil {
+			log.Fatal("Could not parse $" + name + ": " + err.Error())
+		}
+		config.Tolerances[field] = tolerance
+	}
+
+	// Open webhook storage backend, once the configuration is known to be valid
+	// log.Fatal skips deferred calls, so the store is closed by hand if the dispatcher fails to start
+	store, err := newStore(os.Getenv("STORE"))
+	if err != nil {
+		log.Fatal("Could not open webhook store: " + err.Error())
+	}
+	dispatcher := notify.NewDispatcher(store, config)
+	if err := dispatcher.Start(); err != nil {
+		store.Close()
+		log.Fatal("Could not start webhook dispatcher: " + err.Error())
+	}
+	defer store.Close()
+	defer dispatcher.Stop()
+
+	// API keys and secrets are fingerprinted with $FINGERPRINT_KEY, a random one changes them on every restart
+	if key := os.Getenv("FINGERPRINT_KEY"); key != "" {
+		covidcase.SetFingerprintKey(key)
+	} else {
+		log.Println("$FINGERPRINT_KEY not set, fingerprints and idempotency keys sent with an API key do not survive restarts")
+	}
+
+	// Idempotency keys of registrations are remembered for $IDEMPOTENCY_TTL hours
+	keyTTL := time.Duration(envInt("IDEMPOTENCY_TTL", int(covidcase.DEFAULTKEYTTL/time.Hour))) * time.Hour
+
 	// Define new router
 	r := chi.NewRouter()
 
@@ -44,9 +135,9 @@ func main() {
 		// AllowedOrigins:   []string{"https://foo.com"}, // Use this to allow specific origin hosts
 		AllowedOrigins: []string{"https://*", "http://*"},
 		// AllowOriginFunc:  func(r *http.Request, origin string) bool { return true },
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "Idempotency-Key", "X-API-Key", "Last-Event-ID"},
+		ExposedHeaders:   []string{"Link", "Idempotent-Replayed"},
 		Debug:            true,
 		AllowCredentials: false,
 		MaxAge:           300, // Maximum value not ignored by any of major browsers
@@ -59,18 +150,105 @@ func main() {
 	r.Use(middleware.Recoverer)
 
 	// Routes GET
-	r.Get("/corona/v1/notifications/", covidcase.HandlerNotifications())
-	r.Get("/corona/v1/notifications/"+WEBID, covidcase.HandlerNotification())
-	r.Get("/corona/v1/country/"+COUNTRY, covidcase.HandlerCountry()) // optional query parameter "scope" as start/end date
-	r.Get("/corona/v1/policy/"+COUNTRY, covidcase.HandlerPolicy())   // optional query parameter "scope" as start/end date
-	r.Get("/diag", covidcase.HandlerDiag(appStart))                  // Pass appStart time value for use in this route
-	r.Get("/*", covidcase.HandlerLostUser)                           // Route for any other query not handled by API
+	// optional query parameters "country", "field", "trigger", "status", "sort", "limit" and "cursor"
+	r.Get("/corona/v1/notifications/", covidcase.HandlerNotifications(store, dispatcher, keyTTL))
+	r.Get("/corona/v1/notifications/"+WEBID, covidcase.HandlerNotification(store, dispatcher))
+	r.Get("/corona/v1/notifications/"+WEBID+"/failed", covidcase.HandlerDeadLetters(store, dispatcher))
+	r.Get("/corona/v1/notifications/"+WEBID+"/failed/"+FAILID, covidcase.HandlerDeadLetter(store, dispatcher))
+	// optional query parameters "status", "limit" and "offset"
+	r.Get("/corona/v1/notifications/"+WEBID+"/deliveries", covidcase.HandlerDeliveries(store))
+	// optional query parameters "limit" and "offset", also served once the webhook is deleted
+	r.Get("/corona/v1/notifications/"+WEBID+"/history", covidcase.HandlerHistory(store))
+	r.Get("/corona/v1/country/"+COUNTRY, covidcase.HandlerCountry())   // optional query parameter "scope" as start/end date
+	r.Get("/corona/v1/policy/"+COUNTRY, covidcase.HandlerPolicy())     // optional query parameter "scope" as start/end date
+	r.Get("/diag", covidcase.HandlerDiag(appStart, store, dispatcher)) // Pass appStart time value for use in this route
+	r.Get("/corona/v1/stream", covidcase.HandlerStream(dispatcher))    // query parameters "country" and "field"
+	r.Get("/corona/v1/changes", covidcase.HandlerChanges(store))       // optional query parameters "since" and "limit"
+	r.Get("/*", covidcase.HandlerLostUser)                             // Route for any other query not handled by API
 
 	// Routes POST
-	r.Post("/corona/v1/notifications/", covidcase.HandlerNotifications())
+	r.Post("/corona/v1/notifications/", covidcase.HandlerNotifications(store, dispatcher, keyTTL))              // Optional Idempotency-Key header
+	r.Post("/corona/v1/notifications/"+WEBID+"/failed", covidcase.HandlerDeadLetters(store, dispatcher))        // Redrive all
+	r.Post("/corona/v1/notifications/"+WEBID+"/failed/"+FAILID, covidcase.HandlerDeadLetter(store, dispatcher)) // Redrive one
+	r.Post("/corona/v1/notifications/"+WEBID+"/secret", covidcase.HandlerSecret(store, dispatcher))             // Rotate secret
+	r.Post("/corona/v1/notifications/"+WEBID+"/pause", covidcase.HandlerPause(store, dispatcher, true))
+	r.Post("/corona/v1/notifications/"+WEBID+"/resume", covidcase.HandlerPause(store, dispatcher, false))
+	r.Post("/corona/v1/notifications/"+WEBID+"/test", covidcase.HandlerTestFire(store, dispatcher))
+	r.Post("/corona/v1/notifications/"+WEBID+"/reactivate", covidcase.HandlerReactivate(store, dispatcher))
 
 	// Routes DELETE
-	r.Delete("/corona/v1/notifications/"+WEBID, covidcase.HandlerNotification())
+	r.Delete("/corona/v1/notifications/"+WEBID, covidcase.HandlerNotification(store, dispatcher))
+	r.Delete("/corona/v1/notifications/"+WEBID+"/failed/"+FAILID, covidcase.HandlerDeadLetter(store, dispatcher))
+
+	// Routes PUT and PATCH
+	r.Put("/corona/v1/notifications/"+WEBID, covidcase.HandlerNotification(store, dispatcher))   // Replace settings
+	r.Patch("/corona/v1/notifications/"+WEBID, covidcase.HandlerNotification(store, dispatcher)) // Change some settings
 
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	// Serve until interrupted, then let open requests finish before the deferred cleanup runs
+	srv := &http.Server{Addr: ":" + port, Handler: r}
+	srv.RegisterOnShutdown(dispatcher.EndStreams) // Open streams would keep Shutdown waiting otherwise
+	// A server failing to listen or stopping by itself goes through the same shutdown, exiting with an error after
+	serveErr := make(chan error, 1)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			serveErr <- err
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-quit:
+		log.Println("Shutting down")
+	case err := <-serveErr:
+		log.Println("Server stopped: " + err.Error())
+		exitCode = 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWNTIMEOUT)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("Shutdown: " + err.Error())
+	}
+}
+
+/*
+newStore opens the webhook storage backend named by kind
+* "firestore" uses the project in $FIRESTORE_PROJECT and optional credentials file in $FIRESTORE_CREDENTIALS
+* "bolt" uses a local database file at $BOLT_PATH, defaulting to BOLTPATH
+* "memory" or empty keeps registrations in process memory only
+*/
+func newStore(kind string) (db.Store, error) {
+	switch kind {
+	case "firestore":
+		project := os.Getenv("FIRESTORE_PROJECT")
+		if project == "" {
+			return nil, errors.New("$FIRESTORE_PROJECT must be set")
+		}
+		log.Println("Using Firestore webhook store for project " + project)
+		return db.NewFirestoreStore(project, os.Getenv("FIRESTORE_CREDENTIALS"))
+	case "bolt":
+		path := os.Getenv("BOLT_PATH")
+		if path == "" {
+			path = BOLTPATH
+		}
+		log.Println("Using bolt webhook store in " + path)
+		return db.NewBoltStore(path)
+	case "memory", "":
+		log.Println("Using in-memory webhook store, registrations are lost on restart")
+		return db.NewMemoryStore(), nil
+	default:
+		return nil, errors.New("unknown store " + kind)
+	}
+}
+
+/*
+envInt returns the integer in environment variable name, or def if it is unset or not a number
+*/
+func envInt(name string, def int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return value
 }
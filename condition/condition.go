@@ -0,0 +1,463 @@
+package condition
+
+/*
+Condition expressions over the values computed by the country and policy APIs, such as
+`stringency < 40 && trend < 0`. Expressions are type-checked when parsed, so evaluating one only fails on missing values.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Type of a value in an expression
+type Type int
+
+const (
+	NUMBER Type = iota
+	BOOL
+	STRING
+)
+
+// String returns the name of a type as used in error messages
+func (t Type) String() string {
+	switch t {
+	case NUMBER:
+		return "number"
+	case BOOL:
+		return "bool"
+	default:
+		return "string"
+	}
+}
+
+/*
+Variables an expression can refer to, with their types
+*/
+var Variables = map[string]Type{
+	"stringency":            NUMBER, // Stringency value from the policy API
+	"trend":                 NUMBER, // Change of the stringency over the week up to it, from the policy API
+	"confirmed":             NUMBER, // Confirmed cases from the cases API
+	"recovered":             NUMBER, // Recovered cases from the cases API
+	"population_percentage": NUMBER, // Percentage of the population with a confirmed case
+	"continent":             STRING, // Continent of the country, from the cases API
+}
+
+// Condition struct for a parsed, type-checked expression
+type Condition struct {
+	source string
+	root   *node
+	names  []string // Variables referred to, in order of first appearance
+}
+
+// node struct for one operation or operand in the syntax tree
+type node struct {
+	op          string      // Operator, or "lit" and "var" for operands
+	typ         Type        // Type the node evaluates to
+	left, right *node       // Operands, right is nil for unary operators
+	value       interface{} // Literal value
+	name        string      // Variable name
+}
+
+/*
+Parse returns the condition for source, or an error with the offset at which it is malformed or ill-typed.
+A condition has to evaluate to a bool.
+*/
+func Parse(source string) (*Condition, error) {
+	tokens, err := lex(source)
+	if err != nil {
+		return nil, err
+	}
+	p := parser{tokens: tokens, seen: make(map[string]bool)}
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %s at offset %d", tok, tok.pos)
+	}
+	if root.typ != BOOL {
+		return nil, errors.New("condition must be a comparison or bool, not a " + root.typ.String())
+	}
+	return &Condition{source: source, root: root, names: p.names}, nil
+}
+
+// String returns the source the condition was parsed from
+func (c *Condition) String() string {
+	return c.source
+}
+
+// Names returns the variables the condition refers to
+func (c *Condition) Names() []string {
+	return c.names
+}
+
+/*
+Eval evaluates the condition against values, which has to hold every variable in Names.
+Numbers are float64, bools bool and strings string.
+*/
+func (c *Condition) Eval(values map[string]interface{}) (bool, error) {
+	result, err := c.root.eval(values)
+	if err != nil {
+		return false, err
+	}
+	return result.(bool), nil
+}
+
+/*
+eval returns the value of n, the parser has made sure all operand types line up
+*/
+func (n *node) eval(values map[string]interface{}) (interface{}, error) {
+	switch n.op {
+	case "lit":
+		return n.value, nil
+	case "var":
+		value, ok := values[n.name]
+		if !ok {
+			return nil, errors.New("no value for " + n.name)
+		}
+		if !hasType(value, n.typ) {
+			return nil, fmt.Errorf("value for %s is not a %s", n.name, n.typ)
+		}
+		return value, nil
+	}
+
+	left, err := n.left.eval(values)
+	if err != nil {
+		return nil, err
+	}
+	// Unary operators
+	switch n.op {
+	case "!":
+		return !left.(bool), nil
+	case "neg":
+		return -left.(float64), nil
+	}
+	// Short-circuit the logical operators
+	if n.op == "&&" && !left.(bool) {
+		return false, nil
+	}
+	if n.op == "||" && left.(bool) {
+		return true, nil
+	}
+	right, err := n.right.eval(values)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "&&", "||":
+		return right.(bool), nil
+	case "==":
+		return left == right, nil
+	case "!=":
+		return left != right, nil
+	}
+	// What is left only takes numbers
+	a, b := left.(float64), right.(float64)
+	switch n.op {
+	case "<":
+		return a < b, nil
+	case "<=":
+		return a <= b, nil
+	case ">":
+		return a > b, nil
+	case ">=":
+		return a >= b, nil
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	default: // "/"
+		return a / b, nil
+	}
+}
+
+// hasType reports whether value is of the Go type used for typ
+func hasType(value interface{}, typ Type) bool {
+	switch value.(type) {
+	case float64:
+		return typ == NUMBER
+	case bool:
+		return typ == BOOL
+	case string:
+		return typ == STRING
+	default:
+		return false
+	}
+}
+
+/*
+Tokens produced by the lexer
+*/
+const (
+	tokEOF = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokOp
+)
+
+// token struct for one lexed piece of source
+type token struct {
+	kind int
+	text string
+	pos  int // Byte offset in the source
+}
+
+// String returns the token as shown in error messages
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of condition"
+	}
+	return "'" + t.text + "'"
+}
+
+// Operators, two character ones first so they are matched before their prefixes
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "*", "/", "(", ")"}
+
+/*
+lex splits source into tokens
+*/
+func lex(source string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(source); {
+		c := source[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isDigit(c) || (c == '.' && i+1 < len(source) && isDigit(source[i+1])):
+			start := i
+			for i < len(source) && (isDigit(source[i]) || source[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{tokNumber, source[start:i], start})
+		case isLetter(c):
+			start := i
+			for i < len(source) && (isLetter(source[i]) || isDigit(source[i])) {
+				i++
+			}
+			tokens = append(tokens, token{tokIdent, source[start:i], start})
+		case c == '"':
+			end := strings.IndexByte(source[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			tokens = append(tokens, token{tokString, source[i+1 : i+1+end], i})
+			i += end + 2
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(source[i:], op) {
+					tokens = append(tokens, token{tokOp, op, i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected '%c' at offset %d", c, i)
+			}
+		}
+	}
+	return append(tokens, token{tokEOF, "", len(source)}), nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+/*
+parser struct for a recursive descent over the tokens, lowest precedence first:
+
+	|| then && then comparisons then + - then * / then unary ! -
+*/
+type parser struct {
+	tokens []token
+	next   int
+	names  []string
+	seen   map[string]bool
+}
+
+// peek returns the next token without consuming it
+func (p *parser) peek() token {
+	return p.tokens[p.next]
+}
+
+// accept consumes the next token and returns true if it is one of the operators in ops
+func (p *parser) accept(ops ...string) (token, bool) {
+	tok := p.peek()
+	if tok.kind == tokOp {
+		for _, op := range ops {
+			if tok.text == op {
+				p.next++
+				return tok, true
+			}
+		}
+	}
+	return tok, false
+}
+
+func (p *parser) or() (*node, error) {
+	return p.binary(p.and, "||")
+}
+
+func (p *parser) and() (*node, error) {
+	return p.binary(p.comparison, "&&")
+}
+
+func (p *parser) sum() (*node, error) {
+	return p.binary(p.product, "+", "-")
+}
+
+func (p *parser) product() (*node, error) {
+	return p.binary(p.unary, "*", "/")
+}
+
+/*
+binary parses a left-associative chain of the operators in ops between operands parsed by operand
+*/
+func (p *parser) binary(operand func() (*node, error), ops ...string) (*node, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok, ok := p.accept(ops...)
+		if !ok {
+			return left, nil
+		}
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		if left, err = combine(tok, left, right); err != nil {
+			return nil, err
+		}
+	}
+}
+
+/*
+comparison parses at most one comparison, `a < b < c` is rejected rather than compared as a bool
+*/
+func (p *parser) comparison() (*node, error) {
+	left, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	tok, ok := p.accept("==", "!=", "<", "<=", ">", ">=")
+	if !ok {
+		return left, nil
+	}
+	right, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	if next, ok := p.accept("==", "!=", "<", "<=", ">", ">="); ok {
+		return nil, fmt.Errorf("comparisons cannot be chained, add && before %s at offset %d", next, next.pos)
+	}
+	return combine(tok, left, right)
+}
+
+func (p *parser) unary() (*node, error) {
+	tok, ok := p.accept("!", "-")
+	if !ok {
+		return p.primary()
+	}
+	operand, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	if tok.text == "!" {
+		if operand.typ != BOOL {
+			return nil, fmt.Errorf("%s at offset %d needs a bool, not a %s", tok, tok.pos, operand.typ)
+		}
+		return &node{op: "!", typ: BOOL, left: operand}, nil
+	}
+	if operand.typ != NUMBER {
+		return nil, fmt.Errorf("%s at offset %d needs a number, not a %s", tok, tok.pos, operand.typ)
+	}
+	return &node{op: "neg", typ: NUMBER, left: operand}, nil
+}
+
+func (p *parser) primary() (*node, error) {
+	tok := p.peek()
+	switch tok.kind {
+	case tokNumber:
+		p.next++
+		value, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed number %s at offset %d", tok, tok.pos)
+		}
+		return &node{op: "lit", typ: NUMBER, value: value}, nil
+	case tokString:
+		p.next++
+		return &node{op: "lit", typ: STRING, value: tok.text}, nil
+	case tokIdent:
+		p.next++
+		if tok.text == "true" || tok.text == "false" {
+			return &node{op: "lit", typ: BOOL, value: tok.text == "true"}, nil
+		}
+		typ, ok := Variables[tok.text]
+		if !ok {
+			return nil, fmt.Errorf("unknown variable %s at offset %d", tok, tok.pos)
+		}
+		if !p.seen[tok.text] {
+			p.seen[tok.text] = true
+			p.names = append(p.names, tok.text)
+		}
+		return &node{op: "var", typ: typ, name: tok.text}, nil
+	}
+
+	if _, ok := p.accept("("); ok {
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if tok, ok := p.accept(")"); !ok {
+			return nil, fmt.Errorf("expected ')' but found %s at offset %d", tok, tok.pos)
+		}
+		return inner, nil
+	}
+	return nil, fmt.Errorf("unexpected %s at offset %d", tok, tok.pos)
+}
+
+/*
+combine type-checks a binary operation and returns its node
+*/
+func combine(tok token, left, right *node) (*node, error) {
+	mismatch := func(want string) error {
+		return fmt.Errorf("%s at offset %d needs %s, not a %s and a %s", tok, tok.pos, want, left.typ, right.typ)
+	}
+
+	switch tok.text {
+	case "&&", "||":
+		if left.typ != BOOL || right.typ != BOOL {
+			return nil, mismatch("two bools")
+		}
+		return &node{op: tok.text, typ: BOOL, left: left, right: right}, nil
+	case "==", "!=":
+		if left.typ != right.typ {
+			return nil, mismatch("operands of the same type")
+		}
+		return &node{op: tok.text, typ: BOOL, left: left, right: right}, nil
+	case "<", "<=", ">", ">=":
+		if left.typ != NUMBER || right.typ != NUMBER {
+			return nil, mismatch("two numbers")
+		}
+		return &node{op: tok.text, typ: BOOL, left: left, right: right}, nil
+	default: // Arithmetic
+		if left.typ != NUMBER || right.typ != NUMBER {
+			return nil, mismatch("two numbers")
+		}
+		return &node{op: tok.text, typ: NUMBER, left: left, right: right}, nil
+	}
+}
@@ -0,0 +1,152 @@
+package condition
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// values every variable can be evaluated against
+var values = map[string]interface{}{
+	"stringency":            30.0,
+	"trend":                 -2.0,
+	"confirmed":             1000.0,
+	"recovered":             900.0,
+	"population_percentage": 1.5,
+	"continent":             "Europe",
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		source string
+		want   bool
+	}{
+		// Precedence, * before +, comparisons before &&, && before ||
+		{"1 + 2 * 3 == 7", true},
+		{"2 * 3 + 1 == 7", true},
+		{"true || false && false", true},
+		{"false && true || true", true},
+		{"stringency < 40 && trend < 0", true},
+		{"stringency > 40 || trend < 0 && confirmed > 500", true},
+		// Left associativity
+		{"10 - 4 - 3 == 3", true},
+		{"12 / 2 / 3 == 2", true},
+		// Unary operators bind tightest
+		{"-2 * 3 == -6", true},
+		{"!false && false", false},
+		{"!(false && false)", true},
+		{"- -1 == 1", true},
+		// Parentheses
+		{"(1 + 2) * 3 == 9", true},
+		{"(true || false) && false", false},
+		{"((stringency))  <  (40)", true},
+		// Variables of every type
+		{"continent == \"Europe\"", true},
+		{"continent != \"Asia\"", true},
+		{"confirmed - recovered == 100", true},
+		{"population_percentage >= 1.5", true},
+		{".5 < 1", true},
+		{"true", true},
+	}
+	for _, test := range tests {
+		cond, err := Parse(test.source)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.source, err)
+			continue
+		}
+		got, err := cond.Eval(values)
+		if err != nil {
+			t.Errorf("Eval(%q): %v", test.source, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("Eval(%q) = %v, want %v", test.source, got, test.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string // Part of the error message
+	}{
+		// Unknown identifiers
+		{"deaths > 10", "unknown variable 'deaths' at offset 0"},
+		{"stringency > 10 && Stringency < 50", "unknown variable 'Stringency' at offset 19"},
+		// Type mismatches
+		{"continent > 1", "'>' at offset 10 needs two numbers, not a string and a number"},
+		{"continent == 1", "needs operands of the same type, not a string and a number"},
+		{"stringency && true", "needs two bools, not a number and a bool"},
+		{"!stringency", "'!' at offset 0 needs a bool, not a number"},
+		{"-continent == 1", "'-' at offset 0 needs a number, not a string"},
+		{"\"a\" + 1 == 2", "needs two numbers, not a string and a number"},
+		{"stringency + 1", "condition must be a comparison or bool, not a number"},
+		{"continent", "condition must be a comparison or bool, not a string"},
+		// Trailing tokens
+		{"stringency > 1 stringency", "unexpected 'stringency' at offset 15"},
+		{"true )", "unexpected ')' at offset 5"},
+		{"1 < 2 < 3", "comparisons cannot be chained, add && before '<' at offset 6"},
+		// Malformed input
+		{"(true", "expected ')' but found end of condition at offset 5"},
+		{"stringency >", "unexpected end of condition at offset 12"},
+		{"", "unexpected end of condition at offset 0"},
+		{"continent == \"Europe", "unterminated string at offset 13"},
+		{"stringency # 2", "unexpected '#' at offset 11"},
+		{"1.2.3 > 1", "malformed number '1.2.3' at offset 0"},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.source)
+		if err == nil {
+			t.Errorf("Parse(%q) succeeded, want error containing %q", test.source, test.want)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("Parse(%q) = %q, want error containing %q", test.source, err, test.want)
+		}
+	}
+}
+
+func TestEvalMissingValues(t *testing.T) {
+	tests := []struct {
+		source string
+		values map[string]interface{}
+		want   bool
+		err    string // Part of the error message, empty if none is expected
+	}{
+		{"stringency < 40", map[string]interface{}{}, false, "no value for stringency"},
+		{"stringency < 40", map[string]interface{}{"stringency": "30"}, false, "value for stringency is not a number"},
+		{"continent == \"Europe\"", map[string]interface{}{"continent": 1.0}, false, "value for continent is not a string"},
+		// The right side is never looked at when the left side decides
+		{"stringency > 40 && trend < 0", map[string]interface{}{"stringency": 30.0}, false, ""},
+		{"stringency < 40 || trend < 0", map[string]interface{}{"stringency": 30.0}, true, ""},
+		{"stringency < 40 && trend < 0", map[string]interface{}{"stringency": 30.0}, false, "no value for trend"},
+	}
+	for _, test := range tests {
+		cond, err := Parse(test.source)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.source, err)
+			continue
+		}
+		got, err := cond.Eval(test.values)
+		if test.err == "" {
+			if err != nil || got != test.want {
+				t.Errorf("Eval(%q) = %v, %v, want %v", test.source, got, err, test.want)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Eval(%q) = %v, %v, want error containing %q", test.source, got, err, test.err)
+		}
+	}
+}
+
+func TestNames(t *testing.T) {
+	cond, err := Parse("trend < 0 && (stringency > 10 || trend > -5) && continent == \"Asia\"")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"trend", "stringency", "continent"}
+	if !reflect.DeepEqual(cond.Names(), want) {
+		t.Errorf("Names() = %v, want %v", cond.Names(), want)
+	}
+}
@@ -1,9 +1,13 @@
 package country
 
 import (
-	"covidcase/utils"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"sort"
+	"strings"
 )
 
 /*
@@ -13,6 +17,18 @@ const BASEURL = "https://covid-api.mmediagroup.fr/v1/cases"
 const CASEURL = "https://covid-api.mmediagroup.fr/v1/cases?country=%s"                     // For all covid cases
 const SCOPEURL = "https://covid-api.mmediagroup.fr/v1/history?country=%s&status=Confirmed" // Cases within a date scope
 
+// ErrUnknownCountry is returned when the cases API has no data for a country
+var ErrUnknownCountry = errors.New("unknown country")
+
+// ErrDateNotAvailable is returned when the history of a country has no cases for a date of the scope
+var ErrDateNotAvailable = errors.New("date not available")
+
+// ErrSchemaChanged is returned when a response of the cases API does not look like it used to
+var ErrSchemaChanged = errors.New("upstream schema changed")
+
+// ErrUpstream is returned when the cases API answers with a status other than 200 OK
+var ErrUpstream = errors.New("cases API answered")
+
 // CaseInfo struct for JSON encoding HTTP request data
 type CaseInfo struct {
 	Country              string  `json:"country"`
@@ -23,69 +39,186 @@ type CaseInfo struct {
 	PopulationPercentage string  `json:"population_percentage"`
 }
 
+// Cases struct for JSON decoding the `/cases` response for one country, keyed by region with "All" for the total.
+// Unknown countries get an empty object
+type Cases map[string]CaseTotals
+
+// CaseTotals struct for JSON decoding the totals of one region, fields are pointers to tell missing ones apart
+type CaseTotals struct {
+	Country    *string  `json:"country"`
+	Continent  *string  `json:"continent"`
+	Confirmed  *float64 `json:"confirmed"`
+	Recovered  *float64 `json:"recovered"`
+	Population *float64 `json:"population"`
+}
+
+// History struct for JSON decoding the `/history` response for one country, keyed by region with "All" for the total.
+// Unknown countries get an empty object
+type History map[string]CaseHistory
+
+// CaseHistory struct for JSON decoding the confirmed cases of one region by date (YYYY-MM-DD)
+type CaseHistory struct {
+	Country    *string            `json:"country"`
+	Continent  *string            `json:"continent"`
+	Population *float64           `json:"population"`
+	Dates      map[string]float64 `json:"dates"`
+}
+
 /*
-GetCountryData returns a map of a decoded json object with
-specified total confirmed cases and total of recovered based on a timescope(date) specified
+GetCountryData returns the total confirmed cases and recovered of a country, or the confirmed cases between
+two dates (YYYY-MM-DD) of its history if both are given.
+Errors are ErrUnknownCountry, ErrDateNotAvailable or ErrSchemaChanged if the data is not there, ErrUpstream if the
+cases API answered with an error status, otherwise it could not be reached.
 */
 func GetCountryData(startDate, endDate, countryName string) (CaseInfo, error) {
-	var result map[string]interface{}
 	var caseInfo CaseInfo
 
 	if startDate == "" || endDate == "" { // Format within complete scope
+		var result Cases
 		// Insert parameters into CASEURL for HTTP GET request
-		resData, err := http.Get(fmt.Sprintf(CASEURL, countryName))
+		err := get(fmt.Sprintf(CASEURL, url.QueryEscape(countryName)), &result)
 		if err != nil { // Error handling data
 			return caseInfo, err
 		}
-		result, err = utils.DecodeResponseToMap(resData, "") // Decode for data extraction into Caseinfo struct
-		if err != nil {                                      // Error handling data
+		all, ok := result["All"]
+		if !ok { // Error handling unknown country
+			return caseInfo, ErrUnknownCountry
+		}
+		if err := require(map[string]bool{"country": all.Country != nil, "continent": all.Continent != nil,
+			"confirmed": all.Confirmed != nil, "recovered": all.Recovered != nil, "population": all.Population != nil}); err != nil {
 			return caseInfo, err
 		}
 
 		// Inserting and processing data into caseInfo struct
-		// Remember to use type assertion at the end ".(float64)/.(string)" since the program has to deal with interface{}
-		caseInfo.Country = result["All"].(map[string]interface{})["country"].(string)      // Country
-		caseInfo.Continent = result["All"].(map[string]interface{})["continent"].(string)  // Continent
-		caseInfo.Scope = "total"                                                           // Scope
-		caseInfo.Confirmed = result["All"].(map[string]interface{})["confirmed"].(float64) // Confirmed cases
-		caseInfo.Recovered = result["All"].(map[string]interface{})["recovered"].(float64) // Recovered cases
+		caseInfo.Country = *all.Country     // Country
+		caseInfo.Continent = *all.Continent // Continent
+		caseInfo.Scope = "total"            // Scope
+		caseInfo.Confirmed = *all.Confirmed // Confirmed cases
+		caseInfo.Recovered = *all.Recovered // Recovered cases
 		// Percentage of population with a confirmed case
-		percentage := caseInfo.Confirmed / result["All"].(map[string]interface{})["population"].(float64) * 100
-		caseInfo.PopulationPercentage = fmt.Sprintf("%.2f", percentage)
+		caseInfo.PopulationPercentage = percentage(caseInfo.Confirmed, *all.Population)
 
 		return caseInfo, nil
 	} else { // Format within scope of date specified
-
+		var result History
 		// Insert parameters into SCOPEURL for HTTP GET request
-		resData, err := http.Get(fmt.Sprintf(SCOPEURL, countryName)) // Confirmed cases
-		if err != nil {                                              // Error handling data
+		err := get(fmt.Sprintf(SCOPEURL, url.QueryEscape(countryName)), &result) // Confirmed cases
+		if err != nil {                                                          // Error handling data
 			return caseInfo, err
 		}
-		// Processing scope
-		result, err = utils.DecodeResponseToMap(resData, "") // Decode for data extraction into Caseinfo struct
-		if err != nil {                                      // Error handling data
+		all, ok := result["All"]
+		if !ok { // Error handling unknown country
+			return caseInfo, ErrUnknownCountry
+		}
+		if err := require(map[string]bool{"country": all.Country != nil, "continent": all.Continent != nil,
+			"population": all.Population != nil, "dates": all.Dates != nil}); err != nil {
 			return caseInfo, err
 		}
 
 		// Extracting confirmed cases at start date and end date for scope calculation
-		startDateCases := result["All"].(map[string]interface{})["dates"].(map[string]interface{})[startDate].(float64)
-		endDateCases := result["All"].(map[string]interface{})["dates"].(map[string]interface{})[endDate].(float64)
+		startDateCases, ok := all.Dates[startDate]
+		if !ok { // Error handling dates outside the history
+			return caseInfo, fmt.Errorf("%w: %s", ErrDateNotAvailable, startDate)
+		}
+		endDateCases, ok := all.Dates[endDate]
+		if !ok {
+			return caseInfo, fmt.Errorf("%w: %s", ErrDateNotAvailable, endDate)
+		}
 
 		// Inserting data into caseInfo struct
-		// Remember to use type assertion at the end ".(float)/.(string)" since the program has to deal with interface{}
-		caseInfo.Country = result["All"].(map[string]interface{})["country"].(string)     // Country
-		caseInfo.Continent = result["All"].(map[string]interface{})["continent"].(string) // Continent
-		caseInfo.Scope = startDate + "-" + endDate                                        // Scope
-		caseInfo.Confirmed = endDateCases - startDateCases                                // Confirmed cases
-		caseInfo.Recovered = 0                                                            // No recovery cases response
+		caseInfo.Country = *all.Country                    // Country
+		caseInfo.Continent = *all.Continent                // Continent
+		caseInfo.Scope = startDate + "-" + endDate         // Scope
+		caseInfo.Confirmed = endDateCases - startDateCases // Confirmed cases
+		caseInfo.Recovered = 0                             // No recovery cases response
 		// Percentage of population with a confirmed case
-		percentage := caseInfo.Confirmed / result["All"].(map[string]interface{})["population"].(float64) * 100
-		caseInfo.PopulationPercentage = fmt.Sprintf("%.2f", percentage)
+		caseInfo.PopulationPercentage = percentage(caseInfo.Confirmed, *all.Population)
 
 		return caseInfo, nil
 	}
 }
 
+/*
+get sends an HTTP GET request to the cases API and decodes the JSON response into v,
+a status other than 200 OK is reported as ErrUpstream and a response that cannot be decoded into v as ErrSchemaChanged
+*/
+func get(rawURL string, v interface{}) error {
+	resData, err := http.Get(rawURL)
+	if err != nil { // Error handling HTTP request
+		return err
+	}
+	defer resData.Body.Close()
+	if resData.StatusCode != http.StatusOK { // Error handling HTTP status
+		return fmt.Errorf("%w %s", ErrUpstream, resData.Status)
+	}
+	if err := json.NewDecoder(resData.Body).Decode(v); err != nil { // Error handling decoding
+		return fmt.Errorf("%w: %v", ErrSchemaChanged, err)
+	}
+	return nil
+}
+
+/*
+require returns ErrSchemaChanged naming every field that is not present, nil if none are missing
+*/
+func require(present map[string]bool) error {
+	var missing []string
+	for field, ok := range present {
+		if !ok {
+			missing = append(missing, field)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return fmt.Errorf("%w: missing %s", ErrSchemaChanged, strings.Join(missing, ", "))
+}
+
+/*
+percentage returns the share of population with a confirmed case, formatted with two decimals
+*/
+func percentage(confirmed, population float64) string {
+	if population <= 0 { // Nothing to take a share of
+		return fmt.Sprintf("%.2f", 0.0)
+	}
+	return fmt.Sprintf("%.2f", confirmed/population*100)
+}
+
+/*
+GetCountries returns the continent of every country the cases API has data for, keyed by country name
+*/
+func GetCountries() (map[string]string, error) {
+	var result map[string]Cases
+	// BASEURL without a country lists them all, keyed by country
+	err := get(BASEURL, &result)
+	if err != nil { // Error handling data
+		return nil, err
+	}
+
+	countries := make(map[string]string)
+	for name, cases := range result {
+		// Entries without a continent, like the global total, are not countries
+		if all, ok := cases["All"]; ok && all.Continent != nil && *all.Continent != "" {
+			countries[name] = *all.Continent
+		}
+	}
+	return countries, nil
+}
+
+/*
+Exists reports whether the cases API has data for countryName, unknown countries get an empty object
+*/
+func Exists(countryName string) (bool, error) {
+	var result Cases
+	// Insert parameters into CASEURL for HTTP GET request
+	err := get(fmt.Sprintf(CASEURL, url.QueryEscape(countryName)), &result)
+	if err != nil { // Error handling data
+		return false, err
+	}
+	_, ok := result["All"]
+	return ok, nil
+}
+
 /*
 HealthCheck returns an http status code after checking for a response from REST Countries API servers
 */
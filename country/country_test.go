@@ -0,0 +1,63 @@
+package country
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// stubTransport struct for answering every request of the default client with one status and body
+type stubTransport struct {
+	status int
+	body   string
+}
+
+func (s stubTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: s.status, Status: http.StatusText(s.status), Header: make(http.Header),
+		Body: ioutil.NopCloser(strings.NewReader(s.body)), Request: r}, nil
+}
+
+// stub answers the requests of the default client with status and body, returning a func restoring its transport
+func stub(status int, body string) func() {
+	transport := http.DefaultClient.Transport
+	http.DefaultClient.Transport = stubTransport{status, body}
+	return func() { http.DefaultClient.Transport = transport }
+}
+
+func TestGetCountries(t *testing.T) {
+	defer stub(http.StatusOK, `{
+		"Norway": {"All": {"country": "Norway", "continent": "Europe", "confirmed": 61000}, "Oslo": {"confirmed": 20000}},
+		"Japan": {"All": {"country": "Japan", "continent": "Asia"}},
+		"Global": {"All": {"population": 7800000000, "confirmed": 100000000}},
+		"Diamond Princess": {"All": {"country": "Diamond Princess", "continent": ""}}
+	}`)()
+	countries, err := GetCountries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(countries) != 2 || countries["Norway"] != "Europe" || countries["Japan"] != "Asia" {
+		t.Errorf("GetCountries = %v, want Norway and Japan only", countries)
+	}
+}
+
+func TestGetCountriesSchemaChanged(t *testing.T) {
+	defer stub(http.StatusOK, `{"Norway": {"All": {"continent": 1}}}`)()
+	if _, err := GetCountries(); !errors.Is(err, ErrSchemaChanged) {
+		t.Errorf("GetCountries = %v, want ErrSchemaChanged", err)
+	}
+}
+
+func TestUpstreamStatus(t *testing.T) {
+	defer stub(http.StatusServiceUnavailable, `<html>down for maintenance</html>`)()
+	if _, err := GetCountries(); !errors.Is(err, ErrUpstream) {
+		t.Errorf("GetCountries = %v, want ErrUpstream", err)
+	}
+	if _, err := GetCountryData("", "", "Norway"); !errors.Is(err, ErrUpstream) || !strings.Contains(err.Error(), "Service Unavailable") {
+		t.Errorf("GetCountryData = %v, want ErrUpstream with the status", err)
+	}
+	if _, err := Exists("Norway"); !errors.Is(err, ErrUpstream) {
+		t.Errorf("Exists = %v, want ErrUpstream", err)
+	}
+}
@@ -0,0 +1,799 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.etcd.io/bbolt"
+	"strconv"
+	"time"
+)
+
+/*
+Bucket and key names used in the bolt database file
+*/
+const BUCKETMETA = "meta"          // Bookkeeping such as the schema version
+const BUCKETWEBHOOKS = "webhooks"  // Webhook registrations keyed by id
+const BUCKETDEADLETTERS = "failed" // Failed deliveries keyed by webhook id and delivery id
+const BUCKETHISTORY = "history"    // Delivery attempts keyed by webhook id, time and entry id
+const BUCKETDIGESTS = "digests"    // Events waiting for a digest keyed by webhook id, time and event id
+const BUCKETKEYS = "idempotency"   // Idempotency keys of registration requests keyed by name
+const BUCKETAUDIT = "audit"        // Changes made through the API keyed by webhook id, time and entry id
+const BUCKETCHANGES = "changes"    // Change log keyed by id, big-endian so keys sort like the ids
+const KEYSCHEMA = "schema"         // Key in BUCKETMETA holding the current schema version
+const KEYPRUNED = "changes_pruned" // Key in BUCKETMETA holding the highest id removed from the change log
+
+// migration upgrades the database file by one schema version
+type migration func(tx *bbolt.Tx) error
+
+/*
+migrations are applied in order to files with an older schema, index i upgrades from version i to i+1.
+Append new migrations to the end, never change or reorder existing ones.
+*/
+var migrations = []migration{
+	// 1: webhook registrations
+	func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(BUCKETWEBHOOKS))
+		return err
+	},
+	// 2: dead letters
+	func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(BUCKETDEADLETTERS))
+		return err
+	},
+	// 3: delivery history
+	func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(BUCKETHISTORY))
+		return err
+	},
+	// 4: events waiting for a digest
+	func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(BUCKETDIGESTS))
+		return err
+	},
+	// 5: idempotency keys
+	func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(BUCKETKEYS))
+		return err
+	},
+	// 6: audit log
+	func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(BUCKETAUDIT))
+		return err
+	},
+	// 7: change log
+	func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(BUCKETCHANGES))
+		return err
+	},
+}
+
+// BoltStore struct for keeping webhooks in an embedded bolt database file, registrations survive restarts
+type BoltStore struct {
+	db *bbolt.DB
+}
+
+/*
+NewBoltStore opens (or creates) the bolt database file at path and migrates it to the current schema
+*/
+func NewBoltStore(path string) (*BoltStore, error) {
+	// Timeout stops a second process from waiting forever on the file lock
+	bdb, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil { // Error handling file
+		return nil, err
+	}
+	if err := migrate(bdb); err != nil { // Error handling schema upgrade
+		bdb.Close()
+		return nil, err
+	}
+	return &BoltStore{db: bdb}, nil
+}
+
+/*
+Create stores a new webhook with a generated id
+*/
+func (s *BoltStore) Create(hook Webhook) (Webhook, error) {
+	id, err := NewID()
+	if err != nil { // Error handling id generation
+		return Webhook{}, err
+	}
+	hook.ID = id
+	hook.Created = time.Now().UTC()
+
+	data, err := json.Marshal(hook)
+	if err != nil { // Error handling encoding
+		return Webhook{}, err
+	}
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(BUCKETWEBHOOKS)).Put([]byte(id), data)
+	})
+	if err != nil { // Error handling write
+		return Webhook{}, err
+	}
+	return hook, nil
+}
+
+/*
+Get returns the webhook with the given id
+*/
+func (s *BoltStore) Get(id string) (Webhook, error) {
+	var hook Webhook
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket([]byte(BUCKETWEBHOOKS)).Get([]byte(id))
+		if data == nil {
+			return ErrNotFound
+		}
+		// Data is only valid during the transaction, decode before returning
+		return json.Unmarshal(data, &hook)
+	})
+	return hook, err
+}
+
+/*
+Update replaces the stored webhook with the same id
+*/
+func (s *BoltStore) Update(hook Webhook) error {
+	data, err := json.Marshal(hook)
+	if err != nil { // Error handling encoding
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKETWEBHOOKS))
+		if b.Get([]byte(hook.ID)) == nil {
+			return ErrNotFound
+		}
+		return b.Put([]byte(hook.ID), data)
+	})
+}
+
+/*
+Modify applies fn to the stored webhook with the given id and stores the result in one write transaction
+*/
+func (s *BoltStore) Modify(id string, fn func(hook *Webhook) error) (Webhook, error) {
+	var hook Webhook
+
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKETWEBHOOKS))
+		data := b.Get([]byte(id))
+		if data == nil {
+			return ErrNotFound
+		}
+		if err := json.Unmarshal(data, &hook); err != nil { // Error handling decoding
+			return err
+		}
+		if err := fn(&hook); err != nil {
+			return err
+		}
+		hook.ID = id // The id is not fn's to change
+		data, err := json.Marshal(hook)
+		if err != nil { // Error handling encoding
+			return err
+		}
+		return b.Put([]byte(id), data)
+	})
+	if err != nil {
+		return Webhook{}, err
+	}
+	return hook, nil
+}
+
+/*
+List returns all webhooks ordered by creation time
+*/
+func (s *BoltStore) List() ([]Webhook, error) {
+	var hooks []Webhook
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(BUCKETWEBHOOKS)).ForEach(func(_, data []byte) error {
+			var hook Webhook
+			if err := json.Unmarshal(data, &hook); err != nil { // Error handling decoding
+				return err
+			}
+			hooks = append(hooks, hook)
+			return nil
+		})
+	})
+	if err != nil { // Error handling read
+		return nil, err
+	}
+
+	// Keys are random ids, so order has to be restored here
+	sortByCreated(hooks)
+	return hooks, nil
+}
+
+/*
+Delete removes the webhook with the given id along with its dead letters, history and digest events, not its audit log
+*/
+func (s *BoltStore) Delete(id string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKETWEBHOOKS))
+		if b.Get([]byte(id)) == nil {
+			return ErrNotFound
+		}
+		if err := b.Delete([]byte(id)); err != nil { // Error handling write
+			return err
+		}
+		if err := deletePrefix(tx.Bucket([]byte(BUCKETDEADLETTERS)), deadLetterKey(id, "")); err != nil {
+			return err
+		}
+		if err := deletePrefix(tx.Bucket([]byte(BUCKETHISTORY)), []byte(id+"/")); err != nil {
+			return err
+		}
+		return deletePrefix(tx.Bucket([]byte(BUCKETDIGESTS)), []byte(id+"/"))
+	})
+}
+
+/*
+Count returns the number of stored webhooks
+*/
+func (s *BoltStore) Count() (int, error) {
+	var n int
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		n = tx.Bucket([]byte(BUCKETWEBHOOKS)).Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
+/*
+AddDeadLetter stores a failed delivery
+*/
+func (s *BoltStore) AddDeadLetter(delivery Delivery) (Delivery, error) {
+	delivery, err := prepareDeadLetter(delivery)
+	if err != nil { // Error handling id generation
+		return delivery, err
+	}
+	data, err := json.Marshal(delivery)
+	if err != nil { // Error handling encoding
+		return delivery, err
+	}
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(BUCKETDEADLETTERS)).Put(deadLetterKey(delivery.WebhookID, delivery.ID), data)
+	})
+	return delivery, err
+}
+
+/*
+GetDeadLetter returns one failed delivery of a webhook
+*/
+func (s *BoltStore) GetDeadLetter(webhookID, id string) (Delivery, error) {
+	var delivery Delivery
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket([]byte(BUCKETDEADLETTERS)).Get(deadLetterKey(webhookID, id))
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, &delivery)
+	})
+	return delivery, err
+}
+
+/*
+ListDeadLetters returns the failed deliveries of a webhook ordered by creation time
+*/
+func (s *BoltStore) ListDeadLetters(webhookID string) ([]Delivery, error) {
+	var deliveries []Delivery
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		prefix := deadLetterKey(webhookID, "")
+		c := tx.Bucket([]byte(BUCKETDEADLETTERS)).Cursor()
+		for k, data := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, data = c.Next() {
+			var delivery Delivery
+			if err := json.Unmarshal(data, &delivery); err != nil { // Error handling decoding
+				return err
+			}
+			deliveries = append(deliveries, delivery)
+		}
+		return nil
+	})
+	if err != nil { // Error handling read
+		return nil, err
+	}
+
+	sortDeliveries(deliveries)
+	return deliveries, nil
+}
+
+/*
+DeleteDeadLetter removes one failed delivery of a webhook
+*/
+func (s *BoltStore) DeleteDeadLetter(webhookID, id string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKETDEADLETTERS))
+		key := deadLetterKey(webhookID, id)
+		if b.Get(key) == nil {
+			return ErrNotFound
+		}
+		return b.Delete(key)
+	})
+}
+
+/*
+AddHistory records a delivery attempt
+*/
+func (s *BoltStore) AddHistory(entry HistoryEntry) error {
+	if entry.ID == "" {
+		id, err := NewID()
+		if err != nil { // Error handling id generation
+			return err
+		}
+		entry.ID = id
+	}
+	data, err := json.Marshal(entry)
+	if err != nil { // Error handling encoding
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(BUCKETHISTORY)).Put(historyKey(entry), data)
+	})
+}
+
+/*
+ListHistory returns the recorded attempts of a webhook, newest first
+*/
+func (s *BoltStore) ListHistory(webhookID string) ([]HistoryEntry, error) {
+	var entries []HistoryEntry
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		prefix := []byte(webhookID + "/")
+		c := tx.Bucket([]byte(BUCKETHISTORY)).Cursor()
+		for k, data := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, data = c.Next() {
+			var entry HistoryEntry
+			if err := json.Unmarshal(data, &entry); err != nil { // Error handling decoding
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	if err != nil { // Error handling read
+		return nil, err
+	}
+
+	sortHistory(entries)
+	return entries, nil
+}
+
+/*
+PruneHistory removes attempts that are too old or beyond the newest keep of each webhook
+*/
+func (s *BoltStore) PruneHistory(before time.Time, keep int) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKETHISTORY))
+
+		// Group every entry by webhook, limits apply per webhook
+		byWebhook := make(map[string][]HistoryEntry)
+		err := b.ForEach(func(_, data []byte) error {
+			var entry HistoryEntry
+			if err := json.Unmarshal(data, &entry); err != nil { // Error handling decoding
+				return err
+			}
+			byWebhook[entry.WebhookID] = append(byWebhook[entry.WebhookID], entry)
+			return nil
+		})
+		if err != nil { // Error handling read
+			return err
+		}
+
+		for _, entries := range byWebhook {
+			_, removed := pruneHistory(entries, before, keep)
+			for _, entry := range removed {
+				if err := b.Delete(historyKey(entry)); err != nil { // Error handling write
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+/*
+AddDigestEvent stores an event for the next digest of its webhook
+*/
+func (s *BoltStore) AddDigestEvent(event DigestEvent) error {
+	event, err := prepareDigestEvent(event)
+	if err != nil { // Error handling id generation
+		return err
+	}
+	data, err := json.Marshal(event)
+	if err != nil { // Error handling encoding
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(BUCKETDIGESTS)).Put(digestKey(event), data)
+	})
+}
+
+/*
+ListDigestEvents returns the events waiting for the digest of a webhook, oldest first
+*/
+func (s *BoltStore) ListDigestEvents(webhookID string) ([]DigestEvent, error) {
+	var events []DigestEvent
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		prefix := []byte(webhookID + "/")
+		c := tx.Bucket([]byte(BUCKETDIGESTS)).Cursor()
+		for k, data := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, data = c.Next() {
+			var event DigestEvent
+			if err := json.Unmarshal(data, &event); err != nil { // Error handling decoding
+				return err
+			}
+			events = append(events, event)
+		}
+		return nil
+	})
+	if err != nil { // Error handling read
+		return nil, err
+	}
+
+	sortDigestEvents(events)
+	return events, nil
+}
+
+/*
+DeleteDigestEvents removes the events of a webhook recorded before the given time
+*/
+func (s *BoltStore) DeleteDigestEvents(webhookID string, before time.Time) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		// Keys sort by time within a webhook, so everything up to the first later key goes
+		prefix := []byte(webhookID + "/")
+		end := []byte(fmt.Sprintf("%s/%020d", webhookID, before.UnixNano()))
+		var keys [][]byte
+		c := tx.Bucket([]byte(BUCKETDIGESTS)).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) && bytes.Compare(k, end) < 0; k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		for _, k := range keys {
+			if err := tx.Bucket([]byte(BUCKETDIGESTS)).Delete(k); err != nil { // Error handling write
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+/*
+ClaimIdempotencyKey stores key unless an unexpired key by the same name exists, in one transaction
+*/
+func (s *BoltStore) ClaimIdempotencyKey(key IdempotencyKey, now time.Time) (IdempotencyKey, bool, error) {
+	existing := key
+	claimed := false
+
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKETKEYS))
+		if data := b.Get([]byte(key.Key)); data != nil {
+			if err := json.Unmarshal(data, &existing); err != nil { // Error handling decoding
+				return err
+			}
+			if existing.Expires.After(now) {
+				return nil
+			}
+		}
+		data, err := json.Marshal(key)
+		if err != nil { // Error handling encoding
+			return err
+		}
+		existing, claimed = key, true
+		return b.Put([]byte(key.Key), data)
+	})
+	return existing, claimed, err
+}
+
+/*
+SwapIdempotencyKey replaces old with key if the stored key is still old, in one transaction
+*/
+func (s *BoltStore) SwapIdempotencyKey(old, key IdempotencyKey) (bool, error) {
+	data, err := json.Marshal(key)
+	if err != nil { // Error handling encoding
+		return false, err
+	}
+	swapped := false
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKETKEYS))
+		if same, err := storedKey(b, old); err != nil || !same {
+			return err
+		}
+		swapped = true
+		return b.Put([]byte(key.Key), data)
+	})
+	return swapped, err
+}
+
+/*
+DeleteIdempotencyKey removes key so it can be used again unless it was replaced, in one transaction
+*/
+func (s *BoltStore) DeleteIdempotencyKey(key IdempotencyKey) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKETKEYS))
+		if same, err := storedKey(b, key); err != nil || !same {
+			return err
+		}
+		return b.Delete([]byte(key.Key))
+	})
+}
+
+/*
+storedKey reports whether key is what the bucket holds under its name
+*/
+func storedKey(b *bbolt.Bucket, key IdempotencyKey) (bool, error) {
+	data := b.Get([]byte(key.Key))
+	if data == nil {
+		return false, nil
+	}
+	var existing IdempotencyKey
+	if err := json.Unmarshal(data, &existing); err != nil { // Error handling decoding
+		return false, err
+	}
+	return existing.same(key), nil
+}
+
+/*
+PruneIdempotencyKeys removes keys that expired before the given time
+*/
+func (s *BoltStore) PruneIdempotencyKeys(before time.Time) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKETKEYS))
+		var expired [][]byte
+		err := b.ForEach(func(k, data []byte) error {
+			var key IdempotencyKey
+			if err := json.Unmarshal(data, &key); err != nil { // Error handling decoding
+				return err
+			}
+			if key.Expires.Before(before) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil { // Error handling write
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+/*
+AddAuditEntry appends an entry to the audit log of its webhook
+*/
+func (s *BoltStore) AddAuditEntry(entry AuditEntry) (AuditEntry, error) {
+	entry, err := prepareAuditEntry(entry)
+	if err != nil { // Error handling id generation
+		return entry, err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil { // Error handling encoding
+		return entry, err
+	}
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(BUCKETAUDIT)).Put(auditKey(entry), data)
+	})
+	return entry, err
+}
+
+/*
+ListAuditEntries returns the audit log of a webhook, oldest first
+*/
+func (s *BoltStore) ListAuditEntries(webhookID string) ([]AuditEntry, error) {
+	var entries []AuditEntry
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		prefix := []byte(webhookID + "/")
+		c := tx.Bucket([]byte(BUCKETAUDIT)).Cursor()
+		for k, data := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, data = c.Next() {
+			var entry AuditEntry
+			if err := json.Unmarshal(data, &entry); err != nil { // Error handling decoding
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	if err != nil { // Error handling read
+		return nil, err
+	}
+
+	sortAuditEntries(entries)
+	return entries, nil
+}
+
+/*
+AddChange appends a change to the change log
+*/
+func (s *BoltStore) AddChange(change Change) error {
+	data, err := json.Marshal(change)
+	if err != nil { // Error handling encoding
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(BUCKETCHANGES)).Put(changeKey(change.ID), data)
+	})
+}
+
+/*
+ListChanges returns up to limit changes with an id above since, lowest id first
+*/
+func (s *BoltStore) ListChanges(since int64, limit int) ([]Change, error) {
+	var changes []Change
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket([]byte(BUCKETCHANGES)).Cursor()
+		for k, data := c.Seek(changeKey(since + 1)); k != nil && len(changes) < limit; k, data = c.Next() {
+			var change Change
+			if err := json.Unmarshal(data, &change); err != nil { // Error handling decoding
+				return err
+			}
+			changes = append(changes, change)
+		}
+		return nil
+	})
+	if err != nil { // Error handling read
+		return nil, err
+	}
+	return changes, nil
+}
+
+/*
+PruneChanges removes changes observed before the given time, recording the highest id removed in BUCKETMETA
+*/
+func (s *BoltStore) PruneChanges(before time.Time) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKETCHANGES))
+		pruned, err := changesPruned(tx)
+		if err != nil {
+			return err
+		}
+		var expired [][]byte
+		err = b.ForEach(func(k, data []byte) error {
+			var change Change
+			if err := json.Unmarshal(data, &change); err != nil { // Error handling decoding
+				return err
+			}
+			if change.Time.Before(before) {
+				expired = append(expired, append([]byte(nil), k...))
+				if change.ID > pruned {
+					pruned = change.ID
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(expired) == 0 {
+			return nil
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil { // Error handling write
+				return err
+			}
+		}
+		return tx.Bucket([]byte(BUCKETMETA)).Put([]byte(KEYPRUNED), []byte(strconv.FormatInt(pruned, 10)))
+	})
+}
+
+/*
+ChangesPruned returns the highest id removed from the change log so far
+*/
+func (s *BoltStore) ChangesPruned() (int64, error) {
+	var pruned int64
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		pruned, err = changesPruned(tx)
+		return err
+	})
+	return pruned, err
+}
+
+/*
+Close closes the database file, releasing its lock
+*/
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+/*
+migrate applies every migration newer than the schema version recorded in the file, in one transaction
+*/
+func migrate(bdb *bbolt.DB) error {
+	return bdb.Update(func(tx *bbolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists([]byte(BUCKETMETA))
+		if err != nil { // Error handling bucket creation
+			return err
+		}
+
+		// Files without a version are new and start at 0
+		version := 0
+		if raw := meta.Get([]byte(KEYSCHEMA)); raw != nil {
+			version, err = strconv.Atoi(string(raw))
+			if err != nil { // Error handling corrupt version
+				return err
+			}
+		}
+		if version > len(migrations) {
+			return errors.New("database schema version " + strconv.Itoa(version) + " is newer than this build supports")
+		}
+
+		for ; version < len(migrations); version++ {
+			if err := migrations[version](tx); err != nil { // Error handling migration, transaction is rolled back
+				return err
+			}
+		}
+		return meta.Put([]byte(KEYSCHEMA), []byte(strconv.Itoa(version)))
+	})
+}
+
+/*
+deadLetterKey returns the key of a dead letter, with an empty id it is the prefix shared by all of a webhook's dead letters
+*/
+func deadLetterKey(webhookID, id string) []byte {
+	return []byte(webhookID + "/" + id)
+}
+
+/*
+historyKey returns the key of a history entry, sorting the entries of a webhook by the time they were recorded
+*/
+func historyKey(entry HistoryEntry) []byte {
+	return []byte(fmt.Sprintf("%s/%020d/%s", entry.WebhookID, entry.Time.UnixNano(), entry.ID))
+}
+
+/*
+digestKey returns the key of a digest event, sorting the events of a webhook by the time they were recorded
+*/
+func digestKey(event DigestEvent) []byte {
+	return []byte(fmt.Sprintf("%s/%020d/%s", event.WebhookID, event.Time.UnixNano(), event.ID))
+}
+
+/*
+auditKey returns the key of an audit entry, sorting the log of a webhook by the time changes were made
+*/
+func auditKey(entry AuditEntry) []byte {
+	return []byte(fmt.Sprintf("%s/%020d/%s", entry.WebhookID, entry.Time.UnixNano(), entry.ID))
+}
+
+/*
+changeKey returns the key of a change, ids are positive so their big-endian bytes sort like the ids
+*/
+func changeKey(id int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
+
+/*
+changesPruned reads the highest id removed from the change log, 0 if nothing was
+*/
+func changesPruned(tx *bbolt.Tx) (int64, error) {
+	raw := tx.Bucket([]byte(BUCKETMETA)).Get([]byte(KEYPRUNED))
+	if raw == nil {
+		return 0, nil
+	}
+	return strconv.ParseInt(string(raw), 10, 64)
+}
+
+/*
+deletePrefix removes every key starting with prefix from a bucket
+*/
+func deletePrefix(b *bbolt.Bucket, prefix []byte) error {
+	// Collect keys first, deleting while iterating a cursor skips entries
+	var keys [][]byte
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, append([]byte(nil), k...))
+	}
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil { // Error handling write
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// tempFile returns the path of a bolt file in a new temporary directory and a func removing the directory
+func tempFile(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "covidcase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "webhooks.db"), func() { os.RemoveAll(dir) }
+}
+
+// schema returns the schema version recorded in the bolt file at path
+func schema(t *testing.T, path string) string {
+	t.Helper()
+	bdb, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bdb.Close()
+	var version string
+	bdb.View(func(tx *bbolt.Tx) error {
+		version = string(tx.Bucket([]byte(BUCKETMETA)).Get([]byte(KEYSCHEMA)))
+		return nil
+	})
+	return version
+}
+
+func TestBoltReopen(t *testing.T) {
+	path, remove := tempFile(t)
+	defer remove()
+
+	store, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	hook, err := store.Create(Webhook{URL: "http://example.com/hook", Field: "stringency", Country: "Norway", Trigger: "ON_CHANGE"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery, err := store.AddDeadLetter(Delivery{WebhookID: hook.ID, Payload: `{"country": "Norway"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddHistory(HistoryEntry{WebhookID: hook.ID, DeliveryID: delivery.ID, Success: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddDigestEvent(DigestEvent{ID: "event", WebhookID: hook.ID, Payload: "{}", Time: now}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.AddAuditEntry(AuditEntry{WebhookID: hook.ID, Action: "create", Time: now}); err != nil {
+		t.Fatal(err)
+	}
+	for id := int64(1); id <= 3; id++ {
+		if err := store.AddChange(Change{ID: id, Country: "Norway", Field: "stringency", Time: now.Add(time.Duration(id-3) * time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.PruneChanges(now); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything written has to be read back from the file
+	store, err = NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if got, err := store.Get(hook.ID); err != nil || got.URL != hook.URL || got.Country != "Norway" || !got.Created.Equal(hook.Created) {
+		t.Errorf("Get after reopening = %+v, %v, want %+v", got, err, hook)
+	}
+	if hooks, err := store.List(); err != nil || len(hooks) != 1 {
+		t.Errorf("List after reopening = %v, %v, want the webhook", hooks, err)
+	}
+	if got, err := store.GetDeadLetter(hook.ID, delivery.ID); err != nil || got.Payload != delivery.Payload {
+		t.Errorf("GetDeadLetter after reopening = %+v, %v, want %+v", got, err, delivery)
+	}
+	if entries, err := store.ListHistory(hook.ID); err != nil || len(entries) != 1 || entries[0].DeliveryID != delivery.ID {
+		t.Errorf("ListHistory after reopening = %v, %v, want the delivery", entries, err)
+	}
+	if events, err := store.ListDigestEvents(hook.ID); err != nil || len(events) != 1 || events[0].ID != "event" {
+		t.Errorf("ListDigestEvents after reopening = %v, %v, want the event", events, err)
+	}
+	if entries, err := store.ListAuditEntries(hook.ID); err != nil || len(entries) != 1 || entries[0].Action != "create" {
+		t.Errorf("ListAuditEntries after reopening = %v, %v, want the creation", entries, err)
+	}
+	if changes, err := store.ListChanges(0, 10); err != nil || len(changes) != 1 || changes[0].ID != 3 {
+		t.Errorf("ListChanges after reopening = %v, %v, want change 3 only", changes, err)
+	}
+	if pruned, err := store.ChangesPruned(); err != nil || pruned != 2 {
+		t.Errorf("ChangesPruned after reopening = %d, %v, want 2", pruned, err)
+	}
+}
+
+func TestBoltMigrate(t *testing.T) {
+	latest := strconv.Itoa(len(migrations))
+	for version := 0; version <= len(migrations); version++ {
+		path, remove := tempFile(t)
+		defer remove()
+
+		// Write a file the way a build of this schema version left it
+		bdb, err := bbolt.Open(path, 0600, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = bdb.Update(func(tx *bbolt.Tx) error {
+			meta, err := tx.CreateBucket([]byte(BUCKETMETA))
+			if err != nil {
+				return err
+			}
+			for _, m := range migrations[:version] {
+				if err := m(tx); err != nil {
+					return err
+				}
+			}
+			if version == 0 {
+				return nil // Files without a version
+			}
+			if err := tx.Bucket([]byte(BUCKETWEBHOOKS)).Put([]byte("old"), []byte(`{"id": "old", "url": "http://example.com/hook"}`)); err != nil {
+				return err
+			}
+			return meta.Put([]byte(KEYSCHEMA), []byte(strconv.Itoa(version)))
+		})
+		bdb.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		store, err := NewBoltStore(path)
+		if err != nil {
+			t.Errorf("schema %d: NewBoltStore = %v", version, err)
+			continue
+		}
+		// Every bucket of the latest schema has to be usable
+		if version > 0 {
+			if hook, err := store.Get("old"); err != nil || hook.URL != "http://example.com/hook" {
+				t.Errorf("schema %d: webhook from before the migration = %+v, %v", version, hook, err)
+			}
+		}
+		if _, err := store.AddDeadLetter(Delivery{WebhookID: "old"}); err != nil {
+			t.Errorf("schema %d: AddDeadLetter = %v", version, err)
+		}
+		if err := store.AddHistory(HistoryEntry{WebhookID: "old"}); err != nil {
+			t.Errorf("schema %d: AddHistory = %v", version, err)
+		}
+		if err := store.AddDigestEvent(DigestEvent{ID: "event", WebhookID: "old"}); err != nil {
+			t.Errorf("schema %d: AddDigestEvent = %v", version, err)
+		}
+		if _, _, err := store.ClaimIdempotencyKey(IdempotencyKey{Key: "key", Expires: time.Now().Add(time.Hour)}, time.Now()); err != nil {
+			t.Errorf("schema %d: ClaimIdempotencyKey = %v", version, err)
+		}
+		if _, err := store.AddAuditEntry(AuditEntry{WebhookID: "old"}); err != nil {
+			t.Errorf("schema %d: AddAuditEntry = %v", version, err)
+		}
+		if err := store.AddChange(Change{ID: 1}); err != nil {
+			t.Errorf("schema %d: AddChange = %v", version, err)
+		}
+		store.Close()
+		if got := schema(t, path); got != latest {
+			t.Errorf("schema %d: migrated to version %s, want %s", version, got, latest)
+		}
+	}
+}
+
+func TestBoltSchemaRefused(t *testing.T) {
+	tests := []struct {
+		version string
+		err     string
+	}{
+		{strconv.Itoa(len(migrations) + 1), "is newer than this build supports"},
+		{"seven", "invalid syntax"},
+	}
+	for _, test := range tests {
+		path, remove := tempFile(t)
+		defer remove()
+		bdb, err := bbolt.Open(path, 0600, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = bdb.Update(func(tx *bbolt.Tx) error {
+			meta, err := tx.CreateBucket([]byte(BUCKETMETA))
+			if err != nil {
+				return err
+			}
+			return meta.Put([]byte(KEYSCHEMA), []byte(test.version))
+		})
+		bdb.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if store, err := NewBoltStore(path); err == nil || !strings.Contains(err.Error(), test.err) {
+			if err == nil {
+				store.Close()
+			}
+			t.Errorf("schema %s: NewBoltStore = %v, want error containing %q", test.version, err, test.err)
+		}
+		// The file is left as it was, and unlocked
+		if got := schema(t, path); got != test.version {
+			t.Errorf("schema %s: changed to %s", test.version, got)
+		}
+	}
+}
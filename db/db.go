@@ -0,0 +1,387 @@
+package db
+
+/*
+Storage of webhook registrations, their failed deliveries and delivery history, independent of the backend holding them
+*/
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"time"
+)
+
+const IDLEN = 10 // Number of random bytes in a generated id (hex encoded to twice the length)
+
+// ErrNotFound is returned when a requested webhook or delivery does not exist in the store
+var ErrNotFound = errors.New("not found")
+
+// Webhook struct for a stored webhook registration
+type Webhook struct {
+	ID          string      `json:"id" firestore:"id"`
+	URL         string      `json:"url" firestore:"url"`
+	Channel     string      `json:"channel,omitempty" firestore:"channel"`           // "http", "email", "slack" or "teams"
+	To          []string    `json:"to,omitempty" firestore:"to"`                     // Only for email, recipient addresses
+	Subject     string      `json:"subject,omitempty" firestore:"subject"`           // Only for email, optional subject line
+	Template    string      `json:"template,omitempty" firestore:"template"`         // Payload template replacing the default JSON
+	ContentType string      `json:"content_type,omitempty" firestore:"content_type"` // Content type of the rendered template
+	Timeout     float64     `json:"timeout" firestore:"timeout"`
+	Field       string      `json:"field" firestore:"field"`
+	Country     string      `json:"country" firestore:"country"`                 // A single country, or "*" for all
+	Countries   []string    `json:"countries,omitempty" firestore:"countries"`   // Instead of country, a list of countries
+	Continent   string      `json:"continent,omitempty" firestore:"continent"`   // Instead of country, every country on it
+	Mode        string      `json:"mode,omitempty" firestore:"mode"`             // "single", "batch" or "digest" notifications
+	Window      string      `json:"window,omitempty" firestore:"window"`         // Only for digests, "hourly", "daily" or "weekly"
+	SkipEmpty   bool        `json:"skip_empty,omitempty" firestore:"skip_empty"` // Only for digests, send nothing for quiet windows
+	Trigger     string      `json:"trigger" firestore:"trigger"`
+	Threshold   *float64    `json:"threshold,omitempty" firestore:"threshold"` // Only for ABOVE, BELOW and CROSSES
+	Condition   string      `json:"condition,omitempty" firestore:"condition"` // Only for CONDITION
+	Paused      bool        `json:"paused" firestore:"paused"`                 // Registration is kept but not evaluated
+	Health      *Health     `json:"health,omitempty" firestore:"health"`       // Outcome of deliveries so far, nil before the first
+	Suspended   *Suspension `json:"suspended,omitempty" firestore:"suspended"` // Set when stopped for failing, until reactivated
+	Created     time.Time   `json:"created" firestore:"created"`
+
+	// Secrets signing the notifications, the previous one keeps signing until it expires after a rotation
+	Secret                string     `json:"secret,omitempty" firestore:"secret"`
+	PreviousSecret        string     `json:"previous_secret,omitempty" firestore:"previous_secret"`
+	PreviousSecretExpires *time.Time `json:"previous_secret_expires,omitempty" firestore:"previous_secret_expires"`
+}
+
+// IdempotencyKey struct for a registration request that clients may retry under the same key
+type IdempotencyKey struct {
+	Key       string    `json:"key" firestore:"key"`               // Scoped to the client that sent it
+	Hash      string    `json:"hash" firestore:"hash"`             // Fingerprint of the request the key was first used for
+	WebhookID string    `json:"webhook_id" firestore:"webhook_id"` // Registration created, empty while in progress
+	Created   time.Time `json:"created" firestore:"created"`
+	Expires   time.Time `json:"expires" firestore:"expires"`
+}
+
+// same reports whether two keys are the same claim, so one request cannot replace or remove the claim of another
+func (k IdempotencyKey) same(other IdempotencyKey) bool {
+	return k.Key == other.Key && k.Hash == other.Hash && k.WebhookID == other.WebhookID && k.Created.Equal(other.Created)
+}
+
+// Health struct for how deliveries to a webhook have been going
+type Health struct {
+	Score               float64    `json:"score" firestore:"score"` // Weighted share of recent deliveries that succeeded
+	Deliveries          int        `json:"deliveries" firestore:"deliveries"`
+	Failures            int        `json:"failures" firestore:"failures"` // Deliveries that ran out of attempts
+	ConsecutiveFailures int        `json:"consecutive_failures" firestore:"consecutive_failures"`
+	LastSuccess         *time.Time `json:"last_success,omitempty" firestore:"last_success"`
+	LastFailure         *time.Time `json:"last_failure,omitempty" firestore:"last_failure"`
+}
+
+// Suspension struct for why a webhook was stopped automatically
+type Suspension struct {
+	Reason string    `json:"reason" firestore:"reason"`
+	Time   time.Time `json:"time" firestore:"time"`
+}
+
+// Attempt struct for the outcome of one try at delivering a notification
+type Attempt struct {
+	Number     int       `json:"attempt" firestore:"attempt"`
+	Time       time.Time `json:"time" firestore:"time"`
+	StatusCode int       `json:"status_code" firestore:"status_code"` // 0 if no response was received
+	Latency    float64   `json:"latency_ms" firestore:"latency_ms"`
+	Error      string    `json:"error,omitempty" firestore:"error"`
+}
+
+// Delivery struct for a notification payload and every attempt made to deliver it
+type Delivery struct {
+	ID        string    `json:"id" firestore:"id"`
+	WebhookID string    `json:"webhook_id" firestore:"webhook_id"`
+	Payload   string    `json:"payload" firestore:"payload"`
+	Attempts  []Attempt `json:"attempts" firestore:"attempts"`
+	Created   time.Time `json:"created" firestore:"created"`
+}
+
+// HistoryEntry struct for one recorded delivery attempt in the history of a webhook
+type HistoryEntry struct {
+	Attempt
+	ID         string `json:"id" firestore:"id"`
+	WebhookID  string `json:"webhook_id" firestore:"webhook_id"`
+	DeliveryID string `json:"delivery_id" firestore:"delivery_id"`
+	Payload    string `json:"payload" firestore:"payload"`
+	Success    bool   `json:"success" firestore:"success"`
+}
+
+// DigestEvent struct for a notification held back until the digest of its webhook is sent
+type DigestEvent struct {
+	ID        string    `json:"id" firestore:"id"`
+	WebhookID string    `json:"webhook_id" firestore:"webhook_id"`
+	Payload   string    `json:"payload" firestore:"payload"` // JSON encoded notification
+	Time      time.Time `json:"time" firestore:"time"`
+}
+
+// Change struct for a change in the value of a field for a country, as logged in the change feed
+type Change struct {
+	ID       int64     `json:"id" firestore:"id"` // Increases with every change, gaps are left where ids go unused
+	Country  string    `json:"country" firestore:"country"`
+	Field    string    `json:"field" firestore:"field"`
+	Previous float64   `json:"previous" firestore:"previous"`
+	Value    float64   `json:"value" firestore:"value"`
+	Time     time.Time `json:"time" firestore:"time"` // When the new value was observed
+}
+
+// AuditEntry struct for one change made to a webhook through the API, entries are never changed or removed
+type AuditEntry struct {
+	ID        string        `json:"id" firestore:"id"`
+	WebhookID string        `json:"webhook_id" firestore:"webhook_id"`
+	Action    string        `json:"action" firestore:"action"`                   // What was done, e.g. "create", "update" or "delete"
+	Actor     string        `json:"actor" firestore:"actor"`                     // API key fingerprint or client address making the change
+	RequestID string        `json:"request_id,omitempty" firestore:"request_id"` // Id the request was logged under
+	Changes   []FieldChange `json:"changes" firestore:"changes"`
+	Time      time.Time     `json:"time" firestore:"time"`
+}
+
+// FieldChange struct for the value of one webhook setting before and after a change, nil where it was unset
+type FieldChange struct {
+	Field  string      `json:"field" firestore:"field"`
+	Before interface{} `json:"before" firestore:"before"`
+	After  interface{} `json:"after" firestore:"after"`
+}
+
+/*
+Store is implemented by every backend, holding registrations, their dead letters, their delivery history,
+the events waiting for their next digest, the idempotency keys registrations were made with, the audit log
+and the log of changes to the values webhooks watch
+*/
+type Store interface {
+	WebhookStore
+	DeadLetterStore
+	HistoryStore
+	DigestStore
+	IdempotencyStore
+	AuditStore
+	ChangeStore
+}
+
+/*
+WebhookStore is implemented by every backend able to persist webhook registrations
+*/
+type WebhookStore interface {
+	// Create stores a new webhook and returns it with its generated id and creation time
+	Create(hook Webhook) (Webhook, error)
+	// Get returns the webhook with the given id or ErrNotFound
+	Get(id string) (Webhook, error)
+	// Update replaces the stored webhook with the same id or returns ErrNotFound
+	Update(hook Webhook) error
+	// Modify applies fn to the stored webhook with the given id and stores the result in one transaction,
+	// so changes stored in the meantime are not lost, and returns it. It returns ErrNotFound if there is no such
+	// webhook, or the error of fn without storing anything. fn may run more than once and must replace rather
+	// than change the values pointer fields point to
+	Modify(id string, fn func(hook *Webhook) error) (Webhook, error)
+	// List returns all webhooks ordered by creation time
+	List() ([]Webhook, error)
+	// Delete removes the webhook with the given id, along with its dead letters, history and digest events,
+	// or returns ErrNotFound. Its audit log is kept
+	Delete(id string) error
+	// Count returns the number of registered webhooks
+	Count() (int, error)
+	// Close releases any resources held by the store
+	Close() error
+}
+
+/*
+DeadLetterStore is implemented by every backend able to keep deliveries that ran out of attempts
+*/
+type DeadLetterStore interface {
+	// AddDeadLetter stores a failed delivery, generating an id and creation time if it has none
+	AddDeadLetter(delivery Delivery) (Delivery, error)
+	// GetDeadLetter returns one failed delivery of a webhook or ErrNotFound
+	GetDeadLetter(webhookID, id string) (Delivery, error)
+	// ListDeadLetters returns the failed deliveries of a webhook ordered by creation time
+	ListDeadLetters(webhookID string) ([]Delivery, error)
+	// DeleteDeadLetter removes one failed delivery of a webhook or returns ErrNotFound
+	DeleteDeadLetter(webhookID, id string) error
+}
+
+/*
+HistoryStore is implemented by every backend able to keep a bounded history of delivery attempts
+*/
+type HistoryStore interface {
+	// AddHistory records a delivery attempt, generating an id if it has none
+	AddHistory(entry HistoryEntry) error
+	// ListHistory returns the recorded attempts of a webhook, newest first
+	ListHistory(webhookID string) ([]HistoryEntry, error)
+	// PruneHistory removes attempts recorded before the given time and all but the newest keep attempts of each webhook,
+	// a zero time or keep of 0 disables that limit
+	PruneHistory(before time.Time, keep int) error
+}
+
+/*
+DigestStore is implemented by every backend able to hold events back for periodic digests
+*/
+type DigestStore interface {
+	// AddDigestEvent stores an event for the next digest of its webhook, generating an id if it has none
+	AddDigestEvent(event DigestEvent) error
+	// ListDigestEvents returns the events waiting for the digest of a webhook, oldest first
+	ListDigestEvents(webhookID string) ([]DigestEvent, error)
+	// DeleteDigestEvents removes the events of a webhook recorded before the given time
+	DeleteDigestEvents(webhookID string, before time.Time) error
+}
+
+/*
+IdempotencyStore is implemented by every backend able to remember the idempotency keys of requests
+*/
+type IdempotencyStore interface {
+	// ClaimIdempotencyKey stores key unless an unexpired key by the same name exists at the given time,
+	// reporting whether it was stored and returning the existing key if it was not
+	ClaimIdempotencyKey(key IdempotencyKey, now time.Time) (IdempotencyKey, bool, error)
+	// SwapIdempotencyKey replaces old with key if the stored key by that name is still old, e.g. to record the
+	// webhook its request created or to take over a request that never finished, reporting whether it did
+	SwapIdempotencyKey(old, key IdempotencyKey) (bool, error)
+	// DeleteIdempotencyKey removes key so it can be used again, unless it was replaced in the meantime.
+	// Removing an unknown key is not an error
+	DeleteIdempotencyKey(key IdempotencyKey) error
+	// PruneIdempotencyKeys removes keys that expired before the given time
+	PruneIdempotencyKeys(before time.Time) error
+}
+
+/*
+AuditStore is implemented by every backend able to keep an append-only log of changes to webhooks
+*/
+type AuditStore interface {
+	// AddAuditEntry appends an entry to the log of its webhook, generating an id and time if it has none
+	AddAuditEntry(entry AuditEntry) (AuditEntry, error)
+	// ListAuditEntries returns the log of a webhook oldest first, it outlives the webhook itself
+	ListAuditEntries(webhookID string) ([]AuditEntry, error)
+}
+
+/*
+ChangeStore is implemented by every backend able to keep a log of changes, ordered by id, for a limited time
+*/
+type ChangeStore interface {
+	// AddChange appends a change to the log, its id has to be higher than that of any change before it
+	AddChange(change Change) error
+	// ListChanges returns up to limit changes with an id above since, lowest id first
+	ListChanges(since int64, limit int) ([]Change, error)
+	// PruneChanges removes changes observed before the given time, remembering the highest id removed
+	PruneChanges(before time.Time) error
+	// ChangesPruned returns the highest id removed from the log so far, 0 if nothing was
+	ChangesPruned() (int64, error)
+}
+
+/*
+NewID returns a random hex encoded id for a new webhook, delivery or history entry
+*/
+func NewID() (string, error) {
+	b := make([]byte, IDLEN)
+	if _, err := rand.Read(b); err != nil { // Error handling random source
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+/*
+prepareDeadLetter fills in the id and creation time of a delivery about to be stored, keeping existing ones
+*/
+func prepareDeadLetter(delivery Delivery) (Delivery, error) {
+	if delivery.ID == "" {
+		id, err := NewID()
+		if err != nil { // Error handling id generation
+			return delivery, err
+		}
+		delivery.ID = id
+	}
+	if delivery.Created.IsZero() {
+		delivery.Created = time.Now().UTC()
+	}
+	return delivery, nil
+}
+
+/*
+sortDeliveries orders deliveries by creation time, ties broken by id for a stable listing
+*/
+func sortDeliveries(deliveries []Delivery) {
+	sort.Slice(deliveries, func(i, j int) bool {
+		if deliveries[i].Created.Equal(deliveries[j].Created) {
+			return deliveries[i].ID < deliveries[j].ID
+		}
+		return deliveries[i].Created.Before(deliveries[j].Created)
+	})
+}
+
+/*
+sortHistory orders history entries newest first, ties broken by id for a stable listing
+*/
+func sortHistory(entries []HistoryEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Time.Equal(entries[j].Time) {
+			return entries[i].ID > entries[j].ID
+		}
+		return entries[i].Time.After(entries[j].Time)
+	})
+}
+
+/*
+prepareDigestEvent fills in the id of an event about to be stored, keeping an existing one
+*/
+func prepareDigestEvent(event DigestEvent) (DigestEvent, error) {
+	if event.ID == "" {
+		id, err := NewID()
+		if err != nil { // Error handling id generation
+			return event, err
+		}
+		event.ID = id
+	}
+	return event, nil
+}
+
+/*
+sortDigestEvents orders digest events oldest first, ties broken by id for a stable listing
+*/
+func sortDigestEvents(events []DigestEvent) {
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Time.Equal(events[j].Time) {
+			return events[i].ID < events[j].ID
+		}
+		return events[i].Time.Before(events[j].Time)
+	})
+}
+
+/*
+prepareAuditEntry fills in the id and time of an audit entry about to be stored, keeping existing ones
+*/
+func prepareAuditEntry(entry AuditEntry) (AuditEntry, error) {
+	if entry.ID == "" {
+		id, err := NewID()
+		if err != nil { // Error handling id generation
+			return entry, err
+		}
+		entry.ID = id
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	return entry, nil
+}
+
+/*
+sortAuditEntries orders audit entries oldest first, ties broken by id for a stable listing
+*/
+func sortAuditEntries(entries []AuditEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Time.Equal(entries[j].Time) {
+			return entries[i].ID < entries[j].ID
+		}
+		return entries[i].Time.Before(entries[j].Time)
+	})
+}
+
+/*
+pruneHistory returns the entries of one webhook, newest first, split into those to keep and those to remove
+*/
+func pruneHistory(entries []HistoryEntry, before time.Time, keep int) ([]HistoryEntry, []HistoryEntry) {
+	sortHistory(entries)
+	var kept, removed []HistoryEntry
+	for _, entry := range entries {
+		if entry.Time.Before(before) || (keep > 0 && len(kept) >= keep) {
+			removed = append(removed, entry)
+		} else {
+			kept = append(kept, entry)
+		}
+	}
+	return kept, removed
+}
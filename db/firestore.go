@@ -1 +1,655 @@
 package db
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+const COLLECTION = "webhooks"         // Firestore collection holding webhook registrations
+const DEADLETTERCOLLECTION = "failed" // Subcollection of a webhook document holding its dead letters
+const HISTORYCOLLECTION = "history"   // Subcollection of a webhook document holding its delivery attempts
+const DIGESTCOLLECTION = "digests"    // Subcollection of a webhook document holding events waiting for a digest
+const KEYCOLLECTION = "idempotency"   // Firestore collection holding idempotency keys of registration requests
+const AUDITCOLLECTION = "audit"       // Subcollection of a webhook document holding its audit log
+const CHANGECOLLECTION = "changes"    // Firestore collection holding the change log
+const METACOLLECTION = "meta"         // Firestore collection holding bookkeeping such as the pruned change ids
+
+// FirestoreStore struct for keeping webhooks in a Google Cloud Firestore collection
+type FirestoreStore struct {
+	ctx    context.Context
+	client *firestore.Client
+}
+
+/*
+NewFirestoreStore returns a store connected to the Firestore database of projectID
+* Optional path to a service account credentials file, application default credentials are used otherwise
+*/
+func NewFirestoreStore(projectID, credentials string) (*FirestoreStore, error) {
+	var opts []option.ClientOption
+	ctx := context.Background()
+
+	if credentials != "" {
+		opts = append(opts, option.WithCredentialsFile(credentials))
+	}
+	client, err := firestore.NewClient(ctx, projectID, opts...)
+	if err != nil { // Error handling client setup
+		return nil, err
+	}
+	return &FirestoreStore{ctx: ctx, client: client}, nil
+}
+
+/*
+Create stores a new webhook document with a generated id
+*/
+func (s *FirestoreStore) Create(hook Webhook) (Webhook, error) {
+	id, err := NewID()
+	if err != nil { // Error handling id generation
+		return Webhook{}, err
+	}
+	hook.ID = id
+	hook.Created = time.Now().UTC()
+
+	// Create fails if a document with the same id already exists
+	_, err = s.client.Collection(COLLECTION).Doc(id).Create(s.ctx, hook)
+	if err != nil { // Error handling write
+		return Webhook{}, err
+	}
+	return hook, nil
+}
+
+/*
+Get returns the webhook document with the given id
+*/
+func (s *FirestoreStore) Get(id string) (Webhook, error) {
+	var hook Webhook
+
+	snap, err := s.client.Collection(COLLECTION).Doc(id).Get(s.ctx)
+	if status.Code(err) == codes.NotFound {
+		return hook, ErrNotFound
+	}
+	if err != nil { // Error handling read
+		return hook, err
+	}
+	err = snap.DataTo(&hook)
+	return hook, err
+}
+
+/*
+Update replaces the webhook document with the same id
+*/
+func (s *FirestoreStore) Update(hook Webhook) error {
+	ref := s.client.Collection(COLLECTION).Doc(hook.ID)
+	// Set alone would create missing documents, the transaction makes sure it exists first
+	err := s.client.RunTransaction(s.ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		if _, err := tx.Get(ref); err != nil { // Error handling read, including NotFound
+			return err
+		}
+		return tx.Set(ref, hook)
+	})
+	if status.Code(err) == codes.NotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+/*
+Modify applies fn to the webhook document with the given id and stores the result in one transaction,
+which Firestore retries from a fresh read if the document changed in the meantime
+*/
+func (s *FirestoreStore) Modify(id string, fn func(hook *Webhook) error) (Webhook, error) {
+	var hook Webhook
+
+	ref := s.client.Collection(COLLECTION).Doc(id)
+	err := s.client.RunTransaction(s.ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snap, err := tx.Get(ref)
+		if err != nil { // Error handling read, including NotFound
+			return err
+		}
+		// Start over on every attempt
+		hook = Webhook{}
+		if err := snap.DataTo(&hook); err != nil { // Error handling decoding
+			return err
+		}
+		if err := fn(&hook); err != nil {
+			return err
+		}
+		hook.ID = id // The id is not fn's to change
+		return tx.Set(ref, hook)
+	})
+	if status.Code(err) == codes.NotFound {
+		return Webhook{}, ErrNotFound
+	}
+	if err != nil {
+		return Webhook{}, err
+	}
+	return hook, nil
+}
+
+/*
+List returns all webhook documents ordered by creation time
+*/
+func (s *FirestoreStore) List() ([]Webhook, error) {
+	var hooks []Webhook
+
+	iter := s.client.Collection(COLLECTION).OrderBy("created", firestore.Asc).Documents(s.ctx)
+	defer iter.Stop()
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil { // Error handling read
+			return nil, err
+		}
+		var hook Webhook
+		if err := snap.DataTo(&hook); err != nil { // Error handling decoding
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+/*
+Delete removes the webhook document with the given id along with its dead letters, history and digest events.
+The audit log subcollection is left in place, so the log can still be read after the webhook is gone.
+*/
+func (s *FirestoreStore) Delete(id string) error {
+	// Deleting with an Exists precondition reports missing documents as NotFound
+	_, err := s.client.Collection(COLLECTION).Doc(id).Delete(s.ctx, firestore.Exists)
+	if status.Code(err) == codes.NotFound {
+		return ErrNotFound
+	}
+	if err != nil { // Error handling write
+		return err
+	}
+
+	// Subcollections outlive their parent document, remove them explicitly
+	if err := s.deleteCollection(s.deadLetters(id)); err != nil {
+		return err
+	}
+	if err := s.deleteCollection(s.history(id)); err != nil {
+		return err
+	}
+	return s.deleteCollection(s.digests(id))
+}
+
+/*
+Count returns the number of webhook documents
+*/
+func (s *FirestoreStore) Count() (int, error) {
+	refs, err := s.client.Collection(COLLECTION).DocumentRefs(s.ctx).GetAll()
+	if err != nil { // Error handling read
+		return 0, err
+	}
+	return len(refs), nil
+}
+
+/*
+AddDeadLetter stores a failed delivery in the dead letter subcollection of its webhook
+*/
+func (s *FirestoreStore) AddDeadLetter(delivery Delivery) (Delivery, error) {
+	delivery, err := prepareDeadLetter(delivery)
+	if err != nil { // Error handling id generation
+		return delivery, err
+	}
+	_, err = s.deadLetters(delivery.WebhookID).Doc(delivery.ID).Set(s.ctx, delivery)
+	return delivery, err
+}
+
+/*
+GetDeadLetter returns one failed delivery of a webhook
+*/
+func (s *FirestoreStore) GetDeadLetter(webhookID, id string) (Delivery, error) {
+	var delivery Delivery
+
+	snap, err := s.deadLetters(webhookID).Doc(id).Get(s.ctx)
+	if status.Code(err) == codes.NotFound {
+		return delivery, ErrNotFound
+	}
+	if err != nil { // Error handling read
+		return delivery, err
+	}
+	err = snap.DataTo(&delivery)
+	return delivery, err
+}
+
+/*
+ListDeadLetters returns the failed deliveries of a webhook ordered by creation time
+*/
+func (s *FirestoreStore) ListDeadLetters(webhookID string) ([]Delivery, error) {
+	var deliveries []Delivery
+
+	iter := s.deadLetters(webhookID).OrderBy("created", firestore.Asc).Documents(s.ctx)
+	defer iter.Stop()
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil { // Error handling read
+			return nil, err
+		}
+		var delivery Delivery
+		if err := snap.DataTo(&delivery); err != nil { // Error handling decoding
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+/*
+DeleteDeadLetter removes one failed delivery of a webhook
+*/
+func (s *FirestoreStore) DeleteDeadLetter(webhookID, id string) error {
+	_, err := s.deadLetters(webhookID).Doc(id).Delete(s.ctx, firestore.Exists)
+	if status.Code(err) == codes.NotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+/*
+AddHistory records a delivery attempt in the history subcollection of its webhook
+*/
+func (s *FirestoreStore) AddHistory(entry HistoryEntry) error {
+	if entry.ID == "" {
+		id, err := NewID()
+		if err != nil { // Error handling id generation
+			return err
+		}
+		entry.ID = id
+	}
+	_, err := s.history(entry.WebhookID).Doc(entry.ID).Set(s.ctx, entry)
+	return err
+}
+
+/*
+ListHistory returns the recorded attempts of a webhook, newest first
+*/
+func (s *FirestoreStore) ListHistory(webhookID string) ([]HistoryEntry, error) {
+	var entries []HistoryEntry
+
+	snaps, err := s.history(webhookID).Documents(s.ctx).GetAll()
+	if err != nil { // Error handling read
+		return nil, err
+	}
+	for _, snap := range snaps {
+		var entry HistoryEntry
+		if err := snap.DataTo(&entry); err != nil { // Error handling decoding
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	sortHistory(entries)
+	return entries, nil
+}
+
+/*
+PruneHistory removes attempts that are too old or beyond the newest keep of each webhook
+*/
+func (s *FirestoreStore) PruneHistory(before time.Time, keep int) error {
+	refs, err := s.client.Collection(COLLECTION).DocumentRefs(s.ctx).GetAll()
+	if err != nil { // Error handling read
+		return err
+	}
+	for _, ref := range refs {
+		entries, err := s.ListHistory(ref.ID)
+		if err != nil { // Error handling read
+			return err
+		}
+		_, removed := pruneHistory(entries, before, keep)
+		for _, entry := range removed {
+			if _, err := s.history(ref.ID).Doc(entry.ID).Delete(s.ctx); err != nil { // Error handling write
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+AddDigestEvent stores an event in the digest subcollection of its webhook
+*/
+func (s *FirestoreStore) AddDigestEvent(event DigestEvent) error {
+	event, err := prepareDigestEvent(event)
+	if err != nil { // Error handling id generation
+		return err
+	}
+	_, err = s.digests(event.WebhookID).Doc(event.ID).Set(s.ctx, event)
+	return err
+}
+
+/*
+ListDigestEvents returns the events waiting for the digest of a webhook, oldest first
+*/
+func (s *FirestoreStore) ListDigestEvents(webhookID string) ([]DigestEvent, error) {
+	var events []DigestEvent
+
+	snaps, err := s.digests(webhookID).Documents(s.ctx).GetAll()
+	if err != nil { // Error handling read
+		return nil, err
+	}
+	for _, snap := range snaps {
+		var event DigestEvent
+		if err := snap.DataTo(&event); err != nil { // Error handling decoding
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	sortDigestEvents(events)
+	return events, nil
+}
+
+/*
+DeleteDigestEvents removes the events of a webhook recorded before the given time
+*/
+func (s *FirestoreStore) DeleteDigestEvents(webhookID string, before time.Time) error {
+	refs, err := s.digests(webhookID).Where("time", "<", before).Documents(s.ctx).GetAll()
+	if err != nil { // Error handling read
+		return err
+	}
+	for _, snap := range refs {
+		if _, err := snap.Ref.Delete(s.ctx); err != nil { // Error handling write
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ClaimIdempotencyKey stores key unless an unexpired key by the same name exists, in one transaction
+*/
+func (s *FirestoreStore) ClaimIdempotencyKey(key IdempotencyKey, now time.Time) (IdempotencyKey, bool, error) {
+	existing := key
+	claimed := false
+
+	ref := s.key(key.Key)
+	err := s.client.RunTransaction(s.ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		existing, claimed = key, false // The transaction may run more than once
+		snap, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound { // Error handling read
+			return err
+		}
+		if err == nil {
+			if err := snap.DataTo(&existing); err != nil { // Error handling decoding
+				return err
+			}
+			if existing.Expires.After(now) {
+				return nil
+			}
+		}
+		existing, claimed = key, true
+		return tx.Set(ref, key)
+	})
+	return existing, claimed, err
+}
+
+/*
+SwapIdempotencyKey replaces old with key if the stored key is still old, in one transaction
+*/
+func (s *FirestoreStore) SwapIdempotencyKey(old, key IdempotencyKey) (bool, error) {
+	swapped := false
+	ref := s.key(old.Key)
+	err := s.client.RunTransaction(s.ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		swapped = false // The transaction may run more than once
+		if same, err := s.storedKey(tx, ref, old); err != nil || !same {
+			return err
+		}
+		swapped = true
+		return tx.Set(ref, key)
+	})
+	return swapped, err
+}
+
+/*
+DeleteIdempotencyKey removes key so it can be used again unless it was replaced, in one transaction
+*/
+func (s *FirestoreStore) DeleteIdempotencyKey(key IdempotencyKey) error {
+	ref := s.key(key.Key)
+	return s.client.RunTransaction(s.ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		if same, err := s.storedKey(tx, ref, key); err != nil || !same {
+			return err
+		}
+		return tx.Delete(ref)
+	})
+}
+
+/*
+PruneIdempotencyKeys removes keys that expired before the given time
+*/
+func (s *FirestoreStore) PruneIdempotencyKeys(before time.Time) error {
+	snaps, err := s.client.Collection(KEYCOLLECTION).Where("expires", "<", before).Documents(s.ctx).GetAll()
+	if err != nil { // Error handling read
+		return err
+	}
+	for _, snap := range snaps {
+		if _, err := snap.Ref.Delete(s.ctx); err != nil { // Error handling write
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+AddAuditEntry appends an entry to the audit log subcollection of its webhook
+*/
+func (s *FirestoreStore) AddAuditEntry(entry AuditEntry) (AuditEntry, error) {
+	entry, err := prepareAuditEntry(entry)
+	if err != nil { // Error handling id generation
+		return entry, err
+	}
+	// Create rather than Set, entries are never overwritten
+	_, err = s.audit(entry.WebhookID).Doc(entry.ID).Create(s.ctx, entry)
+	return entry, err
+}
+
+/*
+ListAuditEntries returns the audit log of a webhook, oldest first
+*/
+func (s *FirestoreStore) ListAuditEntries(webhookID string) ([]AuditEntry, error) {
+	var entries []AuditEntry
+
+	snaps, err := s.audit(webhookID).Documents(s.ctx).GetAll()
+	if err != nil { // Error handling read
+		return nil, err
+	}
+	for _, snap := range snaps {
+		var entry AuditEntry
+		if err := snap.DataTo(&entry); err != nil { // Error handling decoding
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	sortAuditEntries(entries)
+	return entries, nil
+}
+
+/*
+AddChange appends a change to the change log, named by its zero-padded id
+*/
+func (s *FirestoreStore) AddChange(change Change) error {
+	_, err := s.client.Collection(CHANGECOLLECTION).Doc(fmt.Sprintf("%020d", change.ID)).Create(s.ctx, change)
+	return err
+}
+
+/*
+ListChanges returns up to limit changes with an id above since, lowest id first
+*/
+func (s *FirestoreStore) ListChanges(since int64, limit int) ([]Change, error) {
+	var changes []Change
+
+	snaps, err := s.client.Collection(CHANGECOLLECTION).Where("id", ">", since).OrderBy("id", firestore.Asc).
+		Limit(limit).Documents(s.ctx).GetAll()
+	if err != nil { // Error handling read
+		return nil, err
+	}
+	for _, snap := range snaps {
+		var change Change
+		if err := snap.DataTo(&change); err != nil { // Error handling decoding
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+/*
+PruneChanges removes changes observed before the given time, recording the highest id removed in the meta collection
+*/
+func (s *FirestoreStore) PruneChanges(before time.Time) error {
+	snaps, err := s.client.Collection(CHANGECOLLECTION).Where("time", "<", before).Documents(s.ctx).GetAll()
+	if err != nil { // Error handling read
+		return err
+	}
+	if len(snaps) == 0 {
+		return nil
+	}
+	var highest int64
+	for _, snap := range snaps {
+		var change Change
+		if err := snap.DataTo(&change); err != nil { // Error handling decoding
+			return err
+		}
+		if change.ID > highest {
+			highest = change.ID
+		}
+	}
+
+	// Record the ids as removed before removing them, so a cursor never outlives its changes unnoticed
+	ref := s.client.Collection(METACOLLECTION).Doc(CHANGECOLLECTION)
+	err = s.client.RunTransaction(s.ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		pruned, err := readPruned(tx.Get(ref))
+		if err != nil {
+			return err
+		}
+		if highest <= pruned {
+			return nil
+		}
+		return tx.Set(ref, map[string]interface{}{"pruned": highest})
+	})
+	if err != nil { // Error handling write
+		return err
+	}
+	for _, snap := range snaps {
+		if _, err := snap.Ref.Delete(s.ctx); err != nil { // Error handling write
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ChangesPruned returns the highest id removed from the change log so far
+*/
+func (s *FirestoreStore) ChangesPruned() (int64, error) {
+	return readPruned(s.client.Collection(METACOLLECTION).Doc(CHANGECOLLECTION).Get(s.ctx))
+}
+
+/*
+Close closes the connection to Firestore
+*/
+func (s *FirestoreStore) Close() error {
+	return s.client.Close()
+}
+
+/*
+deadLetters returns the dead letter subcollection of a webhook document
+*/
+func (s *FirestoreStore) deadLetters(webhookID string) *firestore.CollectionRef {
+	return s.client.Collection(COLLECTION).Doc(webhookID).Collection(DEADLETTERCOLLECTION)
+}
+
+/*
+history returns the delivery history subcollection of a webhook document
+*/
+func (s *FirestoreStore) history(webhookID string) *firestore.CollectionRef {
+	return s.client.Collection(COLLECTION).Doc(webhookID).Collection(HISTORYCOLLECTION)
+}
+
+/*
+digests returns the digest event subcollection of a webhook document
+*/
+func (s *FirestoreStore) digests(webhookID string) *firestore.CollectionRef {
+	return s.client.Collection(COLLECTION).Doc(webhookID).Collection(DIGESTCOLLECTION)
+}
+
+/*
+audit returns the audit log subcollection of a webhook document
+*/
+func (s *FirestoreStore) audit(webhookID string) *firestore.CollectionRef {
+	return s.client.Collection(COLLECTION).Doc(webhookID).Collection(AUDITCOLLECTION)
+}
+
+/*
+key returns the document of an idempotency key, named by its hash since keys may hold characters document ids cannot
+*/
+func (s *FirestoreStore) key(name string) *firestore.DocumentRef {
+	sum := sha256.Sum256([]byte(name))
+	return s.client.Collection(KEYCOLLECTION).Doc(hex.EncodeToString(sum[:]))
+}
+
+/*
+storedKey reports whether key is what the document of its name holds, reading it in the transaction
+*/
+func (s *FirestoreStore) storedKey(tx *firestore.Transaction, ref *firestore.DocumentRef, key IdempotencyKey) (bool, error) {
+	snap, err := tx.Get(ref)
+	if status.Code(err) == codes.NotFound {
+		return false, nil
+	}
+	if err != nil { // Error handling read
+		return false, err
+	}
+	var existing IdempotencyKey
+	if err := snap.DataTo(&existing); err != nil { // Error handling decoding
+		return false, err
+	}
+	return existing.same(key), nil
+}
+
+/*
+readPruned returns the highest id removed from the change log held by a meta document, 0 if it does not exist yet
+*/
+func readPruned(snap *firestore.DocumentSnapshot, err error) (int64, error) {
+	if status.Code(err) == codes.NotFound {
+		return 0, nil
+	}
+	if err != nil { // Error handling read
+		return 0, err
+	}
+	var meta struct {
+		Pruned int64 `firestore:"pruned"`
+	}
+	if err := snap.DataTo(&meta); err != nil { // Error handling decoding
+		return 0, err
+	}
+	return meta.Pruned, nil
+}
+
+/*
+deleteCollection removes every document in a collection
+*/
+func (s *FirestoreStore) deleteCollection(collection *firestore.CollectionRef) error {
+	refs, err := collection.DocumentRefs(s.ctx).GetAll()
+	if err != nil { // Error handling read
+		return err
+	}
+	for _, ref := range refs {
+		if _, err := ref.Delete(s.ctx); err != nil { // Error handling write
+			return err
+		}
+	}
+	return nil
+}
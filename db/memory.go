@@ -0,0 +1,441 @@
+package db
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore struct for keeping webhooks in process memory, registrations are lost on restart
+type MemoryStore struct {
+	mu          sync.RWMutex
+	hooks       map[string]Webhook
+	deadLetters map[string]map[string]Delivery // Failed deliveries by webhook id, then delivery id
+	history     map[string][]HistoryEntry      // Delivery attempts by webhook id
+	digests     map[string][]DigestEvent       // Events waiting for a digest by webhook id
+	keys        map[string]IdempotencyKey      // Idempotency keys by name
+	audit       map[string][]AuditEntry        // Changes made through the API by webhook id
+	changes     []Change                       // Change log, lowest id first
+	pruned      int64                          // Highest id removed from the change log
+}
+
+/*
+NewMemoryStore returns an empty in-memory webhook store
+*/
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		hooks:       make(map[string]Webhook),
+		deadLetters: make(map[string]map[string]Delivery),
+		history:     make(map[string][]HistoryEntry),
+		digests:     make(map[string][]DigestEvent),
+		keys:        make(map[string]IdempotencyKey),
+		audit:       make(map[string][]AuditEntry),
+	}
+}
+
+/*
+Create stores a new webhook with a generated id
+*/
+func (s *MemoryStore) Create(hook Webhook) (Webhook, error) {
+	id, err := NewID()
+	if err != nil { // Error handling id generation
+		return Webhook{}, err
+	}
+	hook.ID = id
+	hook.Created = time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks[id] = hook
+	return hook, nil
+}
+
+/*
+Get returns the webhook with the given id
+*/
+func (s *MemoryStore) Get(id string) (Webhook, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	hook, ok := s.hooks[id]
+	if !ok {
+		return Webhook{}, ErrNotFound
+	}
+	return hook, nil
+}
+
+/*
+Update replaces the stored webhook with the same id
+*/
+func (s *MemoryStore) Update(hook Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.hooks[hook.ID]; !ok {
+		return ErrNotFound
+	}
+	s.hooks[hook.ID] = hook
+	return nil
+}
+
+/*
+Modify applies fn to the stored webhook with the given id and stores the result, under the lock of the store
+*/
+func (s *MemoryStore) Modify(id string, fn func(hook *Webhook) error) (Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hook, ok := s.hooks[id]
+	if !ok {
+		return Webhook{}, ErrNotFound
+	}
+	if err := fn(&hook); err != nil {
+		return Webhook{}, err
+	}
+	hook.ID = id // The id is not fn's to change
+	s.hooks[id] = hook
+	return hook, nil
+}
+
+/*
+List returns all webhooks ordered by creation time
+*/
+func (s *MemoryStore) List() ([]Webhook, error) {
+	s.mu.RLock()
+	hooks := make([]Webhook, 0, len(s.hooks))
+	for _, hook := range s.hooks {
+		hooks = append(hooks, hook)
+	}
+	s.mu.RUnlock()
+
+	sortByCreated(hooks)
+	return hooks, nil
+}
+
+/*
+Delete removes the webhook with the given id
+*/
+func (s *MemoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.hooks[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.hooks, id)
+	delete(s.deadLetters, id)
+	delete(s.history, id)
+	delete(s.digests, id)
+	return nil
+}
+
+/*
+Count returns the number of stored webhooks
+*/
+func (s *MemoryStore) Count() (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.hooks), nil
+}
+
+/*
+AddDeadLetter stores a failed delivery
+*/
+func (s *MemoryStore) AddDeadLetter(delivery Delivery) (Delivery, error) {
+	delivery, err := prepareDeadLetter(delivery)
+	if err != nil { // Error handling id generation
+		return delivery, err
+	}
+	// Copy attempts so later appends by the caller do not reach into the store
+	delivery.Attempts = append([]Attempt(nil), delivery.Attempts...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.deadLetters[delivery.WebhookID] == nil {
+		s.deadLetters[delivery.WebhookID] = make(map[string]Delivery)
+	}
+	s.deadLetters[delivery.WebhookID][delivery.ID] = delivery
+	return delivery, nil
+}
+
+/*
+GetDeadLetter returns one failed delivery of a webhook
+*/
+func (s *MemoryStore) GetDeadLetter(webhookID, id string) (Delivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	delivery, ok := s.deadLetters[webhookID][id]
+	if !ok {
+		return Delivery{}, ErrNotFound
+	}
+	delivery.Attempts = append([]Attempt(nil), delivery.Attempts...)
+	return delivery, nil
+}
+
+/*
+ListDeadLetters returns the failed deliveries of a webhook ordered by creation time
+*/
+func (s *MemoryStore) ListDeadLetters(webhookID string) ([]Delivery, error) {
+	s.mu.RLock()
+	deliveries := make([]Delivery, 0, len(s.deadLetters[webhookID]))
+	for _, delivery := range s.deadLetters[webhookID] {
+		delivery.Attempts = append([]Attempt(nil), delivery.Attempts...)
+		deliveries = append(deliveries, delivery)
+	}
+	s.mu.RUnlock()
+
+	sortDeliveries(deliveries)
+	return deliveries, nil
+}
+
+/*
+DeleteDeadLetter removes one failed delivery of a webhook
+*/
+func (s *MemoryStore) DeleteDeadLetter(webhookID, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.deadLetters[webhookID][id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.deadLetters[webhookID], id)
+	return nil
+}
+
+/*
+AddHistory records a delivery attempt
+*/
+func (s *MemoryStore) AddHistory(entry HistoryEntry) error {
+	if entry.ID == "" {
+		id, err := NewID()
+		if err != nil { // Error handling id generation
+			return err
+		}
+		entry.ID = id
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history[entry.WebhookID] = append(s.history[entry.WebhookID], entry)
+	return nil
+}
+
+/*
+ListHistory returns the recorded attempts of a webhook, newest first
+*/
+func (s *MemoryStore) ListHistory(webhookID string) ([]HistoryEntry, error) {
+	s.mu.RLock()
+	entries := append([]HistoryEntry(nil), s.history[webhookID]...)
+	s.mu.RUnlock()
+
+	sortHistory(entries)
+	return entries, nil
+}
+
+/*
+PruneHistory removes attempts that are too old or beyond the newest keep of each webhook
+*/
+func (s *MemoryStore) PruneHistory(before time.Time, keep int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, entries := range s.history {
+		kept, _ := pruneHistory(entries, before, keep)
+		s.history[id] = kept
+	}
+	return nil
+}
+
+/*
+AddDigestEvent stores an event for the next digest of its webhook
+*/
+func (s *MemoryStore) AddDigestEvent(event DigestEvent) error {
+	event, err := prepareDigestEvent(event)
+	if err != nil { // Error handling id generation
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.digests[event.WebhookID] = append(s.digests[event.WebhookID], event)
+	return nil
+}
+
+/*
+ListDigestEvents returns the events waiting for the digest of a webhook, oldest first
+*/
+func (s *MemoryStore) ListDigestEvents(webhookID string) ([]DigestEvent, error) {
+	s.mu.RLock()
+	events := append([]DigestEvent(nil), s.digests[webhookID]...)
+	s.mu.RUnlock()
+
+	sortDigestEvents(events)
+	return events, nil
+}
+
+/*
+DeleteDigestEvents removes the events of a webhook recorded before the given time
+*/
+func (s *MemoryStore) DeleteDigestEvents(webhookID string, before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var kept []DigestEvent
+	for _, event := range s.digests[webhookID] {
+		if !event.Time.Before(before) {
+			kept = append(kept, event)
+		}
+	}
+	if kept == nil {
+		delete(s.digests, webhookID)
+	} else {
+		s.digests[webhookID] = kept
+	}
+	return nil
+}
+
+/*
+ClaimIdempotencyKey stores key unless an unexpired key by the same name exists
+*/
+func (s *MemoryStore) ClaimIdempotencyKey(key IdempotencyKey, now time.Time) (IdempotencyKey, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.keys[key.Key]; ok && existing.Expires.After(now) {
+		return existing, false, nil
+	}
+	s.keys[key.Key] = key
+	return key, true, nil
+}
+
+/*
+SwapIdempotencyKey replaces old with key if the stored key is still old
+*/
+func (s *MemoryStore) SwapIdempotencyKey(old, key IdempotencyKey) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.keys[old.Key]; !ok || !existing.same(old) {
+		return false, nil
+	}
+	s.keys[key.Key] = key
+	return true, nil
+}
+
+/*
+DeleteIdempotencyKey removes key so it can be used again, unless it was replaced
+*/
+func (s *MemoryStore) DeleteIdempotencyKey(key IdempotencyKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.keys[key.Key]; ok && existing.same(key) {
+		delete(s.keys, key.Key)
+	}
+	return nil
+}
+
+/*
+PruneIdempotencyKeys removes keys that expired before the given time
+*/
+func (s *MemoryStore) PruneIdempotencyKeys(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, key := range s.keys {
+		if key.Expires.Before(before) {
+			delete(s.keys, name)
+		}
+	}
+	return nil
+}
+
+/*
+AddAuditEntry appends an entry to the audit log of its webhook
+*/
+func (s *MemoryStore) AddAuditEntry(entry AuditEntry) (AuditEntry, error) {
+	entry, err := prepareAuditEntry(entry)
+	if err != nil { // Error handling id generation
+		return entry, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.audit[entry.WebhookID] = append(s.audit[entry.WebhookID], entry)
+	return entry, nil
+}
+
+/*
+ListAuditEntries returns the audit log of a webhook, oldest first
+*/
+func (s *MemoryStore) ListAuditEntries(webhookID string) ([]AuditEntry, error) {
+	s.mu.RLock()
+	entries := append([]AuditEntry(nil), s.audit[webhookID]...)
+	s.mu.RUnlock()
+
+	sortAuditEntries(entries)
+	return entries, nil
+}
+
+/*
+AddChange appends a change to the change log
+*/
+func (s *MemoryStore) AddChange(change Change) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.changes = append(s.changes, change)
+	return nil
+}
+
+/*
+ListChanges returns up to limit changes with an id above since, lowest id first
+*/
+func (s *MemoryStore) ListChanges(since int64, limit int) ([]Change, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := sort.Search(len(s.changes), func(i int) bool {
+		return s.changes[i].ID > since
+	})
+	end := len(s.changes)
+	if end-i > limit {
+		end = i + limit
+	}
+	return append([]Change(nil), s.changes[i:end]...), nil
+}
+
+/*
+PruneChanges removes changes observed before the given time
+*/
+func (s *MemoryStore) PruneChanges(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var kept []Change
+	for _, change := range s.changes {
+		if change.Time.Before(before) {
+			if change.ID > s.pruned {
+				s.pruned = change.ID
+			}
+		} else {
+			kept = append(kept, change)
+		}
+	}
+	s.changes = kept
+	return nil
+}
+
+/*
+ChangesPruned returns the highest id removed from the change log so far
+*/
+func (s *MemoryStore) ChangesPruned() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.pruned, nil
+}
+
+/*
+Close is a no-op for the in-memory store
+*/
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+/*
+sortByCreated orders webhooks by creation time, ties broken by id for a stable listing
+*/
+func sortByCreated(hooks []Webhook) {
+	sort.Slice(hooks, func(i, j int) bool {
+		if hooks[i].Created.Equal(hooks[j].Created) {
+			return hooks[i].ID < hooks[j].ID
+		}
+		return hooks[i].Created.Before(hooks[j].Created)
+	})
+}
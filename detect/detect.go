@@ -0,0 +1,202 @@
+package detect
+
+/*
+Change detection for values that are revised in small steps, such as stringency or confirmed cases.
+A detector keeps a snapshot of the last value seen and the last one reported for every key, and only reports a change
+once the value has moved further than the tolerance of its field, optionally with hysteresis and a cooldown.
+*/
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tolerance struct for how far a value has to move before it counts as changed, the zero value counts any difference
+type Tolerance struct {
+	Absolute   float64       // Difference a change has to exceed, 0 for any
+	Relative   float64       // Difference a change has to exceed as a fraction of the value reported before, 0 for any
+	Hysteresis float64       // Extra share of the tolerance a value has to move back against the last change, needs one
+	Cooldown   time.Duration // Time after a change during which no other is reported
+}
+
+// Change struct for a change reported by a detector
+type Change struct {
+	Key      string
+	Field    string
+	Previous float64 // Value reported before, which the change is measured from
+	Value    float64
+	Delta    float64 // Value less Previous
+	Time     time.Time
+}
+
+// Snapshot struct for what a detector knows about one key
+type Snapshot struct {
+	Reported     float64   // Value the next change is measured from, the first one seen or the last one reported
+	Observed     float64   // Last value seen, possibly within the tolerance of Reported
+	Direction    int       // 1 if the last change was a rise, -1 if it was a fall, 0 before the first
+	ReportedAt   time.Time // When the last change was reported, zero before the first
+	ObservedAt   time.Time
+	Observations int
+}
+
+// Detector struct for the snapshots of every key and the tolerances of every field, safe for concurrent use
+type Detector struct {
+	mu         sync.Mutex
+	tolerances map[string]Tolerance // By field, fields without one count any difference
+	snapshots  map[string]*Snapshot // By key
+}
+
+/*
+New returns a detector without snapshots, measuring changes to each field against its tolerance in tolerances
+*/
+func New(tolerances map[string]Tolerance) *Detector {
+	copied := make(map[string]Tolerance, len(tolerances))
+	for field, tolerance := range tolerances {
+		copied[field] = tolerance
+	}
+	return &Detector{tolerances: copied, snapshots: make(map[string]*Snapshot)}
+}
+
+/*
+Observe records value as the latest one of field seen for key at the time now, reporting a change if it has moved
+far enough from the value reported before. The first value seen for a key is only recorded.
+Within the cooldown of a change nothing is reported, a value still far enough away once it has passed is.
+*/
+func (d *Detector) Observe(key, field string, value float64, now time.Time) (Change, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	snapshot, ok := d.snapshots[key]
+	if !ok {
+		d.snapshots[key] = &Snapshot{Reported: value, Observed: value, ObservedAt: now, Observations: 1}
+		return Change{}, false
+	}
+	snapshot.Observed = value
+	snapshot.ObservedAt = now
+	snapshot.Observations++
+
+	tolerance := d.tolerances[field]
+	if !snapshot.ReportedAt.IsZero() && now.Sub(snapshot.ReportedAt) < tolerance.Cooldown {
+		return Change{}, false
+	}
+	delta := value - snapshot.Reported
+	if !exceeds(tolerance, snapshot, delta) {
+		return Change{}, false
+	}
+
+	change := Change{Key: key, Field: field, Previous: snapshot.Reported, Value: value, Delta: delta, Time: now}
+	snapshot.Reported = value
+	snapshot.ReportedAt = now
+	snapshot.Direction = sign(delta)
+	return change, true
+}
+
+/*
+Get returns the snapshot of key, reporting whether anything was seen for it
+*/
+func (d *Detector) Get(key string) (Snapshot, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	snapshot, ok := d.snapshots[key]
+	if !ok {
+		return Snapshot{}, false
+	}
+	return *snapshot, true
+}
+
+/*
+Forget removes the snapshots of every key starting with prefix, so the next value seen for them is the first again
+*/
+func (d *Detector) Forget(prefix string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key := range d.snapshots {
+		if strings.HasPrefix(key, prefix) {
+			delete(d.snapshots, key)
+		}
+	}
+}
+
+/*
+exceeds reports whether delta is beyond every tolerance set, by more than the hysteresis as well if it goes
+against the direction of the last change
+*/
+func exceeds(tolerance Tolerance, snapshot *Snapshot, delta float64) bool {
+	if delta == 0 || math.IsNaN(delta) {
+		return false
+	}
+	margin := 1.0
+	if snapshot.Direction != 0 && sign(delta) != snapshot.Direction {
+		margin += tolerance.Hysteresis
+	}
+	if math.Abs(delta) <= tolerance.Absolute*margin {
+		return false
+	}
+	if math.Abs(delta) <= math.Abs(snapshot.Reported)*tolerance.Relative*margin {
+		return false
+	}
+	return true
+}
+
+/*
+sign returns 1 for positive numbers and -1 for the rest
+*/
+func sign(x float64) int {
+	if x > 0 {
+		return 1
+	}
+	return -1
+}
+
+/*
+ParseTolerance reads a tolerance written as comma separated settings, any of which may be left out, e.g.
+`absolute=0.5,relative=1%,hysteresis=0.5,cooldown=10m`. Relative tolerances are fractions or percentages.
+Hysteresis is a share of the tolerance, so it is refused without an absolute or relative one.
+*/
+func ParseTolerance(s string) (Tolerance, error) {
+	var tolerance Tolerance
+	for _, setting := range strings.Split(s, ",") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+		parts := strings.SplitN(setting, "=", 2)
+		if len(parts) != 2 {
+			return tolerance, errors.New("expected name=value, got " + setting)
+		}
+		name, raw := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+
+		var err error
+		switch name {
+		case "absolute":
+			tolerance.Absolute, err = strconv.ParseFloat(raw, 64)
+		case "relative":
+			if strings.HasSuffix(raw, "%") {
+				tolerance.Relative, err = strconv.ParseFloat(strings.TrimSuffix(raw, "%"), 64)
+				tolerance.Relative /= 100
+			} else {
+				tolerance.Relative, err = strconv.ParseFloat(raw, 64)
+			}
+		case "hysteresis":
+			tolerance.Hysteresis, err = strconv.ParseFloat(raw, 64)
+		case "cooldown":
+			tolerance.Cooldown, err = time.ParseDuration(raw)
+		default:
+			return tolerance, errors.New("unknown setting " + name + ", expected absolute, relative, hysteresis or cooldown")
+		}
+		if err != nil {
+			return tolerance, errors.New("invalid " + name + " " + raw)
+		}
+	}
+	if tolerance.Absolute < 0 || tolerance.Relative < 0 || tolerance.Hysteresis < 0 || tolerance.Cooldown < 0 {
+		return tolerance, errors.New("settings must not be negative")
+	}
+	if tolerance.Hysteresis > 0 && tolerance.Absolute == 0 && tolerance.Relative == 0 {
+		return tolerance, errors.New("hysteresis is a share of the tolerance, set absolute or relative as well")
+	}
+	return tolerance, nil
+}
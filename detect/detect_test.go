@@ -0,0 +1,130 @@
+package detect
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// observation is one value fed to a detector, a minute after the one before, and whether it should be a change
+type observation struct {
+	value  float64
+	change bool
+}
+
+// observe feeds observations to a detector with tolerance for one key, failing on every unexpected outcome
+func observe(t *testing.T, name string, tolerance Tolerance, observations []observation) {
+	t.Helper()
+	d := New(map[string]Tolerance{"stringency": tolerance})
+	start := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, o := range observations {
+		_, changed := d.Observe("norway", "stringency", o.value, start.Add(time.Duration(i)*time.Minute))
+		if changed != o.change {
+			t.Errorf("%s: value %d (%v) reported as change %v, want %v", name, i, o.value, changed, o.change)
+		}
+	}
+}
+
+func TestTolerance(t *testing.T) {
+	tests := []struct {
+		name         string
+		tolerance    Tolerance
+		observations []observation
+	}{
+		{"any difference", Tolerance{}, []observation{{10, false}, {10, false}, {10.1, true}, {10, true}}},
+		{"absolute", Tolerance{Absolute: 1}, []observation{{10, false}, {10.5, false}, {11, false}, {11.5, true}}},
+		// Measured from the value reported, small steps add up
+		{"steps add up", Tolerance{Absolute: 1}, []observation{{10, false}, {10.6, false}, {10.4, false}, {11.2, true}, {10.5, false}}},
+		{"relative", Tolerance{Relative: 0.1}, []observation{{100, false}, {109, false}, {111, true}, {100, false}, {99, true}}},
+		// Both have to be exceeded
+		{"absolute and relative", Tolerance{Absolute: 5, Relative: 0.01}, []observation{{100, false}, {104, false}, {106, true}}},
+		{"absolute and relative small", Tolerance{Absolute: 0.5, Relative: 0.1}, []observation{{100, false}, {104, false}, {111, true}}},
+	}
+	for _, test := range tests {
+		observe(t, test.name, test.tolerance, test.observations)
+	}
+}
+
+func TestHysteresis(t *testing.T) {
+	tolerance := Tolerance{Absolute: 1, Hysteresis: 0.5}
+	observe(t, "hysteresis", tolerance, []observation{
+		{10, false},
+		{11.5, true},  // Rise beyond 1
+		{13, true},    // Further in the same direction, no hysteresis
+		{11.8, false}, // Falling back 1.2 is within 1 * 1.5
+		{11.4, true},  // Falling back 1.6 is not
+		{10.2, true},  // Falling further, the band re-arms for the new direction
+		{11.4, false}, // Rising back 1.2 is within the band again
+		{11.8, true},  // Rising back 1.6 is not
+	})
+}
+
+func TestCooldown(t *testing.T) {
+	tolerance := Tolerance{Absolute: 1, Cooldown: 3 * time.Minute}
+	observe(t, "cooldown", tolerance, []observation{
+		{10, false},
+		{12, true},  // Minute 1
+		{14, false}, // Minute 2, within the cooldown
+		{16, false}, // Minute 3
+		{16, true},  // Minute 4, still far enough from 12 once it has passed
+		{16.5, false},
+		{10, false}, // Minute 6, within the cooldown again
+		{16, false}, // Minute 7, came back before it was reported
+	})
+}
+
+func TestObserveSnapshot(t *testing.T) {
+	d := New(map[string]Tolerance{"stringency": {Absolute: 1}})
+	now := time.Now()
+	d.Observe("norway", "stringency", 10, now)
+	d.Observe("norway", "stringency", 10.5, now)
+	change, ok := d.Observe("norway", "stringency", 8, now)
+	if !ok || change.Previous != 10 || change.Value != 8 || change.Delta != -2 {
+		t.Errorf("change = %+v, %v, want from 10 to 8", change, ok)
+	}
+	snapshot, _ := d.Get("norway")
+	if snapshot.Reported != 8 || snapshot.Direction != -1 || snapshot.Observations != 3 {
+		t.Errorf("snapshot = %+v, want 8 reported falling after 3 observations", snapshot)
+	}
+
+	d.Forget("nor")
+	if _, ok := d.Get("norway"); ok {
+		t.Error("snapshot kept after Forget")
+	}
+	if _, ok := d.Observe("norway", "stringency", 20, now); ok {
+		t.Error("first value after Forget reported as a change")
+	}
+}
+
+func TestParseTolerance(t *testing.T) {
+	tests := []struct {
+		source string
+		want   Tolerance
+		err    string // Part of the error message, empty if none is expected
+	}{
+		{"", Tolerance{}, ""},
+		{"absolute=0.5, relative=1%,hysteresis=0.5,cooldown=10m", Tolerance{Absolute: 0.5, Relative: 0.01, Hysteresis: 0.5, Cooldown: 10 * time.Minute}, ""},
+		{"relative=0.02", Tolerance{Relative: 0.02}, ""},
+		{"relative=5%,hysteresis=1", Tolerance{Relative: 0.05, Hysteresis: 1}, ""},
+		{"cooldown=1h", Tolerance{Cooldown: time.Hour}, ""},
+		{"hysteresis=0.5", Tolerance{}, "set absolute or relative as well"},
+		{"hysteresis=0.5,cooldown=1h", Tolerance{}, "set absolute or relative as well"},
+		{"absolute", Tolerance{}, "expected name=value"},
+		{"absolute=x", Tolerance{}, "invalid absolute x"},
+		{"cooldown=10", Tolerance{}, "invalid cooldown 10"},
+		{"absolute=-1", Tolerance{}, "must not be negative"},
+		{"margin=1", Tolerance{}, "unknown setting margin"},
+	}
+	for _, test := range tests {
+		got, err := ParseTolerance(test.source)
+		if test.err == "" {
+			if err != nil || got != test.want {
+				t.Errorf("ParseTolerance(%q) = %+v, %v, want %+v", test.source, got, err, test.want)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("ParseTolerance(%q) = %v, want error containing %q", test.source, err, test.err)
+		}
+	}
+}
@@ -5,7 +5,11 @@ module covidcase
 go 1.13
 
 require (
+	cloud.google.com/go/firestore v1.5.0
 	github.com/alediaferia/gocountries v0.0.0-20150710192521-aaf4e81715ec
 	github.com/go-chi/chi v1.5.3
 	github.com/go-chi/cors v1.2.0
+	go.etcd.io/bbolt v1.3.6
+	google.golang.org/api v0.40.0
+	google.golang.org/grpc v1.35.0
 )
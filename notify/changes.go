@@ -0,0 +1,60 @@
+package notify
+
+import (
+	"covidcase/db"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// changes struct for numbering the changes to the values looked up by webhooks and streams
+type changes struct {
+	mu   sync.Mutex // Serialises detection, numbering and logging, so changes are logged and streamed in id order
+	next int64      // Id of the next change
+}
+
+/*
+newChanges returns changes numbering from the current time in microseconds,
+so ids from before a restart are lower than any handed out after it
+*/
+func newChanges() *changes {
+	return &changes{next: time.Now().UnixNano() / int64(time.Microsecond)}
+}
+
+/*
+sample notes the value of field for a country, however it was looked up. A value that moved beyond the tolerance
+of the field is a change, logged in the change feed and handed to the clients streaming it. The first value is only
+noted.
+*/
+func (d *Dispatcher) sample(field, countryName string, value float64) {
+	c := d.changes
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	detected, ok := d.detector.Observe(changeKey(field, countryName), field, value, time.Now().UTC())
+	if !ok {
+		return
+	}
+
+	change := db.Change{ID: c.next, Country: countryName, Field: field, Previous: detected.Previous, Value: value, Time: detected.Time}
+	c.next++
+	if err := d.store.AddChange(change); err != nil { // Error handling store, streams still get the change
+		fmt.Println("Change " + field + " " + countryName + ": " + err.Error())
+	}
+	d.publish(change)
+}
+
+/*
+webhookKey identifies the values of a country as seen by one webhook, apart from what anyone else has seen
+*/
+func webhookKey(hook db.Webhook, countryName string) string {
+	return "webhook/" + hook.ID + "/" + changeKey(hook.Field, countryName)
+}
+
+/*
+changeKey identifies the values of field for a country, whatever case the country was given in
+*/
+func changeKey(field, countryName string) string {
+	return field + "/" + strings.ToLower(countryName)
+}
@@ -0,0 +1,320 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"covidcase/db"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Channels a notification can be sent through
+*/
+const HTTP = "http"   // Signed payload POSTed to the webhook URL, the default
+const EMAIL = "email" // Plain text email through the SMTP server of the dispatcher
+const SLACK = "slack" // Message for a Slack incoming webhook URL
+const TEAMS = "teams" // Message card for a Microsoft Teams incoming webhook URL
+
+const MAXRECIPIENTS = 10 // Most email addresses a registration can send to
+
+// SMTPConfig struct for the mail server email notifications are sent through
+type SMTPConfig struct {
+	Addr     string // host:port of the server, email notifications are disabled if empty
+	From     string // Sender address
+	Username string // Optional, PLAIN authentication is used if set
+	Password string
+}
+
+// Receipt struct for what the receiving end answered to a notification
+type Receipt struct {
+	StatusCode int         // HTTP status code, or SMTP reply code for email
+	Headers    http.Header // Response headers, HTTP based channels only
+}
+
+/*
+Notifier is implemented by every channel, Send delivers an encoded payload for hook once.
+A receipt is returned whenever the receiving end answered, also along with an error if it refused the notification.
+*/
+type Notifier interface {
+	Send(ctx context.Context, hook db.Webhook, body []byte) (Receipt, error)
+}
+
+/*
+notifier returns the notifier for the channel of hook
+*/
+func (d *Dispatcher) notifier(hook db.Webhook) (Notifier, error) {
+	channel := hook.Channel
+	if channel == "" {
+		channel = HTTP
+	}
+	notifier, ok := d.notifiers[channel]
+	if !ok {
+		return nil, errors.New("channel " + channel + " is not available")
+	}
+	return notifier, nil
+}
+
+// webhookNotifier struct for the HTTP channel, signing every request with the secrets of the webhook
+type webhookNotifier struct {
+	client *http.Client
+}
+
+/*
+Send signs body and POSTs it to the webhook URL
+*/
+func (n webhookNotifier) Send(ctx context.Context, hook db.Webhook, body []byte) (Receipt, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil { // Error handling malformed URL
+		return Receipt{}, err
+	}
+	req.Header.Set("content-type", contentType(hook))
+	now := time.Now()
+	if sigs := signatures(hook, now, body); sigs != "" { // Webhooks registered before signing have no secret
+		req.Header.Set(HEADERTIMESTAMP, strconv.FormatInt(now.Unix(), 10))
+		req.Header.Set(HEADERSIGNATURE, sigs)
+	}
+	return receive(n.client.Do(req))
+}
+
+// chatNotifier struct for chat incoming webhooks, which take a message of their own format rather than the payload
+type chatNotifier struct {
+	client *http.Client
+	format func(title, text string) interface{} // Message posted for a notification
+}
+
+/*
+Send POSTs the payload in body, written out as a chat message, to the incoming webhook URL
+*/
+func (n chatNotifier) Send(ctx context.Context, hook db.Webhook, body []byte) (Receipt, error) {
+	title, lines, err := describe(body)
+	if err != nil { // Error handling payload
+		return Receipt{}, err
+	}
+	message, err := json.Marshal(n.format(title, strings.Join(lines, "\n")))
+	if err != nil { // Error handling encoding
+		return Receipt{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(message))
+	if err != nil { // Error handling malformed URL
+		return Receipt{}, err
+	}
+	req.Header.Set("content-type", "application/json")
+	return receive(n.client.Do(req))
+}
+
+/*
+slackMessage formats a message for a Slack incoming webhook
+*/
+func slackMessage(title, text string) interface{} {
+	return map[string]string{"text": "*" + title + "*\n" + text}
+}
+
+/*
+teamsMessage formats a message card for a Microsoft Teams incoming webhook, which needs blank lines between lines
+*/
+func teamsMessage(title, text string) interface{} {
+	return map[string]string{
+		"@type":    "MessageCard",
+		"@context": "https://schema.org/extensions",
+		"summary":  title,
+		"title":    title,
+		"text":     strings.Replace(text, "\n", "\n\n", -1),
+	}
+}
+
+/*
+receive turns the response to a notification into a receipt, non-2xx responses are errors
+*/
+func receive(res *http.Response, err error) (Receipt, error) {
+	if err != nil { // Error handling HTTP request
+		return Receipt{}, err
+	}
+	res.Body.Close()
+	receipt := Receipt{StatusCode: res.StatusCode, Headers: res.Header}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return receipt, errors.New("subscriber responded " + res.Status)
+	}
+	return receipt, nil
+}
+
+// emailNotifier struct for the email channel
+type emailNotifier struct {
+	config SMTPConfig
+}
+
+/*
+Send mails the payload in body, written out as text with the JSON below it, to the recipients of hook
+*/
+func (n emailNotifier) Send(ctx context.Context, hook db.Webhook, body []byte) (Receipt, error) {
+	title, lines, err := describe(body)
+	if err != nil { // Error handling payload
+		return Receipt{}, err
+	}
+	subject := hook.Subject
+	if subject == "" {
+		subject = title
+	}
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, body, "", "  "); err != nil { // Error handling payload
+		return Receipt{}, err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.config.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(hook.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", strings.NewReplacer("\r", " ", "\n", " ").Replace(subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Join(lines, "\r\n") + "\r\n\r\n")
+	msg.WriteString(strings.Replace(pretty.String(), "\n", "\r\n", -1) + "\r\n")
+
+	if err := n.mail(ctx, hook.To, msg.Bytes()); err != nil { // Error handling SMTP
+		var reply *textproto.Error
+		if errors.As(err, &reply) {
+			return Receipt{StatusCode: reply.Code}, err
+		}
+		return Receipt{}, err
+	}
+	return Receipt{StatusCode: 250}, nil
+}
+
+/*
+mail runs one SMTP transaction, net/smtp.SendMail cannot be cancelled so the connection is made and timed out here
+*/
+func (n emailNotifier) mail(ctx context.Context, to []string, msg []byte) error {
+	dialer := &net.Dialer{Timeout: SENDTIMEOUT}
+	conn, err := dialer.DialContext(ctx, "tcp", n.config.Addr)
+	if err != nil { // Error handling connection
+		return err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(SENDTIMEOUT)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	host, _, _ := net.SplitHostPort(n.config.Addr)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil { // Error handling greeting
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if n.config.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", n.config.Username, n.config.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(n.config.From); err != nil {
+		return err
+	}
+	for _, address := range to {
+		if err := client.Rcpt(address); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+/*
+describe writes out a notification, batch or digest payload as a title and one line per country
+*/
+func describe(body []byte) (string, []string, error) {
+	var payload struct {
+		Notification
+		Window        string         `json:"window"`
+		Start         time.Time      `json:"start"`
+		Changes       []DigestChange `json:"changes"`
+		Notifications []Notification `json:"notifications"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return "", nil, err
+	}
+
+	title := "Webhook " + payload.ID + ": " + payload.Trigger
+	if payload.Test {
+		title = "Test notification for webhook " + payload.ID + ": " + payload.Trigger
+	}
+	var lines []string
+	switch {
+	case payload.Window != "": // Digest
+		title += fmt.Sprintf(", %s digest from %s", payload.Window, payload.Start.Format(time.RFC3339))
+		for _, change := range payload.Changes {
+			line := change.Country + ": " + subject(change.Field, change.Condition)
+			if change.Before != nil && change.After != nil {
+				line += " went from " + number(*change.Before) + " to " + number(*change.After)
+			} else if change.After != nil {
+				line += " is now " + number(*change.After)
+			}
+			lines = append(lines, fmt.Sprintf("%s (%d events)", line, change.Events))
+		}
+		if len(lines) == 0 {
+			lines = append(lines, "Nothing happened in this window")
+		}
+	case payload.Notifications != nil: // Batch
+		for _, notification := range payload.Notifications {
+			lines = append(lines, line(notification))
+		}
+	default:
+		lines = append(lines, line(payload.Notification))
+	}
+	return title, lines, nil
+}
+
+/*
+line writes out one notification
+*/
+func line(notification Notification) string {
+	text := notification.Country + ": " + subject(notification.Field, notification.Condition)
+	if notification.Condition != "" {
+		return text + " holds"
+	}
+	if notification.Value != nil {
+		text += " is now " + number(*notification.Value)
+	}
+	if notification.Previous != nil {
+		text += ", was " + number(*notification.Previous)
+	}
+	if notification.Threshold != nil {
+		text += ", threshold " + number(*notification.Threshold)
+	}
+	return text
+}
+
+// subject returns what a notification is about, its field or its condition
+func subject(field, condition string) string {
+	if condition != "" {
+		return "condition " + condition
+	}
+	return field
+}
+
+// number formats a value without exponents, case counts run into the millions
+func number(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
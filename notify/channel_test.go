@@ -0,0 +1,235 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"covidcase/db"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpSession struct for what a fake SMTP server was told in one transaction
+type smtpSession struct {
+	extensions []string // Advertised in reply to EHLO
+	auth       string   // Decoded AUTH PLAIN response, empty if the client did not authenticate
+	from       string
+	to         []string
+	data       string
+	starttls   bool // Client asked for STARTTLS
+}
+
+/*
+fakeSMTP listens on a local port and serves one SMTP transaction, advertising extensions and refusing the recipients
+in reject. The session is sent on the returned channel once the client quits or goes away.
+*/
+func fakeSMTP(t *testing.T, extensions []string, reject map[string]bool) (string, <-chan smtpSession) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := make(chan smtpSession, 1)
+	go func() {
+		defer listener.Close() // One transaction only
+		session := smtpSession{extensions: extensions}
+		defer func() { sessions <- session }()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		text := textproto.NewConn(conn)
+
+		text.PrintfLine("220 localhost fake SMTP")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			arg := strings.TrimSpace(strings.TrimPrefix(line, strings.SplitN(line, " ", 2)[0]))
+			switch verb {
+			case "EHLO":
+				reply := append([]string{"localhost greets you"}, extensions...)
+				for i, ext := range reply {
+					sep := "-"
+					if i == len(reply)-1 {
+						sep = " "
+					}
+					text.PrintfLine("250%s%s", sep, ext)
+				}
+			case "STARTTLS":
+				session.starttls = true
+				text.PrintfLine("454 TLS not available")
+			case "AUTH":
+				fields := strings.Fields(arg)
+				if len(fields) == 2 {
+					decoded, _ := base64.StdEncoding.DecodeString(fields[1])
+					session.auth = string(decoded)
+				}
+				text.PrintfLine("235 Authenticated")
+			case "MAIL":
+				session.from = address(strings.TrimPrefix(arg, "FROM:"))
+				text.PrintfLine("250 OK")
+			case "RCPT":
+				to := address(strings.TrimPrefix(arg, "TO:"))
+				if reject[to] {
+					text.PrintfLine("550 No such user")
+					continue
+				}
+				session.to = append(session.to, to)
+				text.PrintfLine("250 OK")
+			case "DATA":
+				text.PrintfLine("354 Go ahead")
+				data, err := text.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				session.data = string(data)
+				text.PrintfLine("250 Queued")
+			case "QUIT":
+				text.PrintfLine("221 Bye")
+				return
+			default:
+				text.PrintfLine("502 Not implemented")
+			}
+		}
+	}()
+	return listener.Addr().String(), sessions
+}
+
+// address returns the address in a MAIL or RCPT argument such as `<a@example.com> BODY=8BITMIME`
+func address(arg string) string {
+	arg = strings.TrimPrefix(arg, "<")
+	if end := strings.IndexByte(arg, '>'); end >= 0 {
+		return arg[:end]
+	}
+	return arg
+}
+
+// testPayload returns the encoded notification sent in the email tests
+func testPayload(t *testing.T) []byte {
+	t.Helper()
+	value, previous := 30.0, 25.0
+	body, err := json.Marshal(Notification{ID: "abc", Country: "Norway", Field: FIELDSTRINGENCY, Trigger: ONCHANGE,
+		Value: &value, Previous: &previous, Time: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// headers splits a message read with ReadDotBytes, which turns line ends into \n, into its headers and body
+func headers(t *testing.T, data string) (textproto.MIMEHeader, string) {
+	t.Helper()
+	reader := textproto.NewReader(bufio.NewReader(strings.NewReader(data)))
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.SplitN(data, "\n\n", 2)
+	return header, parts[1]
+}
+
+func TestEmailSend(t *testing.T) {
+	addr, sessions := fakeSMTP(t, []string{"8BITMIME"}, nil) // No STARTTLS, the message goes out in the clear
+	n := emailNotifier{config: SMTPConfig{Addr: addr, From: "covidcase@example.com"}}
+	hook := db.Webhook{ID: "abc", Channel: EMAIL, To: []string{"a@example.com", "b@example.com"}}
+
+	receipt, err := n.Send(context.Background(), hook, testPayload(t))
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if receipt.StatusCode != 250 {
+		t.Errorf("StatusCode = %d, want 250", receipt.StatusCode)
+	}
+	session := <-sessions
+	if session.starttls {
+		t.Error("client asked for STARTTLS without it being advertised")
+	}
+	if session.auth != "" {
+		t.Errorf("client authenticated without a username, got %q", session.auth)
+	}
+
+	// Envelope
+	if session.from != "covidcase@example.com" {
+		t.Errorf("MAIL FROM = %q, want covidcase@example.com", session.from)
+	}
+	if strings.Join(session.to, ",") != "a@example.com,b@example.com" {
+		t.Errorf("RCPT TO = %v, want both recipients", session.to)
+	}
+
+	// Headers
+	header, body := headers(t, session.data)
+	want := map[string]string{
+		"From":         "covidcase@example.com",
+		"To":           "a@example.com, b@example.com",
+		"Subject":      "Webhook abc: ON_CHANGE",
+		"Mime-Version": "1.0",
+		"Content-Type": "text/plain; charset=utf-8",
+	}
+	for name, value := range want {
+		if got := header.Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+	if _, err := time.Parse(time.RFC1123Z, header.Get("Date")); err != nil {
+		t.Errorf("Date %q is not RFC 1123: %v", header.Get("Date"), err)
+	}
+
+	// Body, written out first with the JSON payload below
+	if !strings.HasPrefix(body, "Norway: stringency is now 30, was 25\n\n") {
+		t.Errorf("body does not start with the written out notification:\n%s", body)
+	}
+	var payload Notification
+	if err := json.Unmarshal([]byte(strings.SplitN(body, "\n\n", 2)[1]), &payload); err != nil {
+		t.Errorf("body does not end with the JSON payload: %v", err)
+	} else if payload.ID != "abc" || payload.Country != "Norway" || *payload.Value != 30 {
+		t.Errorf("payload = %+v, want the notification sent", payload)
+	}
+}
+
+func TestEmailSendAuthAndSubject(t *testing.T) {
+	addr, sessions := fakeSMTP(t, []string{"AUTH PLAIN"}, nil)
+	n := emailNotifier{config: SMTPConfig{Addr: addr, From: "covidcase@example.com", Username: "user", Password: "pass"}}
+	hook := db.Webhook{ID: "abc", Channel: EMAIL, To: []string{"a@example.com"}, Subject: "Alert\r\nBcc: x@example.com"}
+
+	if _, err := n.Send(context.Background(), hook, testPayload(t)); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	session := <-sessions
+	if session.auth != "\x00user\x00pass" {
+		t.Errorf("AUTH PLAIN = %q, want user and pass", session.auth)
+	}
+	header, _ := headers(t, session.data)
+	if got := header.Get("Subject"); got != "Alert  Bcc: x@example.com" {
+		t.Errorf("Subject = %q, want line breaks replaced", got)
+	}
+	if header.Get("Bcc") != "" {
+		t.Error("subject injected a Bcc header")
+	}
+}
+
+func TestEmailSendRejected(t *testing.T) {
+	addr, sessions := fakeSMTP(t, nil, map[string]bool{"gone@example.com": true})
+	n := emailNotifier{config: SMTPConfig{Addr: addr, From: "covidcase@example.com"}}
+	hook := db.Webhook{ID: "abc", Channel: EMAIL, To: []string{"gone@example.com"}}
+
+	receipt, err := n.Send(context.Background(), hook, testPayload(t))
+	if err == nil {
+		t.Fatal("Send succeeded for a refused recipient")
+	}
+	if receipt.StatusCode != 550 {
+		t.Errorf("StatusCode = %d, want the 550 the server replied", receipt.StatusCode)
+	}
+	if session := <-sessions; session.data != "" {
+		t.Error("message was sent to a refused recipient")
+	}
+}
@@ -0,0 +1,202 @@
+package notify
+
+import (
+	"covidcase/db"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy struct for how often and how patiently a failed delivery is retried
+type RetryPolicy struct {
+	MaxAttempts int           // Attempts before a delivery is dead-lettered, including the first one
+	BaseDelay   time.Duration // Wait before the second attempt, doubled for every attempt after
+	MaxDelay    time.Duration // Upper bound for the wait between two attempts
+}
+
+// DefaultRetry is used when no other policy is configured
+var DefaultRetry = RetryPolicy{MaxAttempts: 5, BaseDelay: 2 * time.Second, MaxDelay: 5 * time.Minute}
+
+/*
+Backoff returns the wait before attempt number n (counting from 1), exponential in n with random jitter.
+The jitter picks a point in the upper half of the delay so hooks failing together do not retry together.
+*/
+func (p RetryPolicy) Backoff(n int) time.Duration {
+	delay := p.BaseDelay
+	for i := 2; i < n && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+/*
+Redrive removes a delivery from the dead letters and starts delivering it again with a fresh set of attempts,
+it is dead-lettered again if those run out as well
+*/
+func (d *Dispatcher) Redrive(delivery db.Delivery) error {
+	hook, err := d.store.Get(delivery.WebhookID)
+	if err != nil { // Error handling store, webhook may have been removed
+		return err
+	}
+	if err := d.store.DeleteDeadLetter(delivery.WebhookID, delivery.ID); err != nil { // Error handling store
+		return err
+	}
+	if !d.spawn(func() { d.deliver(hook, delivery) }) {
+		// Dispatcher is stopped, put the delivery back where it came from
+		_, err := d.store.AddDeadLetter(delivery)
+		if err == nil {
+			err = errors.New("dispatcher is stopped")
+		}
+		return err
+	}
+	return nil
+}
+
+/*
+deliver attempts delivery until it succeeds or the retry policy runs out, then dead-letters it.
+Deliveries cut short by shutdown are dead-lettered as well so they can be redriven after a restart.
+Only deliveries that reached the host count against the health of the webhook, not ones an open breaker refused.
+*/
+func (d *Dispatcher) deliver(hook db.Webhook, delivery db.Delivery) {
+	reached := false
+	for n := 1; n <= d.config.Retry.MaxAttempts; n++ {
+		if n > 1 {
+			wait := time.NewTimer(d.config.Retry.Backoff(n))
+			select {
+			case <-d.ctx.Done():
+				wait.Stop()
+				d.deadLetter(delivery)
+				return
+			case <-wait.C:
+			}
+		}
+
+		attempt, ok := d.attempt(hook, delivery.Payload, len(delivery.Attempts)+1)
+		reached = reached || ok
+		delivery.Attempts = append(delivery.Attempts, attempt)
+		d.record(delivery, attempt)
+		if attempt.Error == "" { // Delivered
+			d.track(hook.ID, true)
+			return
+		}
+		fmt.Printf("Webhook %s: attempt %d failed: %s\n", hook.ID, attempt.Number, attempt.Error)
+		if d.ctx.Err() != nil { // Shutting down, no point in waiting for another attempt
+			break
+		}
+	}
+	if d.ctx.Err() == nil && reached { // Ran out of attempts, rather than being cut short by shutdown
+		d.track(hook.ID, false)
+	}
+	d.deadLetter(delivery)
+}
+
+/*
+deadLetter stores a delivery that ran out of attempts, unless its webhook has been removed in the meantime
+*/
+func (d *Dispatcher) deadLetter(delivery db.Delivery) {
+	if _, err := d.store.Get(delivery.WebhookID); err == db.ErrNotFound {
+		return
+	}
+	if _, err := d.store.AddDeadLetter(delivery); err != nil { // Error handling store
+		fmt.Println("Webhook " + delivery.WebhookID + ": could not store dead letter: " + err.Error())
+	}
+}
+
+/*
+record adds an attempt at delivery to the history of its webhook
+*/
+func (d *Dispatcher) record(delivery db.Delivery, attempt db.Attempt) {
+	entry := db.HistoryEntry{
+		Attempt:    attempt,
+		WebhookID:  delivery.WebhookID,
+		DeliveryID: delivery.ID,
+		Payload:    delivery.Payload,
+		Success:    attempt.Error == "",
+	}
+	if err := d.store.AddHistory(entry); err != nil { // Error handling store, delivery goes on regardless
+		fmt.Println("Webhook " + delivery.WebhookID + ": could not record attempt: " + err.Error())
+	}
+}
+
+/*
+prune removes expired delivery history, expired idempotency keys, changes past their retention and idle destination
+hosts every PRUNEINTERVAL until the dispatcher stops
+*/
+func (d *Dispatcher) prune() {
+	ticker := time.NewTicker(PRUNEINTERVAL)
+	defer ticker.Stop()
+
+	for {
+		var before time.Time
+		if d.config.HistoryMaxAge > 0 {
+			before = time.Now().Add(-d.config.HistoryMaxAge)
+		}
+		if err := d.store.PruneHistory(before, d.config.HistoryMaxEntries); err != nil { // Error handling store
+			fmt.Println("Could not prune delivery history: " + err.Error())
+		}
+		if err := d.store.PruneIdempotencyKeys(time.Now()); err != nil { // Error handling store
+			fmt.Println("Could not prune idempotency keys: " + err.Error())
+		}
+		if d.config.ChangeRetention > 0 {
+			if err := d.store.PruneChanges(time.Now().Add(-d.config.ChangeRetention)); err != nil { // Error handling store
+				fmt.Println("Could not prune change log: " + err.Error())
+			}
+		}
+		d.limits.forget(time.Now().Add(-HOSTIDLE))
+
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+/*
+attempt POSTs payload to the webhook URL once and records the outcome,
+reporting whether the attempt was sent rather than refused by the circuit breaker of the host
+*/
+func (d *Dispatcher) attempt(hook db.Webhook, payload string, number int) (db.Attempt, bool) {
+	result := db.Attempt{Number: number, Time: time.Now().UTC()}
+
+	start := time.Now()
+	status, err := d.post(hook, payload)
+	result.Latency = float64(time.Since(start)) / float64(time.Millisecond)
+	result.StatusCode = status
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result, !refused(err)
+}
+
+/*
+post sends payload through the channel of the webhook and returns the status code it was answered with,
+refusals are errors. Every request to an HTTP webhook is signed afresh, so a retry carries a new timestamp.
+The limits of the destination host are waited for first, an open circuit breaker fails the attempt right away.
+*/
+func (d *Dispatcher) post(hook db.Webhook, payload string) (int, error) {
+	notifier, err := d.notifier(hook)
+	if err != nil { // Error handling channel no longer configured
+		return 0, err
+	}
+	name := destination(hook)
+	if name == "" {
+		receipt, err := notifier.Send(d.ctx, hook, []byte(payload))
+		return receipt.StatusCode, err
+	}
+	done, err := d.limits.acquire(d.ctx, name, root(hook))
+	if err != nil { // Error handling open breaker or shutdown
+		return 0, err
+	}
+	receipt, err := notifier.Send(d.ctx, hook, []byte(payload))
+	done(err, receipt)
+	return receipt.StatusCode, err
+}
@@ -0,0 +1,166 @@
+package notify
+
+import (
+	"covidcase/db"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Digest struct for JSON encoding the summary a DIGEST webhook gets at the end of a window
+type Digest struct {
+	ID      string         `json:"id"`
+	Trigger string         `json:"trigger"`
+	Window  string         `json:"window"`
+	Start   time.Time      `json:"start"`
+	End     time.Time      `json:"end"`
+	Events  int            `json:"events"` // Notifications summarised, over all countries
+	Changes []DigestChange `json:"changes"`
+	Test    bool           `json:"test,omitempty"`
+	Time    time.Time      `json:"time"`
+}
+
+// DigestChange struct for JSON encoding what happened in one country over a digest window
+type DigestChange struct {
+	Country   string    `json:"country"`
+	Field     string    `json:"field,omitempty"`
+	Condition string    `json:"condition,omitempty"`
+	Before    *float64  `json:"before,omitempty"` // Value before the first event, if there was one
+	After     *float64  `json:"after,omitempty"`  // Value at the last event, left out for conditions
+	Values    Values    `json:"values,omitempty"` // Values the condition was last evaluated against
+	Events    int       `json:"events"`
+	First     time.Time `json:"first"`
+	Last      time.Time `json:"last"`
+}
+
+/*
+windowBounds returns the start and end of the window of the given kind that t falls in, aligned to UTC
+*/
+func windowBounds(window string, t time.Time) (time.Time, time.Time) {
+	t = t.UTC()
+	switch window {
+	case HOURLY:
+		start := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, time.UTC)
+		return start, start.Add(time.Hour)
+	case WEEKLY:
+		// Weekday counts from Sunday, weeks start on Monday
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		start := day.AddDate(0, 0, -(int(t.Weekday())+6)%7)
+		return start, start.AddDate(0, 0, 7)
+	default: // DAILY
+		start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 0, 1)
+	}
+}
+
+/*
+hold completes notifications with the details of hook and stores them until the digest of the window is sent
+*/
+func (d *Dispatcher) hold(hook db.Webhook, notifications ...Notification) {
+	now := time.Now().UTC()
+	complete(hook, notifications, now)
+	for _, notification := range notifications {
+		payload, err := json.Marshal(notification)
+		if err != nil { // Error handling encoding
+			fmt.Println("Webhook " + hook.ID + ": " + err.Error())
+			continue
+		}
+		event := db.DigestEvent{WebhookID: hook.ID, Payload: string(payload), Time: now}
+		if err := d.store.AddDigestEvent(event); err != nil { // Error handling store, the event is lost
+			fmt.Println("Webhook " + hook.ID + ": " + err.Error())
+		}
+	}
+}
+
+/*
+flushDigest sends the digest of the events hook collected before end and removes them from the store.
+A zero start catches up on events left over from earlier windows, starting with the window of the oldest one,
+and sends nothing if there are none. Otherwise an empty window is still reported unless hook skips empty digests.
+*/
+func (d *Dispatcher) flushDigest(hook db.Webhook, start, end time.Time) {
+	events, err := d.store.ListDigestEvents(hook.ID)
+	if err != nil { // Error handling store, the events are sent with the next digest
+		fmt.Println("Webhook " + hook.ID + ": " + err.Error())
+		return
+	}
+
+	var notifications []Notification
+	for _, event := range events {
+		if !event.Time.Before(end) { // Belongs to the window that just began
+			continue
+		}
+		var notification Notification
+		if err := json.Unmarshal([]byte(event.Payload), &notification); err != nil { // Error handling decoding
+			fmt.Println("Webhook " + hook.ID + ": digest event " + event.ID + ": " + err.Error())
+			continue
+		}
+		notifications = append(notifications, notification)
+	}
+
+	if start.IsZero() {
+		if len(events) == 0 || !events[0].Time.Before(end) {
+			return
+		}
+		start, _ = windowBounds(hook.Window, events[0].Time)
+	}
+	if len(notifications) > 0 || !hook.SkipEmpty {
+		body, err := json.Marshal(summarise(hook, notifications, start, end))
+		if err != nil { // Error handling encoding
+			fmt.Println("Webhook " + hook.ID + ": " + err.Error())
+			return
+		}
+		d.queue(hook, body)
+	}
+
+	// The digest is out of our hands now, failed deliveries end up as dead letters like any other
+	if err := d.store.DeleteDigestEvents(hook.ID, end); err != nil { // Error handling store
+		fmt.Println("Webhook " + hook.ID + ": " + err.Error())
+	}
+}
+
+/*
+summarise returns the digest of notifications for hook over the window from start to end,
+one change per country with the value before its first notification and at its last
+*/
+func summarise(hook db.Webhook, notifications []Notification, start, end time.Time) Digest {
+	digest := Digest{
+		ID:      hook.ID,
+		Trigger: hook.Trigger,
+		Window:  hook.Window,
+		Start:   start,
+		End:     end,
+		Events:  len(notifications),
+		Changes: []DigestChange{},
+		Time:    time.Now().UTC(),
+	}
+
+	index := make(map[string]int) // Position in Changes by lowercased country name
+	for _, notification := range notifications {
+		digest.Test = digest.Test || notification.Test
+		key := strings.ToLower(notification.Country)
+		i, ok := index[key]
+		if !ok {
+			i = len(digest.Changes)
+			index[key] = i
+			digest.Changes = append(digest.Changes, DigestChange{
+				Country:   notification.Country,
+				Field:     notification.Field,
+				Condition: notification.Condition,
+				Before:    notification.Previous,
+				First:     notification.Time,
+			})
+		}
+		change := &digest.Changes[i]
+		change.After = notification.Value
+		change.Values = notification.Values
+		change.Events++
+		change.Last = notification.Time
+	}
+
+	sort.Slice(digest.Changes, func(i, j int) bool {
+		return digest.Changes[i].Country < digest.Changes[j].Country
+	})
+	return digest
+}
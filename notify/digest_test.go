@@ -0,0 +1,193 @@
+package notify
+
+import (
+	"covidcase/db"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// event is a notification for a country held back for a digest at the given time
+type event struct {
+	country         string
+	previous, value float64
+	time            time.Time
+}
+
+// float returns a pointer to value, as notifications and digests hold them
+func float(value float64) *float64 {
+	return &value
+}
+
+func TestWindowBounds(t *testing.T) {
+	oslo := time.FixedZone("CET", 3600)
+	tests := []struct {
+		window     string
+		t          time.Time
+		start, end time.Time
+	}{
+		{HOURLY, time.Date(2021, 3, 3, 14, 59, 59, 0, time.UTC), time.Date(2021, 3, 3, 14, 0, 0, 0, time.UTC), time.Date(2021, 3, 3, 15, 0, 0, 0, time.UTC)},
+		{HOURLY, time.Date(2021, 3, 3, 0, 30, 0, 0, oslo), time.Date(2021, 3, 2, 23, 0, 0, 0, time.UTC), time.Date(2021, 3, 3, 0, 0, 0, 0, time.UTC)},
+		{DAILY, time.Date(2021, 3, 3, 23, 59, 0, 0, time.UTC), time.Date(2021, 3, 3, 0, 0, 0, 0, time.UTC), time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)},
+		{DAILY, time.Date(2021, 3, 1, 0, 30, 0, 0, oslo), time.Date(2021, 2, 28, 0, 0, 0, 0, time.UTC), time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"", time.Date(2021, 3, 3, 12, 0, 0, 0, time.UTC), time.Date(2021, 3, 3, 0, 0, 0, 0, time.UTC), time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)},
+		// Weeks start on Monday
+		{WEEKLY, time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2021, 3, 8, 0, 0, 0, 0, time.UTC)},
+		{WEEKLY, time.Date(2021, 3, 3, 12, 0, 0, 0, time.UTC), time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2021, 3, 8, 0, 0, 0, 0, time.UTC)},
+		{WEEKLY, time.Date(2021, 3, 7, 23, 59, 0, 0, time.UTC), time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2021, 3, 8, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		start, end := windowBounds(test.window, test.t)
+		if !start.Equal(test.start) || !end.Equal(test.end) {
+			t.Errorf("windowBounds(%q, %v) = %v, %v, want %v, %v", test.window, test.t, start, end, test.start, test.end)
+		}
+	}
+}
+
+func TestFlushDigest(t *testing.T) {
+	var mu sync.Mutex
+	var received []Digest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var digest Digest
+		if err := json.Unmarshal(body, &digest); err != nil {
+			t.Errorf("digest %s: %v", body, err)
+		}
+		mu.Lock()
+		received = append(received, digest)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	start := time.Date(2021, 3, 3, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 1)
+	earlier := start.AddDate(0, 0, -2).Add(5 * time.Hour)
+	tests := []struct {
+		name      string
+		skipEmpty bool
+		start     time.Time // Zero to catch up on earlier windows
+		events    []event
+		sent      bool
+		from      time.Time // Start of the window reported
+		changes   []DigestChange
+		left      int // Events kept for the next digest
+	}{
+		{"one change per country", false, start, []event{
+			{"Norway", 50, 45, start.Add(time.Hour)},
+			{"Japan", 30, 35, start.Add(2 * time.Hour)},
+			{"norway", 45, 40, start.Add(3 * time.Hour)},
+		}, true, start, []DigestChange{
+			{Country: "Japan", Events: 1, Before: float(30), After: float(35)},
+			{Country: "Norway", Events: 2, Before: float(50), After: float(40)},
+		}, 0},
+		{"events of the next window are kept", false, start, []event{
+			{"Norway", 50, 45, start.Add(time.Hour)},
+			{"Norway", 45, 40, end},
+		}, true, start, []DigestChange{
+			{Country: "Norway", Events: 1, Before: float(50), After: float(45)},
+		}, 1},
+		{"empty window", false, start, nil, true, start, nil, 0},
+		{"empty window skipped", true, start, []event{{"Norway", 50, 45, end.Add(time.Hour)}}, false, time.Time{}, nil, 1},
+		{"nothing to catch up on", false, time.Time{}, []event{{"Norway", 50, 45, end}}, false, time.Time{}, nil, 1},
+		{"catching up", false, time.Time{}, []event{
+			{"Norway", 50, 45, earlier},
+			{"Norway", 45, 40, start.Add(time.Hour)},
+		}, true, start.AddDate(0, 0, -2), []DigestChange{
+			{Country: "Norway", Events: 2, Before: float(50), After: float(40)},
+		}, 0},
+	}
+	for _, test := range tests {
+		d := breakerDispatcher(t)
+		hook, err := d.store.Create(db.Webhook{URL: server.URL, Field: FIELDSTRINGENCY, Country: "*", Trigger: ONCHANGE,
+			Mode: DIGEST, Window: DAILY, SkipEmpty: test.skipEmpty})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, e := range test.events {
+			payload, _ := json.Marshal(Notification{Country: e.country, Previous: float(e.previous), Value: float(e.value), Time: e.time})
+			if err := d.store.AddDigestEvent(db.DigestEvent{ID: string(rune('a' + i)), WebhookID: hook.ID, Payload: string(payload), Time: e.time}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mu.Lock()
+		received = nil
+		mu.Unlock()
+
+		d.flushDigest(hook, test.start, end)
+		d.wg.Wait() // Delivered, no workers were started
+		d.Stop()
+
+		mu.Lock()
+		digests := received
+		mu.Unlock()
+		if !test.sent {
+			if len(digests) != 0 {
+				t.Errorf("%s: sent %+v, want nothing", test.name, digests)
+			}
+		} else if len(digests) != 1 {
+			t.Errorf("%s: sent %d digests, want 1", test.name, len(digests))
+		} else {
+			digest := digests[0]
+			events := 0
+			for _, change := range test.changes {
+				events += change.Events
+			}
+			if !digest.Start.Equal(test.from) || !digest.End.Equal(end) || digest.Events != events || digest.Window != DAILY {
+				t.Errorf("%s: digest of %s from %v to %v with %d events, want %s from %v to %v with %d", test.name,
+					digest.Window, digest.Start, digest.End, digest.Events, DAILY, test.from, end, events)
+			}
+			if len(digest.Changes) != len(test.changes) {
+				t.Errorf("%s: changes %+v, want %+v", test.name, digest.Changes, test.changes)
+			}
+			for i := 0; i < len(digest.Changes) && i < len(test.changes); i++ {
+				got, want := digest.Changes[i], test.changes[i]
+				if got.Country != want.Country || got.Events != want.Events || *got.Before != *want.Before || *got.After != *want.After {
+					t.Errorf("%s: change %d = %s %d events from %v to %v, want %s %d events from %v to %v", test.name, i,
+						got.Country, got.Events, *got.Before, *got.After, want.Country, want.Events, *want.Before, *want.After)
+				}
+			}
+		}
+		if events, err := d.store.ListDigestEvents(hook.ID); err != nil || len(events) != test.left {
+			t.Errorf("%s: %d events left, %v, want %d", test.name, len(events), err, test.left)
+		}
+	}
+}
+
+func TestEncodeMode(t *testing.T) {
+	notifications := func(countries ...string) []Notification {
+		var list []Notification
+		for _, country := range countries {
+			list = append(list, Notification{Country: country, Value: float(40)})
+		}
+		return list
+	}
+	tests := []struct {
+		mode          string
+		notifications []Notification
+		want          string // Key only the expected payload has
+	}{
+		{SINGLE, notifications("Norway"), "country"},
+		{SINGLE, notifications("Norway", "Japan"), "notifications"},
+		{BATCH, notifications("Norway"), "notifications"},
+		{BATCH, notifications("Norway", "Japan"), "notifications"},
+		{DIGEST, notifications("Norway", "Japan"), "changes"},
+	}
+	for _, test := range tests {
+		hook := db.Webhook{ID: "id", Field: FIELDSTRINGENCY, Trigger: ONCHANGE, Mode: test.mode, Window: HOURLY}
+		body, err := encode(hook, test.notifications...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var payload map[string]interface{}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := payload[test.want]; !ok {
+			t.Errorf("%s of %d notifications = %s, want %q", test.mode, len(test.notifications), body, test.want)
+		}
+	}
+}
@@ -0,0 +1,683 @@
+package notify
+
+/*
+Background delivery of webhook notifications for every registration in a store
+*/
+
+import (
+	"context"
+	"covidcase/condition"
+	"covidcase/country"
+	"covidcase/db"
+	"covidcase/detect"
+	"covidcase/policy"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Fields and triggers a webhook can be registered with
+*/
+const FIELDSTRINGENCY = "stringency" // Stringency value from the policy API
+const FIELDCONFIRMED = "confirmed"   // Confirmed cases from the cases API
+const ONCHANGE = "ON_CHANGE"         // Notify only when the value differs from the last one seen
+const ONTIMEOUT = "ON_TIMEOUT"       // Notify on every interval
+const ABOVE = "ABOVE"                // Notify once when the value rises above the threshold
+const BELOW = "BELOW"                // Notify once when the value falls below the threshold
+const CROSSES = "CROSSES"            // Notify whenever the value moves to the other side of the threshold
+const CONDITION = "CONDITION"        // Notify once when the condition expression becomes true
+
+/*
+Delivery modes for webhooks watching more than one country
+*/
+const SINGLE = "single" // One notification per country, the default
+const BATCH = "batch"   // All countries that fired in one payload
+const DIGEST = "digest" // Everything that fired over a window in one summary at its end
+
+/*
+Windows a DIGEST webhook can summarise, aligned to UTC with weeks starting on Monday
+*/
+const HOURLY = "hourly"
+const DAILY = "daily"
+const WEEKLY = "weekly"
+
+const MINTIMEOUT = 10                // Lower bound in seconds for an evaluation interval
+const SENDTIMEOUT = 10 * time.Second // Time allowed for a subscriber to answer a notification
+const PRUNEINTERVAL = time.Hour      // Time between two passes removing expired delivery history
+const TRENDDAYS = 7                  // Days the stringency trend of conditions is measured over
+
+// Config struct for the tunables of a dispatcher
+type Config struct {
+	Retry             RetryPolicy
+	HistoryMaxAge     time.Duration // Delivery attempts older than this are removed from the history, 0 keeps them
+	HistoryMaxEntries int           // Delivery attempts kept per webhook, 0 keeps all
+	Allow             []*net.IPNet  // Private or reserved ranges webhooks may still be sent to
+	SMTP              SMTPConfig    // Mail server for the email channel, disabled if it has no address
+	StreamInterval    time.Duration // Time between two lookups of a country and field clients stream changes of
+	ChangeRetention   time.Duration // Changes older than this are removed from the change feed, 0 keeps them
+
+	// By field, how far a value has to move to count as changed for ON_CHANGE, the change feed and streams
+	Tolerances map[string]detect.Tolerance
+
+	// Limits per destination host, shared by every webhook sending there
+	HostConcurrency int           // Deliveries in flight at once, 0 for no limit
+	HostRate        float64       // Deliveries started per second, 0 for no limit
+	BreakerFailures int           // Consecutive failures after which deliveries stop, 0 never stops them
+	BreakerCooldown time.Duration // Time deliveries stay stopped before one is let through as a probe
+
+	// Webhooks are suspended once either is reached
+	SuspendFailures int     // Deliveries in a row that ran out of attempts, 0 never suspends for this
+	SuspendRatio    float64 // Weighted share of recent deliveries that failed, 0 never suspends for this
+}
+
+// DefaultConfig is used when no other configuration is given
+var DefaultConfig = Config{
+	Retry:             DefaultRetry,
+	HistoryMaxAge:     7 * 24 * time.Hour,
+	HistoryMaxEntries: 1000,
+	HostConcurrency:   4,
+	HostRate:          10,
+	BreakerFailures:   5,
+	BreakerCooldown:   time.Minute,
+	SuspendFailures:   20,
+	SuspendRatio:      0.9,
+	StreamInterval:    STREAMINTERVAL * time.Second,
+	ChangeRetention:   7 * 24 * time.Hour,
+}
+
+// Notification struct for JSON encoding the payload sent to a webhook URL
+type Notification struct {
+	ID        string    `json:"id"`
+	Country   string    `json:"country"`
+	Field     string    `json:"field,omitempty"`
+	Trigger   string    `json:"trigger"`
+	Threshold *float64  `json:"threshold,omitempty"`
+	Previous  *float64  `json:"previous,omitempty"` // Value seen on the evaluation before, if there was one
+	Value     *float64  `json:"value,omitempty"`    // Value of the field, left out for conditions
+	Condition string    `json:"condition,omitempty"`
+	Values    Values    `json:"values,omitempty"` // Values the condition was evaluated against
+	Test      bool      `json:"test,omitempty"`   // Sent on request to try out the receiver, not by the trigger
+	Time      time.Time `json:"time"`
+}
+
+// Batch struct for JSON encoding the payload of a BATCH webhook, one notification per country that fired
+type Batch struct {
+	ID            string         `json:"id"`
+	Trigger       string         `json:"trigger"`
+	Test          bool           `json:"test,omitempty"`
+	Time          time.Time      `json:"time"`
+	Notifications []Notification `json:"notifications"`
+}
+
+// Values maps the variables of a condition to their current values
+type Values map[string]interface{}
+
+// errStopped is returned by lookups abandoned because their worker was stopped
+var errStopped = errors.New("worker stopped")
+
+// FetchFunc returns the current value of field for a country
+type FetchFunc func(field, countryName string) (float64, error)
+
+// ExistsFunc reports whether countryName is a country the APIs have data for
+type ExistsFunc func(countryName string) (bool, error)
+
+// LookupFunc returns the current values of the condition variables in names for a country
+type LookupFunc func(countryName string, names []string) (Values, error)
+
+// Dispatcher struct for running one evaluation loop per registered webhook
+type Dispatcher struct {
+	store     db.Store
+	notifiers map[string]Notifier // By channel, only configured channels are present
+	limits    *limiter            // Rate, concurrency and circuit breaker per destination host
+	detector  *detect.Detector    // Snapshots of the values looked up, shared by ON_CHANGE, the change feed and streams
+	changes   *changes            // Numbering of the changes for the change feed and streams
+	streams   *streams            // Clients streaming changes, by country and field
+	guard     *Guard
+	client    *http.Client // Guarded like the notifiers, for probing hosts with an open breaker
+	fetch     FetchFunc
+	lookup    LookupFunc
+	exists    ExistsFunc
+	config    Config
+
+	directory *directory // Countries known to the cases API, for continents and ALLCOUNTRIES
+
+	ctx     context.Context    // Cancelled on Stop, aborts in-flight requests
+	cancel  context.CancelFunc // Cancels ctx
+	mu      sync.Mutex         // Guards workers, last and wg.Add
+	workers map[string]chan struct{}
+	last    map[string]map[string]observed // Last value seen per webhook and country, kept when a worker is replaced or paused
+	wg      sync.WaitGroup                 // Running workers and deliveries
+}
+
+// observed struct for the last value seen for a webhook, and what it was a value of
+type observed struct {
+	source string
+	value  float64
+}
+
+/*
+NewDispatcher returns a dispatcher for the webhooks in store, Start has to be called before it delivers anything
+*/
+func NewDispatcher(store db.Store, config Config) *Dispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	if config.Retry.MaxAttempts < 1 {
+		config.Retry.MaxAttempts = 1
+	}
+	guard := NewGuard(config.Allow)
+	client := guard.Client(SENDTIMEOUT)
+	notifiers := map[string]Notifier{
+		HTTP:  webhookNotifier{client: client},
+		SLACK: chatNotifier{client: client, format: slackMessage},
+		TEAMS: chatNotifier{client: client, format: teamsMessage},
+	}
+	if config.SMTP.Addr != "" {
+		notifiers[EMAIL] = emailNotifier{config: config.SMTP}
+	}
+	return &Dispatcher{
+		store:     store,
+		notifiers: notifiers,
+		limits:    newLimiter(config),
+		detector:  detect.New(config.Tolerances),
+		changes:   newChanges(),
+		streams:   newStreams(),
+		guard:     guard,
+		client:    client,
+		fetch:     FetchValue,
+		lookup:    FetchValues,
+		exists:    CountryExists,
+		directory: defaultDirectory(),
+		config:    config,
+		ctx:       ctx,
+		cancel:    cancel,
+		workers:   make(map[string]chan struct{}),
+		last:      make(map[string]map[string]observed),
+	}
+}
+
+/*
+Start launches a worker for every webhook already in the store, one keeping the delivery history in bounds
+and one probing hosts whose circuit breaker has cooled down
+*/
+func (d *Dispatcher) Start() error {
+	hooks, err := d.store.List()
+	if err != nil { // Error handling store
+		return err
+	}
+	for _, hook := range hooks {
+		d.Watch(hook)
+	}
+	d.spawn(d.prune)
+	d.spawn(d.probeHosts)
+	return nil
+}
+
+/*
+Stop halts all workers and waits for them to return, in-flight deliveries are aborted and dead-lettered
+*/
+func (d *Dispatcher) Stop() {
+	d.mu.Lock()
+	d.cancel()
+	for id, stop := range d.workers {
+		close(stop)
+		delete(d.workers, id)
+	}
+	d.mu.Unlock()
+
+	d.wg.Wait()
+}
+
+/*
+Watch starts evaluating hook, replacing any worker already running for the same id, or only stops it if hook is paused
+or suspended.
+The last value seen for the id carries over as long as hook still looks at the same value,
+so updating or resuming a webhook does not make ON_CHANGE fire.
+*/
+func (d *Dispatcher) Watch(hook db.Webhook) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.watch(hook)
+}
+
+/*
+Refresh is Watch for the webhook with the given id as it is stored right now. Reading it under the same lock as
+starting the worker means the worker ends up with the last change stored, however changes from the API and from
+deliveries interleave. It returns the error of the store, db.ErrNotFound if the webhook was removed.
+*/
+func (d *Dispatcher) Refresh(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	hook, err := d.store.Get(id)
+	if err != nil { // Error handling store
+		return err
+	}
+	d.watch(hook)
+	return nil
+}
+
+/*
+watch does the work of Watch, the caller holds mu
+*/
+func (d *Dispatcher) watch(hook db.Webhook) {
+	if d.ctx.Err() != nil { // Dispatcher is stopped
+		return
+	}
+	if stop, ok := d.workers[hook.ID]; ok {
+		close(stop)
+		delete(d.workers, hook.ID)
+	}
+	if hook.Paused || hook.Suspended != nil {
+		return
+	}
+
+	stop := make(chan struct{})
+	d.workers[hook.ID] = stop
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.run(hook, stop)
+	}()
+}
+
+/*
+Unwatch stops evaluating the webhook with the given id and forgets the last value seen for it
+*/
+func (d *Dispatcher) Unwatch(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if stop, ok := d.workers[id]; ok {
+		close(stop)
+		delete(d.workers, id)
+	}
+	delete(d.last, id)
+	d.detector.Forget("webhook/" + id + "/")
+}
+
+/*
+spawn runs f in the background unless the dispatcher is stopped, reporting whether it was started
+*/
+func (d *Dispatcher) spawn(f func()) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ctx.Err() != nil { // Dispatcher is stopped, Stop may already be waiting on wg
+		return false
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		f()
+	}()
+	return true
+}
+
+/*
+run evaluates hook every Timeout seconds until stop is closed, DIGEST webhooks also send a digest at the end of
+every window
+*/
+func (d *Dispatcher) run(hook db.Webhook, stop <-chan struct{}) {
+	interval := time.Duration(hook.Timeout * float64(time.Second))
+	if interval < MINTIMEOUT*time.Second {
+		interval = MINTIMEOUT * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Conditions are parsed once per worker, they were checked on registration
+	var cond *condition.Condition
+	if hook.Trigger == CONDITION {
+		var err error
+		if cond, err = condition.Parse(hook.Condition); err != nil {
+			fmt.Println("Webhook " + hook.ID + ": " + err.Error())
+			return
+		}
+	}
+
+	// Events left over from windows that ended while no worker was running go out in one digest first,
+	// a nil channel never fires for the other modes
+	var windowEnd <-chan time.Time
+	var start, end time.Time
+	var timer *time.Timer
+	if hook.Mode == DIGEST {
+		start, end = windowBounds(hook.Window, time.Now())
+		d.flushDigest(hook, time.Time{}, start)
+		timer = time.NewTimer(time.Until(end))
+		defer timer.Stop()
+		windowEnd = timer.C
+	}
+
+	// Observe the starting values so ON_CHANGE has something to compare against,
+	// a value already past the threshold (or a condition already true) fires right away
+	if !d.evaluate(hook, cond, stop, true) {
+		return
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-windowEnd:
+			d.flushDigest(hook, start, end)
+			start, end = windowBounds(hook.Window, end)
+			timer.Reset(time.Until(end))
+			continue
+		case <-ticker.C:
+		}
+
+		if !d.evaluate(hook, cond, stop, false) {
+			return
+		}
+	}
+}
+
+/*
+evaluate looks up the current value for every country of hook and dispatches notifications for those whose trigger
+fires, one per country, all in one batch or held back for the next digest. It returns false if the worker was stopped in the meantime.
+A condition counts as the value 1 while it holds and 0 otherwise.
+The initial evaluation skips countries a previous worker has already seen, and ON_TIMEOUT holds off
+until the first interval has passed.
+*/
+func (d *Dispatcher) evaluate(hook db.Webhook, cond *condition.Condition, stop <-chan struct{}, initial bool) bool {
+	var countries []string
+	err := d.call(hook, stop, func() error {
+		var err error
+		countries, err = d.countries(hook)
+		return err
+	})
+	if err == errStopped {
+		return false
+	}
+	if err != nil { // Error handling country directory, try again next interval
+		fmt.Println("Webhook " + hook.ID + ": " + err.Error())
+		return true
+	}
+
+	var fired []Notification
+	for _, countryName := range countries {
+		if initial && d.seen(hook, countryName) {
+			continue
+		}
+
+		var notification Notification
+		var value float64
+		err := d.call(hook, stop, func() error {
+			var err error
+			notification, value, err = d.read(hook, cond, countryName)
+			return err
+		})
+		if err == errStopped {
+			return false
+		}
+		if err != nil { // Error handling lookup, the other countries go ahead
+			fmt.Println("Webhook " + hook.ID + ": " + countryName + ": " + err.Error())
+			continue
+		}
+		if cond == nil { // Every value looked up feeds the change feed and streams, whether the trigger fires or not
+			d.sample(hook.Field, countryName, value)
+		}
+
+		previous, seen := d.observe(hook, countryName, value)
+		if initial && hook.Trigger == ONTIMEOUT {
+			continue
+		}
+		if hook.Trigger == ONCHANGE {
+			// Revisions within the tolerance of the field do not count, the change is measured from the value
+			// last notified of rather than the one seen last
+			change, changed := d.detector.Observe(webhookKey(hook, countryName), hook.Field, value, time.Now().UTC())
+			if changed {
+				notification.Previous = &change.Previous
+				fired = append(fired, notification)
+			}
+			continue
+		}
+		if Fires(hook, previous, seen, value) {
+			if seen && cond == nil {
+				notification.Previous = &previous
+			}
+			fired = append(fired, notification)
+		}
+	}
+
+	if len(fired) == 0 {
+		return true
+	}
+	if hook.Mode == DIGEST {
+		d.hold(hook, fired...)
+		return true
+	}
+	if hook.Mode == BATCH {
+		d.dispatch(hook, fired...)
+		return true
+	}
+	for _, notification := range fired {
+		d.dispatch(hook, notification)
+	}
+	return true
+}
+
+/*
+read looks up the current value for hook in one country, returning it along with a notification carrying it
+*/
+func (d *Dispatcher) read(hook db.Webhook, cond *condition.Condition, countryName string) (Notification, float64, error) {
+	notification := Notification{Country: countryName}
+	if cond == nil {
+		value, err := d.fetch(hook.Field, countryName)
+		notification.Value = &value
+		return notification, value, err
+	}
+
+	values, err := d.lookup(countryName, cond.Names())
+	if err != nil {
+		return notification, 0, err
+	}
+	holds, err := cond.Eval(values)
+	if err != nil {
+		return notification, 0, err
+	}
+	notification.Condition = cond.String()
+	notification.Values = values
+	if holds {
+		return notification, 1, nil
+	}
+	return notification, 0, nil
+}
+
+/*
+seen reports whether a value has been observed for hook in a country
+*/
+func (d *Dispatcher) seen(hook db.Webhook, countryName string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	last, ok := d.last[hook.ID][strings.ToLower(countryName)]
+	return ok && last.source == source(hook)
+}
+
+/*
+observe records value as the last one seen for hook in a country and returns the one seen before, if any.
+A value seen before the webhook was changed to look at something else does not count.
+*/
+func (d *Dispatcher) observe(hook db.Webhook, countryName string, value float64) (float64, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.last[hook.ID] == nil {
+		d.last[hook.ID] = make(map[string]observed)
+	}
+	key := strings.ToLower(countryName)
+	last, ok := d.last[hook.ID][key]
+	d.last[hook.ID][key] = observed{source: source(hook), value: value}
+	return last.value, ok && last.source == source(hook)
+}
+
+/*
+source identifies the value a webhook looks at in each country, a condition counts as a value of its own
+*/
+func source(hook db.Webhook) string {
+	if hook.Trigger == CONDITION {
+		return hook.Condition
+	}
+	return hook.Field
+}
+
+/*
+call runs the lookup f for hook, turning panics from malformed API data into errors.
+The API clients have no way to be cancelled, so the lookup is left behind with errStopped if stop closes first.
+*/
+func (d *Dispatcher) call(hook db.Webhook, stop <-chan struct{}, f func() error) error {
+	done := make(chan error, 1) // Buffered so an abandoned lookup can still finish
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("could not read values for webhook %s: %v", hook.ID, r)
+			}
+		}()
+		done <- f()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-stop:
+		return errStopped
+	case <-d.ctx.Done():
+		return errStopped
+	}
+}
+
+/*
+dispatch completes notifications with the details of hook and hands them to a background delivery as one payload,
+so retries never hold up evaluation. More than one notification, or any for a BATCH webhook, are sent as a batch.
+*/
+func (d *Dispatcher) dispatch(hook db.Webhook, notifications ...Notification) {
+	body, err := encode(hook, notifications...)
+	if err != nil { // Error handling encoding
+		fmt.Println("Webhook " + hook.ID + ": " + err.Error())
+		return
+	}
+	d.queue(hook, body)
+}
+
+/*
+queue hands an encoded payload for hook to a background delivery
+*/
+func (d *Dispatcher) queue(hook db.Webhook, body []byte) {
+	id, err := db.NewID()
+	if err != nil { // Error handling id generation
+		fmt.Println("Webhook " + hook.ID + ": " + err.Error())
+		return
+	}
+	delivery := db.Delivery{ID: id, WebhookID: hook.ID, Payload: string(body), Created: time.Now().UTC()}
+	d.spawn(func() { d.deliver(hook, delivery) })
+}
+
+/*
+encode completes notifications with the details of hook and returns the payload as JSON,
+a single notification on its own unless hook is in BATCH mode, or a digest of the current window in DIGEST mode.
+A single notification is rendered with the payload template of hook instead if it has one.
+*/
+func encode(hook db.Webhook, notifications ...Notification) ([]byte, error) {
+	now := time.Now().UTC()
+	complete(hook, notifications, now)
+	if hook.Template != "" && hook.Mode != BATCH && hook.Mode != DIGEST && len(notifications) == 1 {
+		return render(hook, notifications[0])
+	}
+	if hook.Mode == DIGEST {
+		start, end := windowBounds(hook.Window, now)
+		return json.Marshal(summarise(hook, notifications, start, end))
+	}
+	if hook.Mode != BATCH && len(notifications) == 1 {
+		return json.Marshal(notifications[0])
+	}
+	batch := Batch{ID: hook.ID, Trigger: hook.Trigger, Test: notifications[0].Test, Time: now, Notifications: notifications}
+	return json.Marshal(batch)
+}
+
+/*
+complete fills in the details of hook and the time now on every notification
+*/
+func complete(hook db.Webhook, notifications []Notification, now time.Time) {
+	for i := range notifications {
+		notifications[i].ID = hook.ID
+		notifications[i].Field = hook.Field
+		notifications[i].Trigger = hook.Trigger
+		notifications[i].Threshold = hook.Threshold
+		notifications[i].Time = now
+	}
+}
+
+/*
+FetchValue returns the current value of field for a country from the policy or cases API
+*/
+func FetchValue(field, countryName string) (float64, error) {
+	switch field {
+	case FIELDSTRINGENCY:
+		info, err := policy.GetPolicyData("", "", countryName)
+		return info.Stringency, err
+	case FIELDCONFIRMED:
+		info, err := country.GetCountryData("", "", countryName)
+		return info.Confirmed, err
+	default:
+		return 0, errors.New("unknown field " + field)
+	}
+}
+
+/*
+CountryExists reports whether the cases API has data for a country
+*/
+func CountryExists(countryName string) (bool, error) {
+	return country.Exists(normalize(countryName))
+}
+
+/*
+FetchValues returns the current values of the condition variables in names for a country,
+calling each API only if one of its variables is needed
+*/
+func FetchValues(countryName string, names []string) (Values, error) {
+	values := make(Values)
+
+	var policies, cases bool
+	for _, name := range names {
+		switch name {
+		case "stringency", "trend":
+			policies = true
+		default:
+			cases = true
+		}
+	}
+
+	if policies {
+		// The trend is how the latest stringency moved over the week before it
+		end := time.Now().AddDate(0, 0, -policy.LATESTLAG)
+		start := end.AddDate(0, 0, -TRENDDAYS)
+		info, err := policy.GetPolicyData(start.Format("2006-01-02"), end.Format("2006-01-02"), countryName)
+		if err != nil { // Error handling policy API
+			return nil, err
+		}
+		if info.Stringency == -1 { // Error handling missing data, the condition is evaluated next time instead
+			return nil, errors.New("no stringency for " + countryName + " on " + end.Format("2006-01-02"))
+		}
+		values["stringency"] = info.Stringency
+		values["trend"] = info.Trend
+	}
+	if cases {
+		info, err := country.GetCountryData("", "", countryName)
+		if err != nil { // Error handling cases API
+			return nil, err
+		}
+		values["confirmed"] = info.Confirmed
+		values["recovered"] = info.Recovered
+		values["continent"] = info.Continent
+		// The cases API hands out the percentage formatted for display
+		percentage, err := strconv.ParseFloat(info.PopulationPercentage, 64)
+		if err != nil {
+			return nil, err
+		}
+		values["population_percentage"] = percentage
+	}
+	return values, nil
+}
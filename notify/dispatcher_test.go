@@ -0,0 +1,77 @@
+package notify
+
+import (
+	"covidcase/condition"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// policyTransport struct for answering the policy APIs with the stringency of Norway on the first and last day of
+// any date range asked for, -1 to leave a day without one
+type policyTransport struct {
+	start, end float64
+}
+
+func (p policyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	body := `[{"alpha3Code": "NOR", "region": "Europe"}]`
+	if strings.Contains(r.URL.Path, "/date-range/") {
+		parts := strings.Split(strings.TrimSuffix(r.URL.Path, "/"), "/")
+		start, end := parts[len(parts)-2], parts[len(parts)-1]
+		body = fmt.Sprintf(`{"data": {%q: {"NOR": %s}, %q: {"NOR": %s}}}`, start, stringency(p.start), end, stringency(p.end))
+	}
+	return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Header: make(http.Header),
+		Body: ioutil.NopCloser(strings.NewReader(body)), Request: r}, nil
+}
+
+// stringency returns the policy API entry of one country on one day
+func stringency(value float64) string {
+	if value == -1 {
+		return `{"confirmed": 1}`
+	}
+	return fmt.Sprintf(`{"stringency_actual": %v}`, value)
+}
+
+func TestFetchValuesTrend(t *testing.T) {
+	transport := http.DefaultClient.Transport
+	defer func() { http.DefaultClient.Transport = transport }()
+
+	cond, err := condition.Parse("stringency < 40 && trend < 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		start, end float64
+		trend      float64
+		holds      bool
+		err        string // Part of the error message, empty if none is expected
+	}{
+		{"easing", 50, 35, -15, true, ""},
+		{"tightening", 30, 35, 5, false, ""},
+		{"no value a week before", -1, 35, 0, false, ""},
+		{"no latest value", 50, -1, 0, false, "no stringency for Norway"},
+	}
+	for _, test := range tests {
+		http.DefaultClient.Transport = policyTransport{test.start, test.end}
+		values, err := FetchValues("Norway", cond.Names())
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: FetchValues = %v, %v, want error containing %q", test.name, values, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: FetchValues: %v", test.name, err)
+			continue
+		}
+		if values["stringency"] != test.end || values["trend"] != test.trend {
+			t.Errorf("%s: values = %v, want stringency %v and trend %v", test.name, values, test.end, test.trend)
+		}
+		if holds, err := cond.Eval(values); err != nil || holds != test.holds {
+			t.Errorf("%s: %s = %v, %v, want %v", test.name, cond, holds, err, test.holds)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const MAXREDIRECTS = 5 // Redirects followed for one notification before giving up
+
+/*
+Address ranges webhooks may not be sent to unless allowlisted, on top of loopback, link-local,
+multicast and unspecified addresses which net.IP reports itself
+*/
+var blockedNets = parseNets(
+	"0.0.0.0/8",       // "This" network
+	"10.0.0.0/8",      // Private
+	"100.64.0.0/10",   // Carrier-grade NAT
+	"172.16.0.0/12",   // Private
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // Documentation
+	"192.168.0.0/16",  // Private
+	"198.18.0.0/15",   // Benchmarking
+	"198.51.100.0/24", // Documentation
+	"203.0.113.0/24",  // Documentation
+	"240.0.0.0/4",     // Reserved, including broadcast
+	"64:ff9b::/96",    // NAT64, could reach IPv4 addresses blocked above
+	"64:ff9b:1::/48",  // Local-use NAT64
+	"100::/64",        // Discard-only
+	"2001:db8::/32",   // Documentation
+	"fc00::/7",        // Unique local
+)
+
+// Guard struct for keeping webhook requests away from internal addresses
+type Guard struct {
+	allow  []*net.IPNet                                                 // Ranges let through even though they are blocked
+	lookup func(ctx context.Context, host string) ([]net.IPAddr, error) // Resolves hosts of registered URLs
+}
+
+/*
+NewGuard returns a guard blocking internal addresses except those within allow
+*/
+func NewGuard(allow []*net.IPNet) *Guard {
+	return &Guard{allow: allow, lookup: net.DefaultResolver.LookupIPAddr}
+}
+
+/*
+ParseAllowList parses a comma separated list of IP addresses and CIDR ranges, e.g. "127.0.0.1,10.1.0.0/16"
+*/
+func ParseAllowList(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") { // Single address
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, errors.New("invalid address " + entry)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, errors.New("invalid range " + entry)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+/*
+Allowed reports whether webhook requests may go to ip
+*/
+func (g *Guard) Allowed(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil { // Also catches IPv4-mapped IPv6 addresses
+		ip = v4
+	}
+	for _, ipNet := range g.allow {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, ipNet := range blockedNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+CheckURL returns an error if raw is not an http(s) URL whose host resolves to allowed addresses only.
+This only catches bad registrations early, the host could resolve differently by the time a notification is sent,
+which is why every connection is checked again as it is dialled.
+*/
+func (g *Guard) CheckURL(ctx context.Context, raw string) error {
+	target, err := url.Parse(raw)
+	if err != nil {
+		return errors.New("url is malformed")
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return errors.New("url must be http or https")
+	}
+	if target.User != nil {
+		return errors.New("url must not contain credentials")
+	}
+	host := target.Hostname()
+	if host == "" {
+		return errors.New("url has no host")
+	}
+
+	// Literal addresses need no lookup
+	if ip := net.ParseIP(host); ip != nil {
+		if !g.Allowed(ip) {
+			return errors.New("url points to a private or reserved address")
+		}
+		return nil
+	}
+	addrs, err := g.lookup(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return errors.New("url host " + host + " could not be resolved")
+	}
+	for _, addr := range addrs {
+		if !g.Allowed(addr.IP) {
+			return fmt.Errorf("url host %s resolves to a private or reserved address", host)
+		}
+	}
+	return nil
+}
+
+/*
+Client returns an HTTP client that refuses to connect to addresses the guard does not allow.
+The check runs on the address actually dialled, after DNS resolution, so it holds for rebinding hosts and every
+redirect as well. Proxies from the environment are ignored since they would hide the real destination.
+*/
+func (g *Guard) Client(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: g.control}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= MAXREDIRECTS {
+				return fmt.Errorf("stopped after %d redirects", MAXREDIRECTS)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return errors.New("redirect to non-http url " + req.URL.String())
+			}
+			return nil
+		},
+	}
+}
+
+/*
+control is run on every connection right before it is made, refusing addresses the guard does not allow
+*/
+func (g *Guard) control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !g.Allowed(ip) {
+		return errors.New("connection to " + address + " blocked, private or reserved address")
+	}
+	return nil
+}
+
+// parseNets parses CIDR ranges known to be valid
+func parseNets(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = ipNet
+	}
+	return nets
+}
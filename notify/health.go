@@ -0,0 +1,74 @@
+package notify
+
+import (
+	"covidcase/db"
+	"fmt"
+	"time"
+)
+
+const HEALTHWEIGHT = 0.1 // Weight of the latest delivery in the health score, the rest goes to the ones before
+const MINDELIVERIES = 10 // Deliveries needed before a webhook can be suspended for its failure ratio
+
+/*
+track records the outcome of a delivery in the health of the webhook with the given id,
+and suspends it if it has been failing for too long. Only the health and suspension are changed, in one step
+with reading them, so settings changed through the API in the meantime are kept.
+*/
+func (d *Dispatcher) track(id string, success bool) {
+	now := time.Now().UTC()
+	suspended := false
+	hook, err := d.store.Modify(id, func(hook *db.Webhook) error {
+		health := db.Health{Score: 1}
+		if hook.Health != nil {
+			health = *hook.Health
+		}
+
+		health.Deliveries++
+		health.Score *= 1 - HEALTHWEIGHT
+		if success {
+			health.Score += HEALTHWEIGHT
+			health.ConsecutiveFailures = 0
+			health.LastSuccess = &now
+		} else {
+			health.Failures++
+			health.ConsecutiveFailures++
+			health.LastFailure = &now
+		}
+		hook.Health = &health
+
+		suspended = false // Modify may run this more than once
+		if hook.Suspended == nil {
+			if reason := d.suspension(health); reason != "" {
+				hook.Suspended = &db.Suspension{Reason: reason, Time: now}
+				suspended = true
+			}
+		}
+		return nil
+	})
+	if err != nil { // Error handling store, the webhook may have been removed in the meantime
+		if err != db.ErrNotFound {
+			fmt.Println("Webhook " + id + ": could not record health: " + err.Error())
+		}
+		return
+	}
+	if suspended {
+		fmt.Println("Webhook " + id + ": suspended, " + hook.Suspended.Reason)
+		// Stops the worker, unless the webhook was reactivated since
+		if err := d.Refresh(id); err != nil && err != db.ErrNotFound {
+			fmt.Println("Webhook " + id + ": " + err.Error())
+		}
+	}
+}
+
+/*
+suspension returns why a webhook in the given health should be suspended, or an empty string if it should not
+*/
+func (d *Dispatcher) suspension(health db.Health) string {
+	if d.config.SuspendFailures > 0 && health.ConsecutiveFailures >= d.config.SuspendFailures {
+		return fmt.Sprintf("%d deliveries in a row failed", health.ConsecutiveFailures)
+	}
+	if d.config.SuspendRatio > 0 && health.Deliveries >= MINDELIVERIES && 1-health.Score >= d.config.SuspendRatio {
+		return fmt.Sprintf("%.0f%% of recent deliveries failed", 100*(1-health.Score))
+	}
+	return ""
+}
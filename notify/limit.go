@@ -0,0 +1,374 @@
+package notify
+
+import (
+	"context"
+	"covidcase/db"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+States of the circuit breaker of a destination host
+*/
+const CLOSED = "closed"         // Deliveries go through
+const OPEN = "open"             // Deliveries fail right away until the cooldown has passed
+const HALFOPEN = "half_open"    // One delivery is let through to probe the host, the rest fail right away
+const HOSTIDLE = 24 * time.Hour // Hosts with a closed breaker and no deliveries for this long are forgotten
+const PROBETICK = time.Second   // Time between two checks for breakers whose cooldown has passed
+
+// Refusals of an open or half open breaker, the host was never contacted so they do not count against webhooks
+var errBreakerOpen = errors.New("paused, circuit breaker is open after repeated failures")
+var errBreakerProbing = errors.New("paused, circuit breaker is waiting for a probe")
+
+// HostStatus struct for JSON encoding the state of deliveries to one destination host
+type HostStatus struct {
+	Host      string     `json:"host"`
+	State     string     `json:"state"`
+	Failures  int        `json:"failures"` // Consecutive failures, reset by a success
+	InFlight  int        `json:"in_flight"`
+	OpenedAt  *time.Time `json:"opened_at,omitempty"` // When the breaker last opened, while it is not closed
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// limiter struct for the rate, concurrency and circuit breaker limits of every destination host
+type limiter struct {
+	config Config
+	mu     sync.Mutex
+	hosts  map[string]*host
+}
+
+// host struct for the limits of one destination, guarded by the mutex of its limiter
+type host struct {
+	slots     chan struct{} // Holds a value per delivery in flight, nil without a concurrency limit
+	tokens    float64       // Requests that may start right away, refilled at the configured rate
+	refilled  time.Time
+	state     string
+	failures  int
+	openedAt  time.Time
+	probing   bool   // A probe is in flight while half open
+	target    string // Root URL of the host, requested to probe it once the cooldown has passed
+	inFlight  int
+	lastError string
+	used      time.Time // Last time a delivery started
+}
+
+/*
+newLimiter returns a limiter applying the host limits in config
+*/
+func newLimiter(config Config) *limiter {
+	return &limiter{config: config, hosts: make(map[string]*host)}
+}
+
+/*
+destination returns the host notifications for hook go to, or an empty string if they are not limited per host
+*/
+func destination(hook db.Webhook) string {
+	if hook.Channel == EMAIL { // Mail goes through the one server of the dispatcher
+		return ""
+	}
+	target, err := url.Parse(hook.URL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(target.Host)
+}
+
+/*
+root returns the URL requested to probe the host of hook, its scheme and host without a path
+*/
+func root(hook db.Webhook) string {
+	target, err := url.Parse(hook.URL)
+	if err != nil {
+		return ""
+	}
+	return (&url.URL{Scheme: target.Scheme, Host: target.Host, Path: "/"}).String()
+}
+
+/*
+acquire waits until a delivery to name may start, returning a function to call with its outcome once it is done.
+It fails right away if the breaker of the host is open, or if ctx is done while waiting.
+target is remembered to probe the host with once its breaker has cooled down.
+*/
+func (l *limiter) acquire(ctx context.Context, name, target string) (func(error, Receipt), error) {
+	l.mu.Lock()
+	h, ok := l.hosts[name]
+	if !ok {
+		h = &host{state: CLOSED, tokens: l.burst(), refilled: time.Now()}
+		if l.config.HostConcurrency > 0 {
+			h.slots = make(chan struct{}, l.config.HostConcurrency)
+		}
+		l.hosts[name] = h
+	}
+	probe, err := l.admit(h, time.Now())
+	h.used = time.Now()
+	h.target = target
+	l.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("delivery to %s %w", name, err)
+	}
+
+	// Wait for a free slot, then for a token
+	if h.slots != nil {
+		select {
+		case h.slots <- struct{}{}:
+		case <-ctx.Done():
+			l.abandon(h, probe)
+			return nil, ctx.Err()
+		}
+	}
+	for {
+		l.mu.Lock()
+		wait := l.reserve(h, time.Now())
+		if wait <= 0 {
+			h.inFlight++
+			l.mu.Unlock()
+			break
+		}
+		l.mu.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			if h.slots != nil {
+				<-h.slots
+			}
+			l.abandon(h, probe)
+			return nil, ctx.Err()
+		}
+	}
+
+	return func(err error, receipt Receipt) {
+		if h.slots != nil {
+			<-h.slots
+		}
+		l.report(h, probe, err, receipt)
+	}, nil
+}
+
+/*
+admit checks the breaker of h, reporting whether the delivery is the probe of a half open breaker
+*/
+func (l *limiter) admit(h *host, now time.Time) (bool, error) {
+	switch h.state {
+	case OPEN:
+		if now.Sub(h.openedAt) < l.config.BreakerCooldown {
+			return false, errBreakerOpen
+		}
+		h.state = HALFOPEN
+		fallthrough
+	case HALFOPEN:
+		if h.probing {
+			return false, errBreakerProbing
+		}
+		h.probing = true
+		return true, nil
+	}
+	return false, nil
+}
+
+/*
+reserve takes a token from h if one is left, otherwise it returns how long until the next one
+*/
+func (l *limiter) reserve(h *host, now time.Time) time.Duration {
+	if l.config.HostRate <= 0 {
+		return 0
+	}
+	h.tokens += now.Sub(h.refilled).Seconds() * l.config.HostRate
+	if h.tokens > l.burst() {
+		h.tokens = l.burst()
+	}
+	h.refilled = now
+	if h.tokens >= 1 {
+		h.tokens--
+		return 0
+	}
+	return time.Duration((1 - h.tokens) / l.config.HostRate * float64(time.Second))
+}
+
+/*
+report records the outcome of a delivery to h. Refusals other than 429 and 5xx responses are the fault of the
+registration rather than the host, and do not count as failures.
+*/
+func (l *limiter) report(h *host, probe bool, err error, receipt Receipt) {
+	failed := err != nil && (receipt.StatusCode == 0 || receipt.StatusCode == 429 || receipt.StatusCode >= 500)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h.inFlight--
+	if probe {
+		h.probing = false
+	}
+	if !failed {
+		h.state = CLOSED
+		h.failures = 0
+		h.lastError = ""
+		return
+	}
+	h.failures++
+	h.lastError = err.Error()
+	// A failed probe opens the breaker for another cooldown
+	if probe || (l.config.BreakerFailures > 0 && h.failures >= l.config.BreakerFailures && h.state == CLOSED) {
+		h.state = OPEN
+		h.openedAt = time.Now()
+	}
+}
+
+/*
+abandon gives up the probe of a delivery that never started
+*/
+func (l *limiter) abandon(h *host, probe bool) {
+	if !probe {
+		return
+	}
+	l.mu.Lock()
+	h.probing = false
+	l.mu.Unlock()
+}
+
+/*
+release gives up a timed probe of h without an outcome, leaving the breaker open to be probed on the next tick
+*/
+func (l *limiter) release(h *host) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h.inFlight--
+	h.probing = false
+	h.state = OPEN
+}
+
+/*
+refused reports whether err is a breaker refusing a delivery, rather than the host failing it
+*/
+func refused(err error) bool {
+	return errors.Is(err, errBreakerOpen) || errors.Is(err, errBreakerProbing)
+}
+
+/*
+due moves the breakers whose cooldown has passed to half open and returns their hosts by name, each with a probe
+in flight that has to be reported once done
+*/
+func (l *limiter) due(now time.Time) map[string]*host {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	hosts := make(map[string]*host)
+	for name, h := range l.hosts {
+		if h.state != OPEN || h.target == "" {
+			continue
+		}
+		if probe, err := l.admit(h, now); err == nil && probe {
+			h.inFlight++
+			hosts[name] = h
+		}
+	}
+	return hosts
+}
+
+/*
+probeHosts probes every host whose breaker has cooled down every PROBETICK until the dispatcher stops,
+so deliveries resume without waiting for one to come along
+*/
+func (d *Dispatcher) probeHosts() {
+	ticker := time.NewTicker(PROBETICK)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for name, h := range d.limits.due(time.Now()) {
+			name, h := name, h
+			if !d.spawn(func() { d.probeHost(name, h) }) { // Dispatcher is stopped
+				d.limits.release(h)
+			}
+		}
+	}
+}
+
+/*
+probeHost sends a HEAD request to the root of h, any answer but 429 or 5xx closes its breaker and anything else
+opens it for another cooldown
+*/
+func (d *Dispatcher) probeHost(name string, h *host) {
+	ctx, cancel := context.WithTimeout(d.ctx, SENDTIMEOUT)
+	defer cancel()
+	d.limits.mu.Lock()
+	target := h.target
+	d.limits.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, target, nil)
+	if err != nil { // Error handling malformed URL, not the fault of the host
+		d.limits.release(h)
+		return
+	}
+	receipt, err := receive(d.client.Do(req))
+	if d.ctx.Err() != nil { // Shutting down, the probe tells nothing about the host
+		d.limits.release(h)
+		return
+	}
+	if err != nil && receipt.StatusCode != 0 && receipt.StatusCode != 429 && receipt.StatusCode < 500 {
+		err = nil // The host answered, whatever it thinks of HEAD requests to its root
+	}
+	if err != nil {
+		fmt.Println("Probe of " + name + " failed: " + err.Error())
+	}
+	d.limits.report(h, true, err, receipt)
+}
+
+/*
+burst returns the number of requests to a host that may start at once after a quiet period
+*/
+func (l *limiter) burst() float64 {
+	if l.config.HostRate < 1 {
+		return 1
+	}
+	return l.config.HostRate
+}
+
+/*
+forget removes hosts with a closed breaker and nothing in flight that have not been used since before
+*/
+func (l *limiter) forget(before time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for name, h := range l.hosts {
+		if h.state == CLOSED && h.inFlight == 0 && h.used.Before(before) {
+			delete(l.hosts, name)
+		}
+	}
+}
+
+/*
+Hosts returns the state of deliveries to every destination host seen lately, sorted by host
+*/
+func (d *Dispatcher) Hosts() []HostStatus {
+	l := d.limits
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	statuses := []HostStatus{}
+	for name, h := range l.hosts {
+		status := HostStatus{Host: name, State: h.state, Failures: h.failures, InFlight: h.inFlight, LastError: h.lastError}
+		// A breaker due for a probe is reported as such, until the next probe tick changes its state
+		if h.state == OPEN && time.Since(h.openedAt) >= l.config.BreakerCooldown {
+			status.State = HALFOPEN
+		}
+		if h.state != CLOSED {
+			openedAt := h.openedAt
+			status.OpenedAt = &openedAt
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Host < statuses[j].Host
+	})
+	return statuses
+}
@@ -0,0 +1,189 @@
+package notify
+
+import (
+	"context"
+	"covidcase/db"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// breakerDispatcher returns a dispatcher allowed to deliver to loopback, opening breakers after two failures.
+// It has to be stopped once the test is done
+func breakerDispatcher(t *testing.T) *Dispatcher {
+	t.Helper()
+	allow, err := ParseAllowList("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig
+	config.Allow = allow
+	config.BreakerFailures = 2
+	config.BreakerCooldown = 50 * time.Millisecond
+	return NewDispatcher(db.NewMemoryStore(), config)
+}
+
+// state returns the breaker state of name as shown on /diag
+func state(d *Dispatcher, name string) string {
+	for _, status := range d.Hosts() {
+		if status.Host == name {
+			return status.State
+		}
+	}
+	return ""
+}
+
+func TestBreakerProbesOnItsOwn(t *testing.T) {
+	var heads int32
+	down := int32(1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			atomic.AddInt32(&heads, 1)
+		}
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	d := breakerDispatcher(t)
+	defer d.Stop()
+	hook := db.Webhook{ID: "abc", URL: server.URL + "/hook"}
+	name := destination(hook)
+
+	for i := 0; i < 2; i++ {
+		if _, err := d.post(hook, `{}`); err == nil {
+			t.Fatal("delivery to a failing host succeeded")
+		}
+	}
+	if got := state(d, name); got != OPEN {
+		t.Fatalf("state = %q after two failures, want %q", got, OPEN)
+	}
+	_, err := d.post(hook, `{}`)
+	if !refused(err) {
+		t.Fatalf("delivery with an open breaker = %v, want a refusal", err)
+	}
+
+	// A probe while the host is still down opens the breaker for another cooldown
+	time.Sleep(60 * time.Millisecond)
+	for name, h := range d.limits.due(time.Now()) {
+		d.probeHost(name, h)
+	}
+	if atomic.LoadInt32(&heads) != 1 || state(d, name) != OPEN {
+		t.Fatalf("after a failed probe: %d probes, state %q, want 1 and %q", heads, state(d, name), OPEN)
+	}
+
+	// Once the host is back, a probe closes the breaker without any delivery coming along
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(60 * time.Millisecond)
+	for name, h := range d.limits.due(time.Now()) {
+		d.probeHost(name, h)
+	}
+	if atomic.LoadInt32(&heads) != 2 || state(d, name) != CLOSED {
+		t.Fatalf("after a successful probe: %d probes, state %q, want 2 and %q", heads, state(d, name), CLOSED)
+	}
+	if _, err := d.post(hook, `{}`); err != nil {
+		t.Fatalf("delivery after the breaker closed: %v", err)
+	}
+}
+
+func TestBreakerProbeLoop(t *testing.T) {
+	var heads int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			atomic.AddInt32(&heads, 1)
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+	d := breakerDispatcher(t)
+	defer d.Stop()
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	hook := db.Webhook{ID: "abc", URL: server.URL + "/hook"}
+
+	d.post(hook, `{}`)
+	d.post(hook, `{}`)
+	deadline := time.Now().Add(3 * PROBETICK)
+	for state(d, destination(hook)) != CLOSED {
+		if time.Now().After(deadline) {
+			t.Fatalf("breaker still %q after %v", state(d, destination(hook)), 3*PROBETICK)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&heads) == 0 {
+		t.Error("breaker closed without a probe")
+	}
+}
+
+func TestRefusalsDoNotCountAgainstHealth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	d := breakerDispatcher(t)
+	defer d.Stop()
+	d.config.Retry = RetryPolicy{MaxAttempts: 1}
+	d.config.SuspendFailures = 3
+	d.limits.config.BreakerCooldown = time.Hour // No probe in between
+	hook, err := d.store.Create(db.Webhook{URL: server.URL + "/hook"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two deliveries reach the host and open its breaker, the rest are refused without contacting it
+	for i := 0; i < 5; i++ {
+		d.deliver(hook, db.Delivery{ID: "d" + string(rune('0'+i)), WebhookID: hook.ID, Payload: `{}`})
+	}
+	stored, err := d.store.Get(hook.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Health == nil || stored.Health.Deliveries != 2 || stored.Health.ConsecutiveFailures != 2 {
+		t.Errorf("health = %+v, want the 2 deliveries that reached the host", stored.Health)
+	}
+	if stored.Suspended != nil {
+		t.Errorf("suspended for refusals of the breaker: %s", stored.Suspended.Reason)
+	}
+	history, _ := d.store.ListHistory(hook.ID)
+	refusals := 0
+	for _, entry := range history {
+		if strings.Contains(entry.Error, errBreakerOpen.Error()) {
+			refusals++
+		}
+	}
+	if refusals != 3 {
+		t.Errorf("%d refusals in the history, want 3 still recorded", refusals)
+	}
+}
+
+func TestReleaseKeepsBreakerOpen(t *testing.T) {
+	d := breakerDispatcher(t)
+	defer d.Stop()
+	l := d.limits
+	done, err := l.acquire(context.Background(), "example.com", "https://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done(errors.New("refused"), Receipt{})
+	done, _ = l.acquire(context.Background(), "example.com", "https://example.com/")
+	done(errors.New("refused"), Receipt{})
+
+	time.Sleep(60 * time.Millisecond)
+	due := l.due(time.Now())
+	if len(due) != 1 {
+		t.Fatalf("%d hosts due for a probe, want 1", len(due))
+	}
+	l.release(due["example.com"])
+	if got := state(d, "example.com"); got != HALFOPEN { // Open past its cooldown, shown as due for a probe
+		t.Errorf("state = %q after a released probe, want it due again", got)
+	}
+	if len(l.due(time.Now())) != 1 {
+		t.Error("released host is not probed again")
+	}
+}
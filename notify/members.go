@@ -0,0 +1,91 @@
+package notify
+
+import (
+	"covidcase/country"
+	"covidcase/db"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ALLCOUNTRIES = "*"            // Country watching every country the cases API knows
+const DIRECTORYTTL = 24 * time.Hour // Time the list of countries is reused before it is fetched again
+
+// Continents a webhook can watch, as named by the cases API
+var CONTINENTS = []string{"Africa", "Asia", "Europe", "North America", "Oceania", "South America"}
+
+// DirectoryFunc returns the continent of every known country, keyed by country name
+type DirectoryFunc func() (map[string]string, error)
+
+// directory struct for caching the list of known countries
+type directory struct {
+	mu      sync.Mutex
+	fetch   DirectoryFunc
+	entries map[string]string
+	fetched time.Time
+}
+
+/*
+get returns the known countries, fetching them again once DIRECTORYTTL has passed.
+A stale list is kept in use if fetching a fresh one fails.
+*/
+func (dir *directory) get() (map[string]string, error) {
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	if dir.entries != nil && time.Since(dir.fetched) < DIRECTORYTTL {
+		return dir.entries, nil
+	}
+	entries, err := dir.fetch()
+	if err != nil {
+		if dir.entries != nil {
+			return dir.entries, nil
+		}
+		return nil, err
+	}
+	dir.entries, dir.fetched = entries, time.Now()
+	return entries, nil
+}
+
+/*
+countries returns the countries hook watches: its list of countries, every country on its continent,
+every country for ALLCOUNTRIES, or else its single country
+*/
+func (d *Dispatcher) countries(hook db.Webhook) ([]string, error) {
+	if len(hook.Countries) > 0 {
+		countries := make([]string, len(hook.Countries))
+		for i, countryName := range hook.Countries {
+			countries[i] = normalize(countryName)
+		}
+		return countries, nil
+	}
+	if hook.Continent == "" && hook.Country != ALLCOUNTRIES {
+		return []string{normalize(hook.Country)}, nil
+	}
+
+	entries, err := d.directory.get()
+	if err != nil { // Error handling cases API
+		return nil, errors.New("could not list countries: " + err.Error())
+	}
+	var countries []string
+	for countryName, continent := range entries {
+		if hook.Continent == "" || strings.EqualFold(continent, hook.Continent) {
+			countries = append(countries, countryName)
+		}
+	}
+	sort.Strings(countries)
+	return countries, nil
+}
+
+/*
+normalize applies the same case handling as the country and policy routes to a country name given by a client
+*/
+func normalize(countryName string) string {
+	return strings.Title(strings.ToLower(strings.TrimSpace(countryName)))
+}
+
+// defaultDirectory lists the countries known to the cases API
+func defaultDirectory() *directory {
+	return &directory{fetch: country.GetCountries}
+}
@@ -0,0 +1,76 @@
+package notify
+
+import (
+	"covidcase/db"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Headers added to every signed notification.
+Receivers recompute HMAC-SHA256 over "<timestamp>.<body>" with their secret, compare it to any of the signatures
+and reject timestamps too far from their own clock to stop replays.
+*/
+const HEADERSIGNATURE = "X-Covidcase-Signature" // Comma separated "sha256=<hex>", one per active secret
+const HEADERTIMESTAMP = "X-Covidcase-Timestamp" // Unix seconds at which the request was signed
+
+const SECRETLEN = 32    // Random bytes in a generated secret (hex encoded to twice the length)
+const MINSECRETLEN = 16 // Shortest secret accepted from a client
+
+/*
+NewSecret returns a random hex encoded signing secret
+*/
+func NewSecret() (string, error) {
+	b := make([]byte, SECRETLEN)
+	if _, err := rand.Read(b); err != nil { // Error handling random source
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+/*
+Sign returns the hex encoded HMAC-SHA256 of body and timestamp under secret
+*/
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+RotateSecret makes secret the signing secret of hook, the old one keeps signing for grace before it is dropped
+*/
+func RotateSecret(hook db.Webhook, secret string, grace time.Duration) db.Webhook {
+	hook.PreviousSecret = ""
+	hook.PreviousSecretExpires = nil
+	if grace > 0 && hook.Secret != "" {
+		expires := time.Now().UTC().Add(grace)
+		hook.PreviousSecret = hook.Secret
+		hook.PreviousSecretExpires = &expires
+	}
+	hook.Secret = secret
+	return hook
+}
+
+/*
+signatures returns the signature header value for body, signed by every secret of hook still active at now
+*/
+func signatures(hook db.Webhook, now time.Time, body []byte) string {
+	var sigs []string
+	timestamp := now.Unix()
+
+	if hook.Secret != "" {
+		sigs = append(sigs, "sha256="+Sign(hook.Secret, timestamp, body))
+	}
+	if hook.PreviousSecret != "" && hook.PreviousSecretExpires != nil && now.Before(*hook.PreviousSecretExpires) {
+		sigs = append(sigs, "sha256="+Sign(hook.PreviousSecret, timestamp, body))
+	}
+	return strings.Join(sigs, ", ")
+}
@@ -0,0 +1,280 @@
+package notify
+
+import (
+	"context"
+	"covidcase/db"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const STREAMBUFFER = 1000    // Recent changes kept for clients resuming a stream with Last-Event-ID
+const SUBSCRIBERBUFFER = 64  // Changes queued for one client before it counts as too slow and is dropped
+const STREAMINTERVAL = 60    // Default seconds between two lookups of a streamed country and field
+const MINSTREAMINTERVAL = 10 // Lower bound in seconds between two lookups, the APIs are not to be hammered
+const RESUMEPAGE = 500       // Changes read from the change log at a time for a client resuming past the buffer
+
+// ErrStreamsClosed is returned when subscribing after the streams were ended for shutdown
+var ErrStreamsClosed = errors.New("streams are closed")
+
+/*
+Subscription struct for a client receiving the changes to one field for one country.
+Changes is closed when the client falls too far behind, so it reconnects and resumes from the buffer instead
+of holding up everyone else, or when the streams are ended for shutdown.
+A change in Missed may be sent on Changes again, clients skip ids they have seen.
+*/
+type Subscription struct {
+	Missed  []db.Change // Changes after the id the client resumed from, to be sent before anything on Changes
+	Reset   bool        // Changes after the id the client resumed from were removed, it has to start over
+	Changes <-chan db.Change
+	cancel  func()
+}
+
+// streams struct for the topics clients are subscribed to and the changes sent to them lately
+type streams struct {
+	mu     sync.Mutex
+	recent []db.Change       // Last STREAMBUFFER changes, oldest first
+	topics map[string]*topic // By field and country
+	closed bool
+}
+
+// topic struct for the subscribers of one field for one country, looked up by one worker while there are any
+type topic struct {
+	country     string
+	field       string
+	subscribers map[chan db.Change]struct{}
+	stop        chan struct{}
+}
+
+/*
+newStreams returns streams without any topics
+*/
+func newStreams() *streams {
+	return &streams{topics: make(map[string]*topic)}
+}
+
+/*
+CheckStream validates a country and field to stream changes for, returning a *ValidationError with every problem,
+or an error of its own if the cases API could not be reached to look up the country
+*/
+func (d *Dispatcher) CheckStream(ctx context.Context, countryName, field string) error {
+	problems := &ValidationError{}
+	validateField(problems, field)
+	if strings.TrimSpace(countryName) == "" {
+		problems.Add("country", "required")
+		return problems
+	}
+
+	hook := db.Webhook{ID: "stream", Country: countryName, Field: field}
+	var exists bool
+	err := d.call(hook, ctx.Done(), func() error {
+		var err error
+		exists, err = d.exists(countryName)
+		return err
+	})
+	if err != nil && len(problems.Problems) == 0 { // Error handling cases API, not the client's fault
+		return err
+	}
+	if err == nil && !exists {
+		problems.Add("country", "unknown country "+countryName)
+	}
+	return problems.err()
+}
+
+/*
+Subscribe starts streaming the changes to field for a country, along with those after the change with an id above
+after (0 for none). Changes older than the buffer, e.g. from before a restart, are read from the change log. If
+the log no longer has them either the subscription is marked Reset instead. The country and field are looked up
+every StreamInterval while anyone is subscribed.
+Cancel has to be called once the client is gone.
+*/
+func (d *Dispatcher) Subscribe(countryName, field string, after int64) (*Subscription, error) {
+	s := d.streams
+	countryName = normalize(countryName)
+	key := changeKey(field, countryName)
+	changes := make(chan db.Change, SUBSCRIBERBUFFER)
+	subscription := &Subscription{Changes: changes}
+
+	// Read from the log without holding up publishing, the buffer has whatever was published in the meantime
+	if after > 0 && !s.buffered(after) {
+		subscription.Missed, after, subscription.Reset = d.loggedChanges(key, after)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, ErrStreamsClosed
+	}
+	if after > 0 {
+		for _, change := range s.recent {
+			if change.ID > after && changeKey(change.Field, change.Country) == key {
+				subscription.Missed = append(subscription.Missed, change)
+			}
+		}
+	}
+
+	t, ok := s.topics[key]
+	if !ok {
+		t = &topic{country: countryName, field: field, subscribers: make(map[chan db.Change]struct{}), stop: make(chan struct{})}
+		if !d.spawn(func() { d.watchTopic(t) }) { // Dispatcher is stopped
+			return nil, ErrStreamsClosed
+		}
+		s.topics[key] = t
+	}
+	t.subscribers[changes] = struct{}{}
+
+	subscription.cancel = func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := t.subscribers[changes]; ok {
+			delete(t.subscribers, changes)
+			close(changes)
+		}
+		// The last one out stops the lookups, a topic replaced in the meantime is left alone
+		if len(t.subscribers) == 0 && s.topics[key] == t {
+			delete(s.topics, key)
+			close(t.stop)
+		}
+	}
+	return subscription, nil
+}
+
+/*
+buffered reports whether every change with an id above after is still in the buffer
+*/
+func (s *streams) buffered(after int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.recent) > 0 && s.recent[0].ID <= after
+}
+
+/*
+loggedChanges reads the changes with key and an id above after from the change log, returning them along with the
+id to continue from. If changes after it were pruned, or the log could not be read, it reports a reset instead.
+*/
+func (d *Dispatcher) loggedChanges(key string, after int64) ([]db.Change, int64, bool) {
+	var missed []db.Change
+	last := after
+	for {
+		changes, err := d.store.ListChanges(last, RESUMEPAGE)
+		if err != nil { // Error handling store
+			fmt.Println("Stream " + key + ": " + err.Error())
+			return nil, 0, true
+		}
+		for _, change := range changes {
+			if changeKey(change.Field, change.Country) == key {
+				missed = append(missed, change)
+			}
+		}
+		if len(changes) > 0 {
+			last = changes[len(changes)-1].ID
+		}
+		if len(changes) < RESUMEPAGE {
+			break
+		}
+	}
+	// Checked after listing, so changes removed in the meantime cannot go missing unnoticed
+	pruned, err := d.store.ChangesPruned()
+	if err != nil { // Error handling store
+		fmt.Println("Stream " + key + ": " + err.Error())
+		return nil, 0, true
+	}
+	if after < pruned {
+		return nil, 0, true
+	}
+	return missed, last, false
+}
+
+/*
+Cancel ends the subscription, it is safe to call more than once
+*/
+func (sub *Subscription) Cancel() {
+	sub.cancel()
+}
+
+/*
+EndStreams closes every subscription and refuses new ones, so open streams let the server shut down
+*/
+func (d *Dispatcher) EndStreams() {
+	s := d.streams
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for key, t := range s.topics {
+		for changes := range t.subscribers {
+			delete(t.subscribers, changes)
+			close(changes)
+		}
+		delete(s.topics, key)
+		close(t.stop)
+	}
+}
+
+/*
+watchTopic looks up the field of t every StreamInterval until t is stopped, recording every value so changes reach
+the subscribers. Values looked up for webhooks watching the same field and country are recorded as well.
+*/
+func (d *Dispatcher) watchTopic(t *topic) {
+	interval := d.config.StreamInterval
+	if interval < MINSTREAMINTERVAL*time.Second {
+		interval = MINSTREAMINTERVAL * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	hook := db.Webhook{ID: "stream", Country: t.country, Field: t.field}
+	for {
+		var value float64
+		err := d.call(hook, t.stop, func() error {
+			var err error
+			value, err = d.fetch(t.field, t.country)
+			return err
+		})
+		if err == errStopped {
+			return
+		}
+		if err != nil { // Error handling lookup, try again next interval
+			fmt.Println("Stream " + t.field + " " + t.country + ": " + err.Error())
+		} else {
+			d.sample(t.field, t.country, value)
+		}
+
+		select {
+		case <-t.stop:
+			return
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+/*
+publish keeps a change for clients resuming later and hands it to every subscriber of its field and country.
+Subscribers with a full queue are dropped rather than waited for.
+*/
+func (d *Dispatcher) publish(change db.Change) {
+	s := d.streams
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.recent = append(s.recent, change)
+	if len(s.recent) > STREAMBUFFER {
+		s.recent = s.recent[len(s.recent)-STREAMBUFFER:]
+	}
+
+	t, ok := s.topics[changeKey(change.Field, change.Country)]
+	if !ok {
+		return
+	}
+	for changes := range t.subscribers {
+		select {
+		case changes <- change:
+		default: // Too slow, the client reconnects and catches up from recent
+			delete(t.subscribers, changes)
+			close(changes)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package notify
+
+import (
+	"covidcase/db"
+	"testing"
+	"time"
+)
+
+// ids returns the ids of changes, in order
+func ids(changes []db.Change) []int64 {
+	var ids []int64
+	for _, change := range changes {
+		ids = append(ids, change.ID)
+	}
+	return ids
+}
+
+// subscribe subscribes to stringency in Norway after the given id, the subscription has to be cancelled
+func subscribe(t *testing.T, d *Dispatcher, after int64) *Subscription {
+	t.Helper()
+	subscription, err := d.Subscribe("norway", FIELDSTRINGENCY, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return subscription
+}
+
+func TestSubscribeResume(t *testing.T) {
+	store := db.NewMemoryStore()
+	d := NewDispatcher(store, DefaultConfig)
+	d.fetch = func(field, countryName string) (float64, error) { return 30, nil }
+	defer d.Stop()
+
+	// Logged before a restart, the buffer starts out empty
+	old := time.Now().Add(-48 * time.Hour)
+	logged := []db.Change{
+		{ID: 1, Country: "Norway", Field: FIELDSTRINGENCY, Time: old},
+		{ID: 2, Country: "France", Field: FIELDSTRINGENCY, Time: old},
+		{ID: 3, Country: "Norway", Field: FIELDSTRINGENCY, Time: time.Now()},
+		{ID: 4, Country: "Norway", Field: FIELDCONFIRMED, Time: time.Now()},
+		{ID: 5, Country: "Norway", Field: FIELDSTRINGENCY, Time: time.Now()},
+	}
+	for _, change := range logged {
+		if err := store.AddChange(change); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sub := subscribe(t, d, 1)
+	defer sub.Cancel()
+	if got := ids(sub.Missed); len(got) != 2 || got[0] != 3 || got[1] != 5 || sub.Reset {
+		t.Errorf("after a restart: missed %v, reset %v, want [3 5] from the log", got, sub.Reset)
+	}
+
+	// Published since, the part past the log comes from the buffer
+	d.publish(db.Change{ID: 6, Country: "Norway", Field: FIELDSTRINGENCY, Time: time.Now()})
+	sub = subscribe(t, d, 3)
+	defer sub.Cancel()
+	if got := ids(sub.Missed); len(got) != 2 || got[0] != 5 || got[1] != 6 {
+		t.Errorf("past the buffer: missed %v, want [5 6]", got)
+	}
+	sub = subscribe(t, d, 6)
+	defer sub.Cancel()
+	if len(sub.Missed) != 0 || sub.Reset {
+		t.Errorf("up to date: missed %v, reset %v, want nothing", ids(sub.Missed), sub.Reset)
+	}
+
+	// Pruned from the log, the client has to start over
+	if err := store.PruneChanges(time.Now().Add(-24 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	sub = subscribe(t, d, 1)
+	defer sub.Cancel()
+	if len(sub.Missed) != 0 || !sub.Reset {
+		t.Errorf("after pruning: missed %v, reset %v, want a reset", ids(sub.Missed), sub.Reset)
+	}
+	sub = subscribe(t, d, 2)
+	defer sub.Cancel()
+	if got := ids(sub.Missed); len(got) != 3 || sub.Reset {
+		t.Errorf("from the last change pruned: missed %v, reset %v, want [3 5 6]", got, sub.Reset)
+	}
+}
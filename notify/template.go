@@ -0,0 +1,188 @@
+package notify
+
+import (
+	"bytes"
+	"covidcase/condition"
+	"covidcase/db"
+	"encoding/json"
+	"mime"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const MAXTEMPLATE = 16 * 1024                 // Longest payload template accepted, in bytes
+const DEFAULTCONTENTTYPE = "application/json" // Content type of the default payload, and of templates giving none
+
+// Event struct for the data a payload template is rendered against
+type Event struct {
+	ID        string // Webhook id
+	Country   string
+	Field     string // Empty for conditions
+	Trigger   string
+	Old       *float64 // Value seen on the evaluation before, nil if there was none
+	New       *float64 // Value of the field, nil for conditions
+	Threshold *float64
+	Condition string
+	Values    Values    // Values a condition was evaluated against
+	Scope     string    // Period the values cover, "total" for the cumulative figures webhooks watch
+	Test      bool      // Sent on request to try out the receiver
+	Time      time.Time // Time of the evaluation, in UTC
+}
+
+/*
+Functions available to payload templates besides the text/template builtins
+*/
+var templateFuncs = template.FuncMap{
+	// json encodes a value, so strings are quoted and escaped and nil pointers come out as null
+	"json": func(value interface{}) (string, error) {
+		b, err := json.Marshal(value)
+		return string(b), err
+	},
+	// number formats a value without exponents, nil as an empty string
+	"number": func(value *float64) string {
+		if value == nil {
+			return ""
+		}
+		return number(*value)
+	},
+}
+
+/*
+newEvent returns the data a payload template is rendered against for a completed notification
+*/
+func newEvent(notification Notification) Event {
+	return Event{
+		ID:        notification.ID,
+		Country:   notification.Country,
+		Field:     notification.Field,
+		Trigger:   notification.Trigger,
+		Old:       notification.Previous,
+		New:       notification.Value,
+		Threshold: notification.Threshold,
+		Condition: notification.Condition,
+		Values:    notification.Values,
+		Scope:     "total",
+		Test:      notification.Test,
+		Time:      notification.Time,
+	}
+}
+
+/*
+render returns the payload template of hook rendered for a completed notification
+*/
+func render(hook db.Webhook, notification Notification) ([]byte, error) {
+	tmpl, err := template.New("payload").Funcs(templateFuncs).Option("missingkey=error").Parse(hook.Template)
+	if err != nil { // Checked on registration, but kept from panicking regardless
+		return nil, err
+	}
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, newEvent(notification)); err != nil {
+		return nil, err
+	}
+	return body.Bytes(), nil
+}
+
+/*
+contentType returns the content type payloads for hook are sent with
+*/
+func contentType(hook db.Webhook) string {
+	if hook.Template != "" && hook.ContentType != "" {
+		return hook.ContentType
+	}
+	return DEFAULTCONTENTTYPE
+}
+
+/*
+validateTemplate checks that the payload template of hook parses and renders sample events with and without
+values, into valid JSON if that is its content type
+*/
+func validateTemplate(problems *ValidationError, hook db.Webhook) {
+	if hook.Template == "" {
+		if hook.ContentType != "" {
+			problems.Add("content_type", "only used along with a template")
+		}
+		return
+	}
+	if hook.Channel != "" && hook.Channel != HTTP {
+		problems.Add("template", "only used by the "+HTTP+" channel")
+	}
+	if hook.Mode == BATCH || hook.Mode == DIGEST {
+		problems.Add("template", "only used in "+SINGLE+" mode, it renders one event at a time")
+	}
+	mediaType := DEFAULTCONTENTTYPE
+	if hook.ContentType != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(hook.ContentType); err != nil {
+			problems.Add("content_type", "must be a media type like "+DEFAULTCONTENTTYPE)
+			return
+		}
+	}
+	if len(hook.Template) > MAXTEMPLATE {
+		problems.Add("template", "must be at most 16 KiB")
+		return
+	}
+
+	// Render made-up events with every value present and without old, new or threshold, as on the first
+	// evaluation or for conditions, so the template has run through both ways. Conditions always come with the
+	// values of their variables.
+	old, value, threshold := 41.2, 38.9, 40.0
+	if hook.Threshold != nil {
+		threshold = *hook.Threshold
+	}
+	values := sampleValues(hook)
+	full := Notification{
+		ID:        hook.ID,
+		Country:   "Norway",
+		Field:     hook.Field,
+		Trigger:   hook.Trigger,
+		Previous:  &old,
+		Value:     &value,
+		Threshold: &threshold,
+		Condition: hook.Condition,
+		Values:    values,
+		Time:      time.Now().UTC(),
+	}
+	empty := Notification{ID: hook.ID, Country: "Norway", Field: hook.Field, Trigger: hook.Trigger,
+		Condition: hook.Condition, Values: values, Time: time.Now().UTC()}
+	for _, sample := range []struct {
+		notification Notification
+		when         string
+	}{{full, "with every value present"}, {empty, "without old, new or threshold"}} {
+		body, err := render(hook, sample.notification)
+		if err != nil {
+			problems.Add("template", err.Error())
+			return
+		}
+		if (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")) && !json.Valid(body) {
+			problems.Add("template", "does not render valid JSON for "+mediaType+" "+sample.when)
+			return
+		}
+	}
+}
+
+/*
+sampleValues returns a made-up value of the right type for every variable the condition of hook refers to,
+nil without a condition
+*/
+func sampleValues(hook db.Webhook) Values {
+	if hook.Condition == "" {
+		return nil
+	}
+	cond, err := condition.Parse(hook.Condition)
+	if err != nil { // Reported along with the condition
+		return nil
+	}
+	values := make(Values)
+	for _, name := range cond.Names() {
+		switch condition.Variables[name] {
+		case condition.NUMBER:
+			values[name] = 38.9
+		case condition.BOOL:
+			values[name] = true
+		default:
+			values[name] = "Europe"
+		}
+	}
+	return values
+}
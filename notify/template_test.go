@@ -0,0 +1,114 @@
+package notify
+
+import (
+	"covidcase/db"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestValidateTemplate(t *testing.T) {
+	threshold := 40.0
+	tests := []struct {
+		name string
+		hook db.Webhook
+		want string // Part of the problem reported, empty if the template is fine
+	}{
+		{
+			name: "json handles missing values",
+			hook: db.Webhook{Trigger: ONCHANGE, Field: FIELDSTRINGENCY, Template: `{"old": {{json .Old}}, "new": {{json .New}}}`},
+		},
+		{
+			name: "guarded number",
+			hook: db.Webhook{Trigger: ABOVE, Field: FIELDSTRINGENCY, Threshold: &threshold,
+				Template: `{"new": {{if .New}}{{number .New}}{{else}}null{{end}}, "threshold": {{json .Threshold}}}`},
+		},
+		{
+			name: "number of a missing old value",
+			hook: db.Webhook{Trigger: ONCHANGE, Field: FIELDSTRINGENCY, Template: `{"old": {{number .Old}}}`},
+			want: "does not render valid JSON for application/json without old, new or threshold",
+		},
+		{
+			name: "number of a missing threshold",
+			hook: db.Webhook{Trigger: ONCHANGE, Field: FIELDSTRINGENCY, Template: `{"threshold": {{number .Threshold}}}`},
+			want: "without old, new or threshold",
+		},
+		{
+			name: "condition without a value",
+			hook: db.Webhook{Trigger: CONDITION, Condition: "stringency > 40", Template: `{"new": {{number .New}}}`},
+			want: "without old, new or threshold",
+		},
+		{
+			name: "invalid with every value present",
+			hook: db.Webhook{Trigger: ONCHANGE, Field: FIELDSTRINGENCY, Template: `{"new": {{.New}}`},
+			want: "with every value present",
+		},
+		{
+			name: "missing values are fine for text",
+			hook: db.Webhook{Trigger: ONCHANGE, Field: FIELDSTRINGENCY, ContentType: "text/plain",
+				Template: `{{.Country}} is now {{number .New}}`},
+		},
+		{
+			name: "variable of the condition",
+			hook: db.Webhook{Trigger: CONDITION, Condition: "confirmed > 5", Template: `{"c": {{json .Values.confirmed}}}`},
+		},
+		{
+			name: "variables of every type",
+			hook: db.Webhook{Trigger: CONDITION, Condition: `stringency < 40 && continent == "Europe"`,
+				Template: `{"s": {{json .Values.stringency}}, "c": {{json .Values.continent}}, "t": {{if .Values.stringency}}true{{else}}false{{end}}}`},
+		},
+		{
+			name: "variable the condition does not refer to",
+			hook: db.Webhook{Trigger: CONDITION, Condition: "confirmed > 5", Template: `{"r": {{json .Values.recovered}}}`},
+			want: "map has no entry for key",
+		},
+		{
+			name: "values without a condition",
+			hook: db.Webhook{Trigger: ONCHANGE, Field: FIELDSTRINGENCY, Template: `{"s": {{json .Values.stringency}}}`},
+			want: "map has no entry for key",
+		},
+		{
+			name: "unknown field",
+			hook: db.Webhook{Trigger: ONCHANGE, Field: FIELDSTRINGENCY, ContentType: "text/plain", Template: `{{.Cases}}`},
+			want: "can't evaluate field Cases",
+		},
+	}
+	for _, test := range tests {
+		problems := &ValidationError{}
+		validateTemplate(problems, test.hook)
+		var messages []string
+		for _, problem := range problems.Problems {
+			messages = append(messages, problem.Message)
+		}
+		got := strings.Join(messages, "; ")
+		if test.want == "" && got != "" {
+			t.Errorf("%s: unexpected problems %q", test.name, got)
+		}
+		if test.want != "" && !strings.Contains(got, test.want) {
+			t.Errorf("%s: problems %q, want one containing %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRenderMissingValues(t *testing.T) {
+	hook := db.Webhook{ID: "abc", Trigger: ONCHANGE, Field: FIELDSTRINGENCY,
+		Template: `{"country": {{json .Country}}, "old": {{json .Old}}, "new": {{json .New}}}`}
+	value := 30.0
+	tests := []struct {
+		notification Notification
+		want         string
+	}{
+		{Notification{Country: "Norway"}, `{"country": "Norway", "old": null, "new": null}`},
+		{Notification{Country: "Norway", Value: &value}, `{"country": "Norway", "old": null, "new": 30}`},
+	}
+	for _, test := range tests {
+		body, err := render(hook, test.notification)
+		if err != nil {
+			t.Errorf("render: %v", err)
+			continue
+		}
+		if string(body) != test.want || !json.Valid(body) {
+			t.Errorf("render = %s, want %s", body, test.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package notify
+
+import (
+	"context"
+	"covidcase/condition"
+	"covidcase/db"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// TestResult struct for JSON encoding the outcome of a test notification
+type TestResult struct {
+	Payload    string      `json:"payload"`
+	StatusCode int         `json:"status_code,omitempty"` // HTTP status, or SMTP reply code for email
+	Headers    http.Header `json:"headers,omitempty"`
+	Latency    float64     `json:"latency_ms"`
+	Error      string      `json:"error,omitempty"` // Set if the request failed or the subscriber refused it
+}
+
+/*
+Test sends hook a notification built from the current values for its first country right away, regardless of its
+trigger, batched if hook is in BATCH mode and summarised as a digest of the current window in DIGEST mode.
+Only failing to look up the values is an error, the outcome of the request itself is part of the result.
+Test notifications are neither retried nor recorded in the delivery history.
+*/
+func (d *Dispatcher) Test(ctx context.Context, hook db.Webhook) (TestResult, error) {
+	var result TestResult
+
+	var cond *condition.Condition
+	if hook.Trigger == CONDITION {
+		var err error
+		if cond, err = condition.Parse(hook.Condition); err != nil {
+			return result, err
+		}
+	}
+	var notification Notification
+	err := d.call(hook, ctx.Done(), func() error {
+		countries, err := d.countries(hook)
+		if err != nil {
+			return err
+		}
+		if len(countries) == 0 {
+			return errors.New("no countries to test with")
+		}
+		notification, _, err = d.read(hook, cond, countries[0])
+		return err
+	})
+	if err != nil { // Error handling lookup
+		return result, err
+	}
+	notification.Test = true
+	body, err := encode(hook, notification)
+	if err != nil { // Error handling encoding
+		return result, err
+	}
+	result.Payload = string(body)
+
+	notifier, err := d.notifier(hook)
+	if err != nil { // Error handling channel, reported to the client like a failed request
+		result.Error = err.Error()
+		return result, nil
+	}
+	start := time.Now()
+	receipt, err := notifier.Send(ctx, hook, body)
+	result.Latency = float64(time.Since(start)) / float64(time.Millisecond)
+	result.StatusCode = receipt.StatusCode
+	result.Headers = receipt.Headers
+	if err != nil { // Error handling request or refusal, reported to the client
+		result.Error = err.Error()
+	}
+	return result, nil
+}
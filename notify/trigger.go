@@ -0,0 +1,37 @@
+package notify
+
+import (
+	"covidcase/db"
+)
+
+/*
+Fires reports whether hook should be notified of value, given the value seen on the evaluation before.
+ABOVE and BELOW only fire on the way past the threshold, so they stay quiet while the value remains on that side.
+CONDITION behaves like ABOVE, firing when the condition starts to hold.
+CROSSES needs a previous value to tell which side it came from, so it never fires on the first evaluation.
+*/
+func Fires(hook db.Webhook, previous float64, seen bool, value float64) bool {
+	switch hook.Trigger {
+	case ONTIMEOUT:
+		return true
+	case ONCHANGE:
+		return seen && value != previous
+	case CONDITION: // 1 while the condition holds
+		return value == 1 && !(seen && previous == 1)
+	}
+
+	if hook.Threshold == nil { // Threshold triggers without a threshold never fire
+		return false
+	}
+	threshold := *hook.Threshold
+	switch hook.Trigger {
+	case ABOVE:
+		return value > threshold && !(seen && previous > threshold)
+	case BELOW:
+		return value < threshold && !(seen && previous < threshold)
+	case CROSSES:
+		return seen && (previous > threshold) != (value > threshold)
+	default:
+		return false
+	}
+}
@@ -0,0 +1,51 @@
+package notify
+
+import (
+	"covidcase/db"
+	"testing"
+)
+
+// step is one value seen by a webhook, evaluation after evaluation, and whether its trigger should fire on it
+type step struct {
+	value float64
+	fires bool
+}
+
+func TestFires(t *testing.T) {
+	threshold := 50.0
+	tests := []struct {
+		name      string
+		trigger   string
+		threshold *float64
+		steps     []step
+	}{
+		{"on timeout", ONTIMEOUT, nil, []step{{40, true}, {40, true}, {60, true}}},
+		{"on change", ONCHANGE, nil, []step{{40, false}, {40, false}, {41, true}, {41, false}, {40, true}}},
+		// Only on the way past the threshold, including the first value seen beyond it
+		{"above", ABOVE, &threshold, []step{{40, false}, {50, false}, {51, true}, {60, false}, {45, false}, {55, true}}},
+		{"above from the start", ABOVE, &threshold, []step{{60, true}, {70, false}}},
+		{"below", BELOW, &threshold, []step{{60, false}, {50, false}, {49, true}, {40, false}, {55, false}, {45, true}}},
+		{"below from the start", BELOW, &threshold, []step{{40, true}, {30, false}}},
+		// Every time the value changes side, never on the first value since the side it came from is unknown
+		{"crosses", CROSSES, &threshold, []step{{60, false}, {40, true}, {45, false}, {50, false}, {51, true}, {49, true}}},
+		{"crosses from the start", CROSSES, &threshold, []step{{40, false}, {60, true}}},
+		// 1 while the condition holds, firing when it starts to
+		{"condition", CONDITION, nil, []step{{0, false}, {1, true}, {1, false}, {0, false}, {1, true}}},
+		{"condition from the start", CONDITION, nil, []step{{1, true}, {1, false}}},
+		// Misconfigured registrations stay quiet
+		{"above without threshold", ABOVE, nil, []step{{40, false}, {60, false}}},
+		{"crosses without threshold", CROSSES, nil, []step{{40, false}, {60, false}}},
+		{"unknown trigger", "ON_FULL_MOON", &threshold, []step{{40, false}, {60, false}}},
+	}
+	for _, test := range tests {
+		hook := db.Webhook{Trigger: test.trigger, Threshold: test.threshold}
+		var previous float64
+		seen := false
+		for i, s := range test.steps {
+			if fires := Fires(hook, previous, seen, s.value); fires != s.fires {
+				t.Errorf("%s: value %d (%v after %v) fires %v, want %v", test.name, i, s.value, previous, fires, s.fires)
+			}
+			previous, seen = s.value, true
+		}
+	}
+}
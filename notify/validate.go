@@ -0,0 +1,326 @@
+package notify
+
+import (
+	"context"
+	"covidcase/condition"
+	"covidcase/db"
+	"fmt"
+	"math"
+	"net/mail"
+	"net/url"
+	"strings"
+)
+
+const MAXTIMEOUT = 7 * 24 * 60 * 60 // Upper bound in seconds for an evaluation interval
+const MAXCOUNTRIES = 250            // Longest list of countries a webhook can watch
+
+// Problem struct for JSON encoding one thing wrong with a webhook
+type Problem struct {
+	Field   string `json:"field"` // Setting at fault, "body" if the request as a whole is
+	Message string `json:"message"`
+}
+
+// ValidationError struct for every problem found with a webhook at once
+type ValidationError struct {
+	Problems []Problem `json:"problems"`
+}
+
+// Add records a problem with field
+func (e *ValidationError) Add(field, message string) {
+	e.Problems = append(e.Problems, Problem{Field: field, Message: message})
+}
+
+// Has reports whether a problem with field has been recorded
+func (e *ValidationError) Has(field string) bool {
+	for _, problem := range e.Problems {
+		if problem.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Error returns all problems on one line
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		messages[i] = problem.Field + ": " + problem.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// err returns e as an error, or nil if no problems were found
+func (e *ValidationError) err() error {
+	if len(e.Problems) == 0 {
+		return nil
+	}
+	return e
+}
+
+/*
+Validate checks the settings of hook without looking anything up, returning a *ValidationError with every problem.
+The trigger and field have to be known, a threshold has to lie within the range of the field so it can be reached,
+a condition has to parse and type-check and a payload template has to render.
+*/
+func Validate(hook db.Webhook) error {
+	problems := &ValidationError{}
+
+	validateChannel(problems, hook)
+	if hook.Timeout < MINTIMEOUT || hook.Timeout > MAXTIMEOUT {
+		problems.Add("timeout", fmt.Sprintf("must be from %d to %d seconds", MINTIMEOUT, MAXTIMEOUT))
+	}
+	validateCountries(problems, hook)
+	if hook.Mode != "" && hook.Mode != SINGLE && hook.Mode != BATCH && hook.Mode != DIGEST {
+		problems.Add("mode", "must be "+SINGLE+", "+BATCH+" or "+DIGEST)
+	}
+	validateWindow(problems, hook)
+	validateTemplate(problems, hook)
+	if hook.Secret != "" && len(hook.Secret) < MINSECRETLEN {
+		problems.Add("secret", fmt.Sprintf("must be at least %d characters", MINSECRETLEN))
+	}
+
+	if hook.Trigger != CONDITION && hook.Condition != "" {
+		problems.Add("condition", "only used by "+CONDITION+" triggers")
+	}
+	switch hook.Trigger {
+	case ONCHANGE, ONTIMEOUT:
+		validateField(problems, hook.Field)
+		if hook.Threshold != nil {
+			problems.Add("threshold", "only used by "+ABOVE+", "+BELOW+" and "+CROSSES+" triggers")
+		}
+	case ABOVE, BELOW, CROSSES:
+		if validateField(problems, hook.Field) {
+			validateThreshold(problems, hook)
+		}
+	case CONDITION:
+		validateCondition(problems, hook)
+	case "":
+		problems.Add("trigger", "required")
+	default:
+		problems.Add("trigger", "must be one of "+strings.Join([]string{ONCHANGE, ONTIMEOUT, ABOVE, BELOW, CROSSES, CONDITION}, ", "))
+	}
+	return problems.err()
+}
+
+/*
+Check validates hook like Validate, then makes sure its URL resolves to addresses notifications may be sent to,
+its channel is configured and its country is known to the cases API.
+A failure to reach the cases API is returned as an error of its own rather than a *ValidationError,
+unless there are other problems to report.
+*/
+func (d *Dispatcher) Check(ctx context.Context, hook db.Webhook) error {
+	problems := &ValidationError{}
+	if err := Validate(hook); err != nil {
+		problems = err.(*ValidationError)
+	}
+
+	if hook.URL != "" && !problems.Has("url") {
+		if err := d.guard.CheckURL(ctx, hook.URL); err != nil {
+			problems.Add("url", err.Error())
+		}
+	}
+	if !problems.Has("channel") && hook.Channel != "" {
+		if _, err := d.notifier(hook); err != nil {
+			problems.Add("channel", hook.Channel+" is not configured on this server")
+		}
+	}
+	// A continent or all countries were checked by name already, lists are checked one by one
+	var field string
+	var countries []string
+	if len(hook.Countries) > 0 && !problems.Has("countries") {
+		field, countries = "countries", hook.Countries
+	} else if hook.Country != "" && hook.Country != ALLCOUNTRIES && !problems.Has("country") {
+		field, countries = "country", []string{hook.Country}
+	}
+	for _, countryName := range countries {
+		var exists bool
+		err := d.call(hook, ctx.Done(), func() error {
+			var err error
+			exists, err = d.exists(countryName)
+			return err
+		})
+		if err != nil && len(problems.Problems) == 0 { // Error handling cases API, not the client's fault
+			return err
+		}
+		if err != nil { // Report what was found so far instead
+			break
+		}
+		if !exists {
+			problems.Add(field, "unknown country "+countryName)
+		}
+	}
+	return problems.err()
+}
+
+/*
+validateChannel checks that hook has the settings its channel needs, a URL for the HTTP based ones and recipients
+for email. The addresses the URL resolves to are up to Check.
+*/
+func validateChannel(problems *ValidationError, hook db.Webhook) {
+	switch hook.Channel {
+	case "", HTTP, SLACK, TEAMS:
+		if hook.URL == "" {
+			problems.Add("url", "required")
+		} else if target, err := url.Parse(hook.URL); err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			problems.Add("url", "must be an absolute http or https URL")
+		}
+		if hook.To != nil {
+			problems.Add("to", "only used by the "+EMAIL+" channel")
+		}
+		if hook.Subject != "" {
+			problems.Add("subject", "only used by the "+EMAIL+" channel")
+		}
+	case EMAIL:
+		if hook.URL != "" {
+			problems.Add("url", "not used by the "+EMAIL+" channel, give recipients in to")
+		}
+		if len(hook.To) == 0 || len(hook.To) > MAXRECIPIENTS {
+			problems.Add("to", fmt.Sprintf("must list from 1 to %d addresses", MAXRECIPIENTS))
+		}
+		for _, to := range hook.To {
+			// Bare addresses only, names and angle brackets would end up in the SMTP envelope
+			if address, err := mail.ParseAddress(to); err != nil || address.Address != to {
+				problems.Add("to", "invalid address "+to)
+				break
+			}
+		}
+		if strings.ContainsAny(hook.Subject, "\r\n") {
+			problems.Add("subject", "must be a single line")
+		}
+	default:
+		problems.Add("channel", "must be one of "+strings.Join([]string{HTTP, EMAIL, SLACK, TEAMS}, ", "))
+	}
+}
+
+/*
+validateCountries checks that hook watches exactly one of a country, a list of countries or a continent
+*/
+func validateCountries(problems *ValidationError, hook db.Webhook) {
+	given := 0
+	if strings.TrimSpace(hook.Country) != "" {
+		given++
+	}
+	if hook.Countries != nil {
+		given++
+		if len(hook.Countries) == 0 || len(hook.Countries) > MAXCOUNTRIES {
+			problems.Add("countries", fmt.Sprintf("must list from 1 to %d countries", MAXCOUNTRIES))
+		}
+		seen := make(map[string]bool)
+		for _, countryName := range hook.Countries {
+			if strings.TrimSpace(countryName) == "" || countryName == ALLCOUNTRIES {
+				problems.Add("countries", "must only hold country names")
+				break
+			}
+			if seen[normalize(countryName)] {
+				problems.Add("countries", "lists "+countryName+" more than once")
+				break
+			}
+			seen[normalize(countryName)] = true
+		}
+	}
+	if hook.Continent != "" {
+		given++
+		known := false
+		for _, continent := range CONTINENTS {
+			known = known || strings.EqualFold(continent, hook.Continent)
+		}
+		if !known {
+			problems.Add("continent", "must be one of "+strings.Join(CONTINENTS, ", "))
+		}
+	}
+
+	if given == 0 {
+		problems.Add("country", "required, or countries or continent instead")
+	} else if given > 1 {
+		problems.Add("country", "give only one of country, countries and continent")
+	}
+}
+
+/*
+validateWindow checks that DIGEST webhooks have a window, and that nothing else sets digest options
+*/
+func validateWindow(problems *ValidationError, hook db.Webhook) {
+	if hook.Mode != DIGEST {
+		if hook.Window != "" {
+			problems.Add("window", "only used in "+DIGEST+" mode")
+		}
+		if hook.SkipEmpty {
+			problems.Add("skip_empty", "only used in "+DIGEST+" mode")
+		}
+		return
+	}
+	switch hook.Window {
+	case HOURLY, DAILY, WEEKLY:
+	case "":
+		problems.Add("window", "required in "+DIGEST+" mode")
+	default:
+		problems.Add("window", "must be "+HOURLY+", "+DAILY+" or "+WEEKLY)
+	}
+}
+
+/*
+validateField checks that field is known, reporting whether it is
+*/
+func validateField(problems *ValidationError, field string) bool {
+	if _, _, ok := fieldRange(field); !ok {
+		if field == "" {
+			problems.Add("field", "required")
+		} else {
+			problems.Add("field", "must be "+FIELDSTRINGENCY+" or "+FIELDCONFIRMED)
+		}
+		return false
+	}
+	return true
+}
+
+/*
+validateThreshold checks that the threshold of an ABOVE, BELOW or CROSSES webhook can be reached by its field
+*/
+func validateThreshold(problems *ValidationError, hook db.Webhook) {
+	if hook.Threshold == nil {
+		problems.Add("threshold", "required by "+hook.Trigger+" triggers")
+		return
+	}
+	threshold := *hook.Threshold
+	min, max, _ := fieldRange(hook.Field)
+
+	// A value above max or below min can never be seen, so neither can a crossing there
+	if hook.Trigger == BELOW {
+		if threshold <= min || threshold > max {
+			problems.Add("threshold", fmt.Sprintf("for %s %s must be above %g and at most %g", hook.Field, hook.Trigger, min, max))
+		}
+	} else if threshold < min || threshold >= max {
+		problems.Add("threshold", fmt.Sprintf("for %s %s must be at least %g and below %g", hook.Field, hook.Trigger, min, max))
+	}
+}
+
+/*
+validateCondition checks the expression of a CONDITION webhook, which takes the place of both field and threshold
+*/
+func validateCondition(problems *ValidationError, hook db.Webhook) {
+	if hook.Field != "" {
+		problems.Add("field", "not used by "+CONDITION+" triggers, refer to it in the condition")
+	}
+	if hook.Threshold != nil {
+		problems.Add("threshold", "not used by "+CONDITION+" triggers, compare against it in the condition")
+	}
+	if hook.Condition == "" {
+		problems.Add("condition", "required by "+CONDITION+" triggers")
+	} else if _, err := condition.Parse(hook.Condition); err != nil {
+		problems.Add("condition", err.Error())
+	}
+}
+
+/*
+fieldRange returns the smallest and largest value a field can take
+*/
+func fieldRange(field string) (float64, float64, bool) {
+	switch field {
+	case FIELDSTRINGENCY:
+		return 0, 100, true
+	case FIELDCONFIRMED:
+		return 0, math.Inf(1), true
+	default:
+		return 0, 0, false
+	}
+}
@@ -0,0 +1,80 @@
+package notify
+
+import (
+	"covidcase/db"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	valid := db.Webhook{URL: "http://example.com/hook", Timeout: 3600, Field: FIELDSTRINGENCY, Country: "Norway", Trigger: ONCHANGE}
+	threshold, outside := 50.0, 100.0
+	tests := []struct {
+		name   string
+		modify func(hook *db.Webhook)
+		fields string // Fields with problems, sorted and separated by spaces, empty if the webhook is valid
+	}{
+		{"valid", func(hook *db.Webhook) {}, ""},
+		{"url required", func(hook *db.Webhook) { hook.URL = "" }, "url"},
+		{"relative url", func(hook *db.Webhook) { hook.URL = "/hook" }, "url"},
+		{"ftp url", func(hook *db.Webhook) { hook.URL = "ftp://example.com/hook" }, "url"},
+		{"timeout too short", func(hook *db.Webhook) { hook.Timeout = MINTIMEOUT - 1 }, "timeout"},
+		{"timeout too long", func(hook *db.Webhook) { hook.Timeout = MAXTIMEOUT + 1 }, "timeout"},
+		{"unknown channel", func(hook *db.Webhook) { hook.Channel = "pigeon" }, "channel"},
+		{"recipients over http", func(hook *db.Webhook) { hook.To = []string{"a@example.com"}; hook.Subject = "s" }, "subject to"},
+		{"email without recipients", func(hook *db.Webhook) { hook.Channel = EMAIL }, "to url"},
+		{"email with a named recipient", func(hook *db.Webhook) {
+			hook.Channel, hook.URL, hook.To = EMAIL, "", []string{"Ann <ann@example.com>"}
+		}, "to"},
+		{"email subject on two lines", func(hook *db.Webhook) {
+			hook.Channel, hook.URL, hook.To, hook.Subject = EMAIL, "", []string{"ann@example.com"}, "a\r\nBcc: b@example.com"
+		}, "subject"},
+		{"no country", func(hook *db.Webhook) { hook.Country = " " }, "country"},
+		{"country and continent", func(hook *db.Webhook) { hook.Continent = "Europe" }, "country"},
+		{"unknown continent", func(hook *db.Webhook) { hook.Country, hook.Continent = "", "Atlantis" }, "continent"},
+		{"empty list of countries", func(hook *db.Webhook) { hook.Country, hook.Countries = "", []string{} }, "countries"},
+		{"all countries in a list", func(hook *db.Webhook) { hook.Country, hook.Countries = "", []string{ALLCOUNTRIES} }, "countries"},
+		{"country listed twice", func(hook *db.Webhook) { hook.Country, hook.Countries = "", []string{"Norway", "norway"} }, "countries"},
+		{"unknown mode", func(hook *db.Webhook) { hook.Mode = "bulk" }, "mode"},
+		{"digest without window", func(hook *db.Webhook) { hook.Mode = DIGEST }, "window"},
+		{"unknown window", func(hook *db.Webhook) { hook.Mode, hook.Window = DIGEST, "monthly" }, "window"},
+		{"window outside digests", func(hook *db.Webhook) { hook.Window, hook.SkipEmpty = DAILY, true }, "skip_empty window"},
+		{"short secret", func(hook *db.Webhook) { hook.Secret = "short" }, "secret"},
+		{"trigger required", func(hook *db.Webhook) { hook.Trigger = "" }, "trigger"},
+		{"unknown trigger", func(hook *db.Webhook) { hook.Trigger = "ON_FULL_MOON" }, "trigger"},
+		{"field required", func(hook *db.Webhook) { hook.Field = "" }, "field"},
+		{"unknown field", func(hook *db.Webhook) { hook.Field = "deaths" }, "field"},
+		{"threshold on change", func(hook *db.Webhook) { hook.Threshold = &threshold }, "threshold"},
+		{"threshold required", func(hook *db.Webhook) { hook.Trigger = ABOVE }, "threshold"},
+		{"threshold out of reach", func(hook *db.Webhook) { hook.Trigger, hook.Threshold = ABOVE, &outside }, "threshold"},
+		{"threshold reachable below", func(hook *db.Webhook) { hook.Trigger, hook.Threshold = BELOW, &outside }, ""},
+		{"condition outside conditions", func(hook *db.Webhook) { hook.Condition = "confirmed > 5" }, "condition"},
+		{"condition required", func(hook *db.Webhook) { hook.Trigger, hook.Field = CONDITION, "" }, "condition"},
+		{"condition with a field", func(hook *db.Webhook) { hook.Trigger, hook.Condition = CONDITION, "confirmed > 5" }, "field"},
+		{"malformed condition", func(hook *db.Webhook) { hook.Trigger, hook.Field, hook.Condition = CONDITION, "", "confirmed >" }, "condition"},
+		{"template that does not parse", func(hook *db.Webhook) { hook.Template = "{{.Country" }, "template"},
+		// Everything is reported at once
+		{"all at once", func(hook *db.Webhook) {
+			hook.URL, hook.Timeout, hook.Country, hook.Mode, hook.Trigger = "", 0, "", "bulk", "ON_FULL_MOON"
+		}, "country mode timeout trigger url"},
+	}
+	for _, test := range tests {
+		hook := valid
+		test.modify(&hook)
+		err := Validate(hook)
+		var fields []string
+		if problems, ok := err.(*ValidationError); ok {
+			for _, problem := range problems.Problems {
+				fields = append(fields, problem.Field)
+			}
+		} else if err != nil {
+			t.Errorf("%s: Validate = %v, want a *ValidationError", test.name, err)
+			continue
+		}
+		sort.Strings(fields)
+		if strings.Join(fields, " ") != test.fields {
+			t.Errorf("%s: problems with %v (%v), want %q", test.name, fields, err, test.fields)
+		}
+	}
+}
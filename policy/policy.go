@@ -15,6 +15,7 @@ const BASEURL = "https://covidtrackerapi.bsg.ox.ac.uk/api/"
 const LATESTURL = "https://covidtrackerapi.bsg.ox.ac.uk/api/v2/stringency/actions/%s/%s"   // URL for latest policy
 const SCOPEURL = "https://covidtrackerapi.bsg.ox.ac.uk/api/v2/stringency/date-range/%s/%s" // URL for policy in scope
 const ALPHA3URL = "https://restcountries.eu/rest/v2/name/%s"                               // Retrieves general info about a country
+const LATESTLAG = 10                                                                       // Days the latest values lag behind today
 
 // StringencyInfo struct for JSON encoding HTTP request data
 type StringencyInfo struct {
@@ -46,7 +47,7 @@ func GetPolicyData(startDate, endDate, countryName string) (StringencyInfo, erro
 
 	if startDate == "" || endDate == "" { // Format within complete scope
 		now := time.Now()
-		now = now.AddDate(0, 0, -10)           // Latest values are from 10 days ago
+		now = now.AddDate(0, 0, -LATESTLAG)    // Latest values are from 10 days ago
 		latestDate := now.Format("2006-01-02") // YYYY-MM-DD string
 
 		// Insert parameters into POLICYURL for HTTP GET request
@@ -81,19 +82,20 @@ func GetPolicyData(startDate, endDate, countryName string) (StringencyInfo, erro
 		// extract from data key
 		stringencyData := result["data"].(map[string]interface{})
 		// Get stringency values from start date
-		startDateStringency, _ := getStringencyScope(stringencyData, startDate, alpha3, "stringency_actual")
+		startDateStringency := getStringencyScope(stringencyData, startDate, alpha3)
 		// Get stringency values from end date
-		endDateStringency, _ := getStringencyScope(stringencyData, endDate, alpha3, "stringency_actual")
+		endDateStringency := getStringencyScope(stringencyData, endDate, alpha3)
 
 		// Inserting and processing data into stringencyInfo struct
 		// Remember to use type assertion at the end ".(float64)/.(string)" since the program has to deal with interface{}
-		stringencyInfo.Country = countryName                    // Country
-		stringencyInfo.Scope = "total"                          // Scope
-		stringencyInfo.Stringency = endDateStringency.(float64) // Stringency
-		if stringencyInfo.Stringency == -1 {                    // Check if missing information, set to 0 if so
+		stringencyInfo.Country = countryName          // Country
+		stringencyInfo.Scope = "total"                // Scope
+		stringencyInfo.Stringency = endDateStringency // Stringency
+		// Check if missing information on either date, set to 0 if so
+		if endDateStringency == -1 || startDateStringency == -1 {
 			stringencyInfo.Trend = 0
 		} else {
-			stringencyInfo.Trend = endDateStringency.(float64) - startDateStringency.(float64) // Trend
+			stringencyInfo.Trend = endDateStringency - startDateStringency // Trend
 		}
 
 		return stringencyInfo, nil
@@ -144,18 +146,16 @@ func getStringency(data map[string]interface{}, key string) interface{} {
 }
 
 /*
-getStringencyScope recursive func that returns a value 'stringency_actual' or 'stringency'
-if it exists for the scope parameter
+getStringencyScope returns the value 'stringency_actual', or else 'stringency', of a country on a date of the scope,
+-1 if the date, the country or both keys are missing
 */
-func getStringencyScope(data map[string]interface{}, date, alpha3, key string) (interface{}, bool) {
-	res, ok := data[date].(map[string]interface{})[alpha3].(map[string]interface{})[key] // First key
-	if !ok {                                                                             // incase first key doesn't work try second
-		res, ok = getStringencyScope(data, date, alpha3, "stringency")
-		if !ok {
-			return -1, true // Return -1 if no keys found
-		} else {
-			return res, true // Return second key if found
+func getStringencyScope(data map[string]interface{}, date, alpha3 string) float64 {
+	day, _ := data[date].(map[string]interface{})
+	country, _ := day[alpha3].(map[string]interface{})
+	for _, key := range []string{"stringency_actual", "stringency"} { // incase first key doesn't work try second
+		if res, ok := country[key].(float64); ok {
+			return res
 		}
 	}
-	return res, true
+	return -1 // Return -1 if no keys found
 }